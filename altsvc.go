@@ -0,0 +1,302 @@
+package minhq
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidAltSvc is returned when an Alt-Svc header field can't be parsed.
+var ErrInvalidAltSvc = errors.New("invalid Alt-Svc header field")
+
+// defaultAltSvcMaxAge is the lifetime of an alternative service that doesn't
+// include the ma parameter.
+const defaultAltSvcMaxAge = 24 * time.Hour
+
+// AltSvc is an alternative service, as advertised in an Alt-Svc header field
+// (RFC 7838).
+type AltSvc struct {
+	// Protocol is the ALPN identifier of the alternative.
+	Protocol string
+	// Host is the host of the alternative.  This is empty if the alternative
+	// is on the same host as the origin.
+	Host string
+	// Port is the port of the alternative.
+	Port int
+	// MaxAge is how long the alternative can be used for.
+	MaxAge time.Duration
+	// Persist is set if the alternative can be kept after a network change.
+	Persist bool
+}
+
+// Authority returns the host and port of the alternative, using the given host
+// if the alternative doesn't include one.
+func (alt *AltSvc) Authority(originHost string) string {
+	host := alt.Host
+	if host == "" {
+		host = originHost
+	}
+	return net.JoinHostPort(host, strconv.Itoa(alt.Port))
+}
+
+// IsHQ returns true if the alternative uses HTTP over QUIC.
+func (alt *AltSvc) IsHQ() bool {
+	return alt.Protocol == "hq" || strings.HasPrefix(alt.Protocol, "hq-")
+}
+
+// String formats the alternative for use in an Alt-Svc header field.
+func (alt *AltSvc) String() string {
+	s := altSvcEscape(alt.Protocol) + "=\"" + net.JoinHostPort(alt.Host, strconv.Itoa(alt.Port)) + "\""
+	if alt.MaxAge != 0 && alt.MaxAge != defaultAltSvcMaxAge {
+		s += "; ma=" + strconv.FormatInt(int64(alt.MaxAge/time.Second), 10)
+	}
+	if alt.Persist {
+		s += "; persist=1"
+	}
+	return s
+}
+
+// altSvcEscape percent-encodes the characters of a protocol identifier that
+// aren't allowed in a token, plus the percent character itself.
+func altSvcEscape(protocol string) string {
+	var b strings.Builder
+	for i := 0; i < len(protocol); i++ {
+		c := protocol[i]
+		if c == '%' || !isTokenChar(c) {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func isTokenChar(c byte) bool {
+	if c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// altSvcParser is a simple parser for Alt-Svc header field values.
+type altSvcParser struct {
+	s string
+}
+
+func (p *altSvcParser) skipSpace() {
+	p.s = strings.TrimLeft(p.s, " \t")
+}
+
+func (p *altSvcParser) consume(c byte) bool {
+	p.skipSpace()
+	if len(p.s) > 0 && p.s[0] == c {
+		p.s = p.s[1:]
+		return true
+	}
+	return false
+}
+
+func (p *altSvcParser) token() (string, error) {
+	p.skipSpace()
+	i := 0
+	for i < len(p.s) && isTokenChar(p.s[i]) {
+		i++
+	}
+	if i == 0 {
+		return "", ErrInvalidAltSvc
+	}
+	t := p.s[:i]
+	p.s = p.s[i:]
+	return t, nil
+}
+
+func (p *altSvcParser) quotedString() (string, error) {
+	p.skipSpace()
+	if len(p.s) == 0 || p.s[0] != '"' {
+		return "", ErrInvalidAltSvc
+	}
+	var b strings.Builder
+	for i := 1; i < len(p.s); i++ {
+		switch p.s[i] {
+		case '"':
+			p.s = p.s[i+1:]
+			return b.String(), nil
+		case '\\':
+			i++
+			if i >= len(p.s) {
+				return "", ErrInvalidAltSvc
+			}
+		}
+		b.WriteByte(p.s[i])
+	}
+	return "", ErrInvalidAltSvc
+}
+
+func (p *altSvcParser) value() (string, error) {
+	p.skipSpace()
+	if len(p.s) > 0 && p.s[0] == '"' {
+		return p.quotedString()
+	}
+	return p.token()
+}
+
+func (p *altSvcParser) alternative() (*AltSvc, error) {
+	protocol, err := p.token()
+	if err != nil {
+		return nil, err
+	}
+	protocol, err = url.PathUnescape(protocol)
+	if err != nil {
+		return nil, ErrInvalidAltSvc
+	}
+	if !p.consume('=') {
+		return nil, ErrInvalidAltSvc
+	}
+	authority, err := p.quotedString()
+	if err != nil {
+		return nil, err
+	}
+	host, portString, err := net.SplitHostPort(authority)
+	if err != nil {
+		return nil, ErrInvalidAltSvc
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, ErrInvalidAltSvc
+	}
+
+	alt := &AltSvc{Protocol: protocol, Host: host, Port: int(port), MaxAge: defaultAltSvcMaxAge}
+	for p.consume(';') {
+		name, err := p.token()
+		if err != nil {
+			return nil, err
+		}
+		if !p.consume('=') {
+			return nil, ErrInvalidAltSvc
+		}
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		switch strings.ToLower(name) {
+		case "ma":
+			ma, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return nil, ErrInvalidAltSvc
+			}
+			alt.MaxAge = time.Duration(ma) * time.Second
+		case "persist":
+			alt.Persist = v == "1"
+		}
+	}
+	return alt, nil
+}
+
+// ParseAltSvc parses the value of an Alt-Svc header field.  If the value is
+// "clear", this returns no alternatives and clear is set.
+func ParseAltSvc(value string) (alternatives []AltSvc, clear bool, err error) {
+	p := &altSvcParser{value}
+	p.skipSpace()
+	if strings.TrimRight(p.s, " \t") == "clear" {
+		return nil, true, nil
+	}
+	for {
+		alt, err := p.alternative()
+		if err != nil {
+			return nil, false, err
+		}
+		alternatives = append(alternatives, *alt)
+		if !p.consume(',') {
+			break
+		}
+	}
+	p.skipSpace()
+	if len(p.s) > 0 {
+		return nil, false, ErrInvalidAltSvc
+	}
+	return alternatives, false, nil
+}
+
+// altSvcEntry is a cached alternative.
+type altSvcEntry struct {
+	authority string
+	expires   time.Time
+}
+
+// AltSvcCache remembers HTTP over QUIC alternatives for origins.  The zero
+// value is ready to use.
+type AltSvcCache struct {
+	lock    sync.Mutex
+	entries map[string]altSvcEntry
+}
+
+// altSvcOrigin works out the origin for a URL, adding the default port.
+func altSvcOrigin(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	return u.Scheme + "://" + net.JoinHostPort(u.Hostname(), port)
+}
+
+// Get returns the authority of an alternative for the origin of the URL, if
+// there is one that hasn't expired.
+func (cache *AltSvcCache) Get(u *url.URL) (string, bool) {
+	origin := altSvcOrigin(u)
+
+	defer cache.lock.Unlock()
+	cache.lock.Lock()
+	entry, ok := cache.entries[origin]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(entry.expires) {
+		delete(cache.entries, origin)
+		return "", false
+	}
+	return entry.authority, true
+}
+
+// Update processes an Alt-Svc header field value for the origin of the URL.
+// Only the first HTTP over QUIC alternative is kept; like any new Alt-Svc
+// header field, a value without one replaces what was cached.  An invalid value
+// is ignored.
+func (cache *AltSvcCache) Update(u *url.URL, value string) {
+	alternatives, clear, err := ParseAltSvc(value)
+	if err != nil {
+		return
+	}
+	if clear {
+		cache.Remove(u)
+		return
+	}
+	for _, alt := range alternatives {
+		if alt.IsHQ() {
+			cache.set(u, alt.Authority(u.Hostname()), time.Now().Add(alt.MaxAge))
+			return
+		}
+	}
+	cache.Remove(u)
+}
+
+func (cache *AltSvcCache) set(u *url.URL, authority string, expires time.Time) {
+	defer cache.lock.Unlock()
+	cache.lock.Lock()
+	if cache.entries == nil {
+		cache.entries = make(map[string]altSvcEntry)
+	}
+	cache.entries[altSvcOrigin(u)] = altSvcEntry{authority, expires}
+}
+
+// Remove forgets any alternative for the origin of the URL.  This is used
+// when an alternative doesn't work.
+func (cache *AltSvcCache) Remove(u *url.URL) {
+	defer cache.lock.Unlock()
+	cache.lock.Lock()
+	delete(cache.entries, altSvcOrigin(u))
+}
@@ -0,0 +1,244 @@
+package minhq
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/martinthomson/minhq/hc"
+)
+
+// AltSvcClient makes requests using net/http until a server advertises an HTTP
+// over QUIC alternative with Alt-Svc.  After that, requests for the same origin
+// use the alternative, until it expires or fails.  If a connection to the
+// alternative can't be made, the request is sent using net/http instead.
+//
+// A request that fails after it is sent to the alternative is also sent using
+// net/http, but only if that is safe: the method has to be idempotent and any
+// request body has to be replayable with Request.GetBody.  Other requests fail
+// with the error from the alternative.
+type AltSvcClient struct {
+	// HTTP is used for requests that don't have an alternative.  If this is
+	// nil, http.DefaultClient is used.
+	HTTP *http.Client
+	// Client is used for requests that have an alternative.
+	Client *Client
+	// Cache holds the alternatives that have been advertised.
+	Cache AltSvcCache
+
+	// connectLock protects Client, which can't be used concurrently.
+	connectLock sync.Mutex
+}
+
+// NewAltSvcClient makes an AltSvcClient with the given configuration.
+func NewAltSvcClient(config *Config) *AltSvcClient {
+	return &AltSvcClient{Client: &Client{Config: *config}}
+}
+
+func (c *AltSvcClient) httpClient() *http.Client {
+	if c.HTTP == nil {
+		return http.DefaultClient
+	}
+	return c.HTTP
+}
+
+// Do sends a request and returns the response.
+func (c *AltSvcClient) Do(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "https" {
+		if alternative, ok := c.Cache.Get(req.URL); ok {
+			connection, err := c.connect(req, alternative)
+			if err == nil {
+				resp, err := fetchHTTP(connection, req)
+				if err == nil {
+					return resp, nil
+				}
+				c.Cache.Remove(req.URL)
+				retry := rewindRequest(req)
+				if retry == nil {
+					return nil, err
+				}
+				req = retry
+			} else {
+				// The alternative didn't work, so don't try it again.
+				c.Cache.Remove(req.URL)
+			}
+		}
+	}
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if req.URL.Scheme == "https" {
+		if altSvc := resp.Header.Get("Alt-Svc"); altSvc != "" {
+			c.Cache.Update(req.URL, altSvc)
+		}
+	}
+	return resp, nil
+}
+
+// idempotentMethods are the methods that can be repeated safely.
+var idempotentMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"OPTIONS": true,
+	"TRACE":   true,
+	"PUT":     true,
+	"DELETE":  true,
+}
+
+// rewindRequest prepares a request that failed to be sent again.  This returns
+// nil if the request can't be repeated.
+func rewindRequest(req *http.Request) *http.Request {
+	if !idempotentMethods[req.Method] {
+		return nil
+	}
+	if req.Body == nil || req.Body == http.NoBody {
+		return req
+	}
+	if req.GetBody == nil {
+		return nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil
+	}
+	retry := *req
+	retry.Body = body
+	return &retry
+}
+
+// connect finds or makes a connection to the alternative for the request.
+func (c *AltSvcClient) connect(req *http.Request, alternative string) (*ClientConnection, error) {
+	defer c.connectLock.Unlock()
+	c.connectLock.Lock()
+	connection := c.Client.Connections[hostKey(req.URL.Host)]
+	if connection != nil {
+		select {
+		case <-connection.Closed():
+		default:
+			return connection, nil
+		}
+	}
+	return c.Client.connect(req.Context(), req.URL.Host, alternative)
+}
+
+// Get makes a GET request.
+func (c *AltSvcClient) Get(url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+// Close closes any HTTP over QUIC connections.
+func (c *AltSvcClient) Close() error {
+	return c.Client.Close()
+}
+
+// connectionHeaders are the header fields that HTTP over QUIC doesn't use.
+var connectionHeaders = map[string]bool{
+	"connection":        true,
+	"host":              true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"te":                true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+// httpHeaderFields converts a net/http header into header fields.
+func httpHeaderFields(header http.Header) []hc.HeaderField {
+	var headers []hc.HeaderField
+	for name, values := range header {
+		name = strings.ToLower(name)
+		if connectionHeaders[name] {
+			continue
+		}
+		for _, v := range values {
+			headers = append(headers, hc.HeaderField{Name: name, Value: v})
+		}
+	}
+	return headers
+}
+
+// httpHeader converts header fields into a net/http header.  Pseudo-header
+// fields are dropped.
+func httpHeader(headers []hc.HeaderField) http.Header {
+	header := make(http.Header)
+	for _, h := range headers {
+		if strings.HasPrefix(h.Name, ":") {
+			continue
+		}
+		header.Add(h.Name, h.Value)
+	}
+	return header
+}
+
+// fetchHTTP sends a net/http request over an HTTP over QUIC connection.
+func fetchHTTP(connection *ClientConnection, req *http.Request) (*http.Response, error) {
+	clientRequest, err := connection.Fetch(req.Method, req.URL.String(), httpHeaderFields(req.Header)...)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for pp := range clientRequest.Pushes {
+			_ = pp.Cancel()
+		}
+	}()
+	if req.Body != nil {
+		_, err = io.Copy(clientRequest, req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = clientRequest.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	clientResponse := clientRequest.Response()
+	if clientResponse == nil {
+		return nil, ErrNoResponse
+	}
+	resp := &http.Response{
+		Status:        strconv.Itoa(clientResponse.Status) + " " + http.StatusText(clientResponse.Status),
+		StatusCode:    clientResponse.Status,
+		Proto:         "HTTP/QUIC",
+		Header:        httpHeader(clientResponse.Headers),
+		Body:          &responseBody{clientResponse, false},
+		ContentLength: -1,
+		Request:       req,
+	}
+	if cl, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+		resp.ContentLength = cl
+	}
+	return resp, nil
+}
+
+// responseBody adapts ClientResponse so that it can be closed.  Closing the
+// body before reading all of it cancels the response.
+type responseBody struct {
+	resp *ClientResponse
+	eof  bool
+}
+
+func (b *responseBody) Read(p []byte) (int, error) {
+	n, err := b.resp.Read(p)
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *responseBody) Close() error {
+	if b.eof {
+		return nil
+	}
+	b.eof = true
+	return b.resp.Cancel()
+}
@@ -0,0 +1,37 @@
+package minhq
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/stvp/assert"
+)
+
+func TestRewindRequest(t *testing.T) {
+	req, err := http.NewRequest("GET", "https://example.com/", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, req, rewindRequest(req))
+
+	// A body that can be replayed is.
+	req, err = http.NewRequest("PUT", "https://example.com/", bytes.NewReader([]byte("body")))
+	assert.Nil(t, err)
+	_, err = ioutil.ReadAll(req.Body)
+	assert.Nil(t, err)
+	retry := rewindRequest(req)
+	assert.NotNil(t, retry)
+	body, err := ioutil.ReadAll(retry.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("body"), body)
+
+	// A body that can't be replayed stops a retry.
+	req, err = http.NewRequest("PUT", "https://example.com/", ioutil.NopCloser(bytes.NewReader([]byte("body"))))
+	assert.Nil(t, err)
+	assert.Nil(t, rewindRequest(req))
+
+	// So does a method that isn't idempotent.
+	req, err = http.NewRequest("POST", "https://example.com/", nil)
+	assert.Nil(t, err)
+	assert.Nil(t, rewindRequest(req))
+}
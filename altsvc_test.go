@@ -0,0 +1,102 @@
+package minhq_test
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/martinthomson/minhq"
+	"github.com/stvp/assert"
+)
+
+func TestParseAltSvc(t *testing.T) {
+	alternatives, clear, err := minhq.ParseAltSvc(`h2="alt.example.com:443", hq=":8443"; ma=3600; persist=1`)
+	assert.Nil(t, err)
+	assert.False(t, clear)
+	assert.Equal(t, 2, len(alternatives))
+
+	assert.Equal(t, "h2", alternatives[0].Protocol)
+	assert.Equal(t, "alt.example.com", alternatives[0].Host)
+	assert.Equal(t, 443, alternatives[0].Port)
+	assert.Equal(t, 24*time.Hour, alternatives[0].MaxAge)
+	assert.False(t, alternatives[0].IsHQ())
+
+	assert.Equal(t, "hq", alternatives[1].Protocol)
+	assert.Equal(t, "", alternatives[1].Host)
+	assert.Equal(t, 8443, alternatives[1].Port)
+	assert.Equal(t, time.Hour, alternatives[1].MaxAge)
+	assert.True(t, alternatives[1].Persist)
+	assert.True(t, alternatives[1].IsHQ())
+	assert.Equal(t, "example.com:8443", alternatives[1].Authority("example.com"))
+}
+
+func TestParseAltSvcEscaped(t *testing.T) {
+	alternatives, _, err := minhq.ParseAltSvc(`w%3Dx%3Ay="[::1]:443"; x="a;b,c"`)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(alternatives))
+	assert.Equal(t, "w=x:y", alternatives[0].Protocol)
+	assert.Equal(t, "::1", alternatives[0].Host)
+	assert.Equal(t, `w%3Dx%3Ay="[::1]:443"`, alternatives[0].String())
+}
+
+func TestParseAltSvcClear(t *testing.T) {
+	alternatives, clear, err := minhq.ParseAltSvc(" clear ")
+	assert.Nil(t, err)
+	assert.True(t, clear)
+	assert.Equal(t, 0, len(alternatives))
+}
+
+func TestParseAltSvcInvalid(t *testing.T) {
+	for _, v := range []string{
+		"",
+		"hq",
+		"hq=:443",
+		`hq="nope"`,
+		`hq=":443";`,
+		`hq=":443" extra`,
+		`hq=":99999"`,
+		`hq=":443"; ma=soon`,
+	} {
+		_, _, err := minhq.ParseAltSvc(v)
+		assert.Equal(t, minhq.ErrInvalidAltSvc, err, v)
+	}
+}
+
+func TestAltSvcString(t *testing.T) {
+	alt := minhq.AltSvc{Protocol: "hq", Port: 443, MaxAge: time.Minute}
+	assert.Equal(t, `hq=":443"; ma=60`, alt.String())
+}
+
+func TestAltSvcCache(t *testing.T) {
+	var cache minhq.AltSvcCache
+	u, err := url.Parse("https://example.com/path")
+	assert.Nil(t, err)
+	other, err := url.Parse("https://example.com:443/other")
+	assert.Nil(t, err)
+
+	_, ok := cache.Get(u)
+	assert.False(t, ok)
+
+	cache.Update(u, `h2=":443", hq="quic.example.com:4433"`)
+	authority, ok := cache.Get(other)
+	assert.True(t, ok)
+	assert.Equal(t, "quic.example.com:4433", authority)
+
+	// A new value without hq replaces the old one.
+	cache.Update(u, `h2=":443"`)
+	_, ok = cache.Get(u)
+	assert.False(t, ok)
+
+	cache.Update(u, `hq=":4433"`)
+	authority, ok = cache.Get(u)
+	assert.True(t, ok)
+	assert.Equal(t, "example.com:4433", authority)
+	cache.Update(u, "clear")
+	_, ok = cache.Get(u)
+	assert.False(t, ok)
+
+	// An expired entry isn't used.
+	cache.Update(u, `hq=":4433"; ma=0`)
+	_, ok = cache.Get(u)
+	assert.False(t, ok)
+}
@@ -0,0 +1,168 @@
+package minhq
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/martinthomson/minhq/hc"
+)
+
+// ServeHandler handles requests using an http.Handler.  Each request is handled
+// in its own goroutine.  This returns when the channel is closed.
+func ServeHandler(requests <-chan *ServerRequest, handler http.Handler) {
+	for req := range requests {
+		go serveRequest(req, handler)
+	}
+}
+
+// newHTTPRequest converts a request into a form that net/http understands.
+func newHTTPRequest(req *ServerRequest) *http.Request {
+	target := req.Target()
+	r := &http.Request{
+		Method:        req.Method(),
+		URL:           target,
+		Proto:         "HTTP/QUIC",
+		Header:        httpHeader(req.Headers),
+		Body:          ioutil.NopCloser(req),
+		ContentLength: -1,
+		Host:          target.Host,
+		RequestURI:    target.RequestURI(),
+	}
+	if cl, err := strconv.ParseInt(r.Header.Get("Content-Length"), 10, 64); err == nil {
+		r.ContentLength = cl
+	}
+	return r
+}
+
+func serveRequest(req *ServerRequest, handler http.Handler) {
+	w := &responseWriter{
+		header: make(http.Header),
+		respond: func(statusCode int, headers ...hc.HeaderField) (*ServerResponse, error) {
+			return req.Respond(statusCode, headers...)
+		},
+		req:     req,
+		handler: handler,
+	}
+	handler.ServeHTTP(w, newHTTPRequest(req))
+	w.finish()
+}
+
+// responseWriter implements http.ResponseWriter for a bridged request or push.
+type responseWriter struct {
+	header  http.Header
+	respond func(statusCode int, headers ...hc.HeaderField) (*ServerResponse, error)
+	resp    *ServerResponse
+	err     error
+
+	// These are used for pushes.
+	req     *ServerRequest
+	handler http.Handler
+}
+
+var _ http.ResponseWriter = &responseWriter{}
+var _ http.Pusher = &responseWriter{}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) WriteHeader(statusCode int) {
+	if w.resp != nil || w.err != nil {
+		return
+	}
+	if statusCode < 200 {
+		// Pushes can't have informational responses.
+		if w.req != nil {
+			_ = w.req.SendInformational(statusCode, httpHeaderFields(w.header)...)
+		}
+		return
+	}
+	w.resp, w.err = w.respond(statusCode, httpHeaderFields(w.header)...)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if w.resp == nil && w.err == nil {
+		if w.header.Get("Content-Type") == "" {
+			w.header.Set("Content-Type", http.DetectContentType(p))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	return w.resp.Write(p)
+}
+
+// Flush implements http.Flusher.  Data is written as it is received, so this
+// only needs to make sure that the response has started.
+func (w *responseWriter) Flush() {
+	w.WriteHeader(http.StatusOK)
+}
+
+// Push implements http.Pusher.  The handler is called for the pushed request.
+func (w *responseWriter) Push(target string, opts *http.PushOptions) error {
+	if w.req == nil {
+		// Pushed responses can't push.
+		return http.ErrNotSupported
+	}
+	if w.resp != nil {
+		return ErrResponseStarted
+	}
+	method := "GET"
+	var header http.Header
+	if opts != nil {
+		if opts.Method != "" {
+			method = opts.Method
+		}
+		header = opts.Header
+	}
+	push, err := w.req.Push(method, target, httpHeaderFields(header)...)
+	if err != nil {
+		return err
+	}
+
+	r := &http.Request{
+		Method:     method,
+		URL:        push.Target,
+		Proto:      "HTTP/QUIC",
+		Header:     httpHeader(push.Headers),
+		Body:       http.NoBody,
+		Host:       push.Target.Host,
+		RequestURI: push.Target.RequestURI(),
+	}
+	pw := &responseWriter{
+		header:  make(http.Header),
+		respond: push.Respond,
+	}
+	go func() {
+		w.handler.ServeHTTP(pw, r)
+		pw.finish()
+	}()
+	return nil
+}
+
+// finish ends the response, sending an empty response if the handler didn't
+// send anything.
+func (w *responseWriter) finish() {
+	w.WriteHeader(http.StatusOK)
+	if w.resp != nil {
+		_ = w.resp.Close()
+	}
+}
+
+// AltSvcHandler wraps a handler so that responses advertise the given
+// alternative services.  This is intended for use on a TCP server that runs
+// alongside an HTTP over QUIC server.
+func AltSvcHandler(handler http.Handler, alternatives ...AltSvc) http.Handler {
+	values := make([]string, len(alternatives))
+	for i := range alternatives {
+		values[i] = alternatives[i].String()
+	}
+	altSvc := strings.Join(values, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", altSvc)
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,599 @@
+package minhq
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/martinthomson/minhq/hc"
+)
+
+// CacheEntry is a stored response.
+type CacheEntry struct {
+	Status  int
+	Headers []hc.HeaderField
+	Body    []byte
+	// Vary holds the values of the request header fields that the response
+	// varies on.
+	Vary map[string]string
+	// RequestTime and ResponseTime are used to work out the age of the
+	// response.
+	RequestTime  time.Time
+	ResponseTime time.Time
+}
+
+// CacheStorage stores responses for Client.Cache.  Implementations need to be
+// safe to use from multiple goroutines.
+type CacheStorage interface {
+	// Load returns the entry for a key, or nil if there isn't one.
+	Load(key string) *CacheEntry
+	// Store saves an entry, replacing any existing entry.
+	Store(key string, entry *CacheEntry)
+	// Remove deletes any entry for a key.
+	Remove(key string)
+}
+
+// bodySizeLimiter is implemented by storage that doesn't keep bodies over a
+// certain size.  Larger bodies aren't read into memory to be stored.
+type bodySizeLimiter interface {
+	maxBodySize() int
+}
+
+// MemoryCache keeps responses in memory.  The zero value has no size limit.
+type MemoryCache struct {
+	// MaxSize is the total size of response bodies that are held.  The least
+	// recently used responses are removed to keep under this limit.  Zero
+	// means no limit.
+	MaxSize int
+
+	lock    sync.Mutex
+	size    int
+	lru     list.List
+	entries map[string]*list.Element
+}
+
+type memoryCacheItem struct {
+	key   string
+	entry *CacheEntry
+}
+
+// Load implements CacheStorage.
+func (mc *MemoryCache) Load(key string) *CacheEntry {
+	defer mc.lock.Unlock()
+	mc.lock.Lock()
+	e := mc.entries[key]
+	if e == nil {
+		return nil
+	}
+	mc.lru.MoveToFront(e)
+	return e.Value.(*memoryCacheItem).entry
+}
+
+// Store implements CacheStorage.
+func (mc *MemoryCache) Store(key string, entry *CacheEntry) {
+	defer mc.lock.Unlock()
+	mc.lock.Lock()
+	mc.remove(key)
+	if mc.MaxSize > 0 && len(entry.Body) > mc.MaxSize {
+		return
+	}
+	if mc.entries == nil {
+		mc.entries = make(map[string]*list.Element)
+	}
+	mc.entries[key] = mc.lru.PushFront(&memoryCacheItem{key, entry})
+	mc.size += len(entry.Body)
+	for mc.MaxSize > 0 && mc.size > mc.MaxSize {
+		mc.remove(mc.lru.Back().Value.(*memoryCacheItem).key)
+	}
+}
+
+func (mc *MemoryCache) maxBodySize() int {
+	return mc.MaxSize
+}
+
+// Remove implements CacheStorage.
+func (mc *MemoryCache) Remove(key string) {
+	defer mc.lock.Unlock()
+	mc.lock.Lock()
+	mc.remove(key)
+}
+
+func (mc *MemoryCache) remove(key string) {
+	e := mc.entries[key]
+	if e == nil {
+		return
+	}
+	mc.size -= len(e.Value.(*memoryCacheItem).entry.Body)
+	mc.lru.Remove(e)
+	delete(mc.entries, key)
+}
+
+// DiskCache keeps responses in files in a directory.
+type DiskCache struct {
+	Dir string
+}
+
+func (dc *DiskCache) path(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return filepath.Join(dc.Dir, hex.EncodeToString(h[:]))
+}
+
+// Load implements CacheStorage.  Entries that can't be read are ignored.
+func (dc *DiskCache) Load(key string) *CacheEntry {
+	f, err := os.Open(dc.path(key))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var stored struct {
+		Key   string
+		Entry CacheEntry
+	}
+	err = gob.NewDecoder(f).Decode(&stored)
+	if err != nil || stored.Key != key {
+		return nil
+	}
+	return &stored.Entry
+}
+
+// Store implements CacheStorage.  Errors are ignored, because a cache that
+// doesn't store anything is still correct.
+func (dc *DiskCache) Store(key string, entry *CacheEntry) {
+	f, err := ioutil.TempFile(dc.Dir, "tmp")
+	if err != nil {
+		return
+	}
+	stored := struct {
+		Key   string
+		Entry CacheEntry
+	}{key, *entry}
+	err = gob.NewEncoder(f).Encode(&stored)
+	closeErr := f.Close()
+	if err != nil || closeErr != nil {
+		_ = os.Remove(f.Name())
+		return
+	}
+	err = os.Rename(f.Name(), dc.path(key))
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+}
+
+// Remove implements CacheStorage.
+func (dc *DiskCache) Remove(key string) {
+	_ = os.Remove(dc.path(key))
+}
+
+// cacheControl holds the directives from a cache-control header field.
+type cacheControl map[string]string
+
+func parseCacheControl(value string) cacheControl {
+	cc := make(cacheControl)
+	for _, directive := range strings.Split(value, ",") {
+		directive = strings.TrimSpace(directive)
+		if directive == "" {
+			continue
+		}
+		name, v := directive, ""
+		if i := strings.IndexByte(directive, '='); i >= 0 {
+			name, v = directive[:i], strings.Trim(directive[i+1:], "\"")
+		}
+		cc[strings.ToLower(strings.TrimSpace(name))] = v
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds returns the value of a directive as a duration.
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	v, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// getHeader finds a header field in a list.
+func getHeader(headers []hc.HeaderField, name string) string {
+	return headerFieldArray(headers).GetHeader(name)
+}
+
+// getHeaderAnyCase is like getHeader, but it works for header fields that
+// an application provides, which might not be lowercase.
+func getHeaderAnyCase(headers []hc.HeaderField, name string) string {
+	var values []string
+	for _, h := range headers {
+		if strings.EqualFold(h.Name, name) {
+			values = append(values, h.Value)
+		}
+	}
+	return strings.Join(values, ",")
+}
+
+func headerTime(headers []hc.HeaderField, name string) (time.Time, bool) {
+	v := getHeader(headers, name)
+	if v == "" {
+		return time.Time{}, false
+	}
+	t, err := http.ParseTime(v)
+	return t, err == nil
+}
+
+// heuristicallyCacheable are the status codes that can be cached without
+// explicit freshness information.
+var heuristicallyCacheable = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// varyNames lists the request header fields that a response varies on.
+func varyNames(headers []hc.HeaderField) []string {
+	var names []string
+	for _, name := range strings.Split(getHeader(headers, "vary"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// cacheable determines if a response can be stored.
+func cacheable(status int, requestCC cacheControl, headers []hc.HeaderField) bool {
+	if requestCC.has("no-store") {
+		return false
+	}
+	cc := parseCacheControl(getHeader(headers, "cache-control"))
+	if cc.has("no-store") {
+		return false
+	}
+	for _, name := range varyNames(headers) {
+		if name == "*" {
+			return false
+		}
+	}
+	if heuristicallyCacheable[status] {
+		return true
+	}
+	_, hasMaxAge := cc.seconds("max-age")
+	_, hasExpires := headerTime(headers, "expires")
+	return hasMaxAge || hasExpires || cc.has("public")
+}
+
+func newCacheEntry(status int, headers []hc.HeaderField, body []byte,
+	requestHeaders []hc.HeaderField, requestTime time.Time, responseTime time.Time) *CacheEntry {
+	entry := &CacheEntry{
+		Status:       status,
+		Headers:      headers,
+		Body:         body,
+		Vary:         make(map[string]string),
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+	}
+	for _, name := range varyNames(headers) {
+		entry.Vary[name] = getHeaderAnyCase(requestHeaders, name)
+	}
+	return entry
+}
+
+// matches checks that the request has the same values for the header fields
+// that the response varies on.
+func (entry *CacheEntry) matches(requestHeaders []hc.HeaderField) bool {
+	for name, v := range entry.Vary {
+		if getHeaderAnyCase(requestHeaders, name) != v {
+			return false
+		}
+	}
+	return true
+}
+
+// freshnessLifetime works out how long the response is fresh for.
+func (entry *CacheEntry) freshnessLifetime() time.Duration {
+	cc := parseCacheControl(getHeader(entry.Headers, "cache-control"))
+	if cc.has("no-cache") {
+		return 0
+	}
+	if maxAge, ok := cc.seconds("max-age"); ok {
+		return maxAge
+	}
+	date, ok := headerTime(entry.Headers, "date")
+	if !ok {
+		date = entry.ResponseTime
+	}
+	if expires, ok := headerTime(entry.Headers, "expires"); ok {
+		return expires.Sub(date)
+	}
+	if getHeader(entry.Headers, "expires") != "" {
+		// An invalid expires value means that the response is stale.
+		return 0
+	}
+	if lastModified, ok := headerTime(entry.Headers, "last-modified"); ok &&
+		heuristicallyCacheable[entry.Status] {
+		heuristic := date.Sub(lastModified) / 10
+		if heuristic > 24*time.Hour {
+			heuristic = 24 * time.Hour
+		}
+		return heuristic
+	}
+	return 0
+}
+
+// age works out the current age of the response, per RFC 7234.
+func (entry *CacheEntry) age(now time.Time) time.Duration {
+	var apparentAge time.Duration
+	if date, ok := headerTime(entry.Headers, "date"); ok {
+		apparentAge = entry.ResponseTime.Sub(date)
+		if apparentAge < 0 {
+			apparentAge = 0
+		}
+	}
+	ageValue, _ := strconv.ParseInt(getHeader(entry.Headers, "age"), 10, 64)
+	correctedAge := time.Duration(ageValue)*time.Second + entry.ResponseTime.Sub(entry.RequestTime)
+	if apparentAge > correctedAge {
+		correctedAge = apparentAge
+	}
+	return correctedAge + now.Sub(entry.ResponseTime)
+}
+
+func (entry *CacheEntry) fresh(now time.Time, requestCC cacheControl) bool {
+	if requestCC.has("no-cache") {
+		return false
+	}
+	lifetime := entry.freshnessLifetime()
+	if maxAge, ok := requestCC.seconds("max-age"); ok && maxAge < lifetime {
+		lifetime = maxAge
+	}
+	return entry.age(now) < lifetime
+}
+
+// validators returns the header fields for a conditional request.
+func (entry *CacheEntry) validators() []hc.HeaderField {
+	var headers []hc.HeaderField
+	if etag := getHeader(entry.Headers, "etag"); etag != "" {
+		headers = append(headers, hc.HeaderField{Name: "if-none-match", Value: etag})
+	}
+	if lastModified := getHeader(entry.Headers, "last-modified"); lastModified != "" {
+		headers = append(headers, hc.HeaderField{Name: "if-modified-since", Value: lastModified})
+	}
+	return headers
+}
+
+// update merges the header fields from a 304 response into the entry.
+func (entry *CacheEntry) update(headers []hc.HeaderField, requestTime time.Time, responseTime time.Time) *CacheEntry {
+	replaced := make(map[string]bool)
+	for _, h := range headers {
+		if !strings.HasPrefix(h.Name, ":") && h.Name != "content-length" {
+			replaced[h.Name] = true
+		}
+	}
+	updated := *entry
+	updated.Headers = nil
+	for _, h := range entry.Headers {
+		if !replaced[h.Name] {
+			updated.Headers = append(updated.Headers, h)
+		}
+	}
+	for _, h := range headers {
+		if replaced[h.Name] {
+			updated.Headers = append(updated.Headers, h)
+		}
+	}
+	updated.RequestTime = requestTime
+	updated.ResponseTime = responseTime
+	return &updated
+}
+
+// response makes a response from the entry.
+func (entry *CacheEntry) response(now time.Time) *ClientResponse {
+	headers := make(headerFieldArray, 0, len(entry.Headers)+1)
+	for _, h := range entry.Headers {
+		if h.Name != "age" {
+			headers = append(headers, h)
+		}
+	}
+	age := int64(entry.age(now) / time.Second)
+	headers = append(headers, hc.HeaderField{Name: "age", Value: strconv.FormatInt(age, 10)})
+	trailers := make(chan []hc.HeaderField)
+	close(trailers)
+	return &ClientResponse{
+		IncomingMessage: IncomingMessage{Headers: headers, Trailers: trailers},
+		Status:          entry.Status,
+		FromCache:       true,
+		body:            bytes.NewReader(entry.Body),
+	}
+}
+
+// cacheKey identifies a resource in the cache.
+func cacheKey(u *url.URL) string {
+	withoutFragment := *u
+	withoutFragment.Fragment = ""
+	return withoutFragment.String()
+}
+
+// hasConditional checks if the application made a conditional request.
+func hasConditional(headers []hc.HeaderField) bool {
+	for _, name := range []string{"if-none-match", "if-modified-since", "if-match",
+		"if-unmodified-since", "if-range", "range"} {
+		if hasHeader(headers, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// errBodyTooLarge is returned by readAndStore when a body is too large for
+// Client.Cache.
+var errBodyTooLarge = errors.New("response body is too large to cache")
+
+// readAndStore reads the response body and stores the response.  The response
+// that is returned reads from the stored body.
+//
+// If Client.Cache limits the size of bodies, no more than that is read.  When
+// the body is larger, nothing is stored and this returns errBodyTooLarge.  The
+// response can still be read: it returns what was read followed by the rest
+// of the body.
+func (c *Client) readAndStore(key string, resp *ClientResponse, requestHeaders []hc.HeaderField,
+	requestTime time.Time) (*ClientResponse, error) {
+	limit := 0
+	if limiter, ok := c.Cache.(bodySizeLimiter); ok {
+		limit = limiter.maxBodySize()
+	}
+	var r io.Reader = resp
+	if limit > 0 {
+		r = &io.LimitedReader{R: resp, N: int64(limit) + 1}
+	}
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && len(body) > limit {
+		c.Cache.Remove(key)
+		resp.body = io.MultiReader(bytes.NewReader(body), streamBody{resp})
+		return resp, errBodyTooLarge
+	}
+	entry := newCacheEntry(resp.Status, resp.Headers, body, requestHeaders, requestTime, time.Now())
+	c.Cache.Store(key, entry)
+	cached := entry.response(time.Now())
+	cached.Request = resp.Request
+	cached.FromCache = false
+	cached.Uncompressed = resp.Uncompressed
+	return cached, nil
+}
+
+// fetchCached makes a GET request, using Client.Cache.  The response is
+// matched against the cache using the header fields that are sent, which
+// includes any that the connection adds.
+func (c *Client) fetchCached(connection *ClientConnection, u *url.URL, headers []hc.HeaderField) (*ClientRequest, error) {
+	requestCC := parseCacheControl(getHeaderAnyCase(headers, "cache-control"))
+	if requestCC.has("no-store") || hasConditional(headers) {
+		return connection.Fetch("GET", u.String(), headers...)
+	}
+	err := hc.ValidatePseudoHeaders(headers)
+	if err != nil {
+		return nil, err
+	}
+
+	key := cacheKey(u)
+	sent, _ := connection.requestHeaders(headers)
+	entry := c.Cache.Load(key)
+	if entry != nil && !entry.matches(sent) {
+		entry = nil
+	}
+	if entry != nil && entry.fresh(time.Now(), requestCC) {
+		target, allHeaders, err := buildRequestHeaderFields("GET", nil, u.String(), sent)
+		if err != nil {
+			return nil, err
+		}
+		return newAnsweredRequest("GET", target, allHeaders, entry.response(time.Now()), false), nil
+	}
+
+	requestHeaders := headers
+	if entry != nil {
+		requestHeaders = append(headers[:len(headers):len(headers)], entry.validators()...)
+	}
+	requestTime := time.Now()
+	req, err := connection.Fetch("GET", u.String(), requestHeaders...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Replace the response with one that is stored.
+	received := req.response
+	stored := make(chan *ClientResponse, 1)
+	req.response = stored
+	go func() {
+		resp := <-received
+		if resp != nil {
+			resp = c.storeResponse(key, entry, resp, requestCC, req.Headers(), requestTime)
+		}
+		stored <- resp
+	}()
+	return req, nil
+}
+
+// storeResponse updates Client.Cache with a response.  If the response is
+// stored, this returns a response that reads from the stored body.  This
+// returns nil if the body can't be read.
+func (c *Client) storeResponse(key string, entry *CacheEntry, resp *ClientResponse,
+	requestCC cacheControl, requestHeaders []hc.HeaderField, requestTime time.Time) *ClientResponse {
+	if resp.Status == http.StatusNotModified && entry != nil {
+		entry = entry.update(resp.Headers, requestTime, time.Now())
+		c.Cache.Store(key, entry)
+		cached := entry.response(time.Now())
+		cached.Request = resp.Request
+		return cached
+	}
+	if !cacheable(resp.Status, requestCC, resp.Headers) {
+		if entry != nil {
+			c.Cache.Remove(key)
+		}
+		return resp
+	}
+	cached, err := c.readAndStore(key, resp, requestHeaders, requestTime)
+	if err == errBodyTooLarge {
+		return resp
+	}
+	if err != nil {
+		return nil
+	}
+	return cached
+}
+
+// cachePushes stores the pushes that arrive on a request in Client.Cache.  The
+// application doesn't see these pushes.
+func (c *Client) cachePushes(req *ClientRequest) {
+	pushes := req.Pushes
+	none := make(chan *PushPromise)
+	close(none)
+	req.Pushes = none
+	go func() {
+		for pp := range pushes {
+			go c.CachePush(pp)
+		}
+	}()
+}
+
+// CachePush waits for the response to a push promise and stores it in
+// Client.Cache, so that a later request for the same resource can use it.
+// Pushes that aren't for GET requests are cancelled.  This blocks until the
+// push is complete, so it is best run in a goroutine.
+func (c *Client) CachePush(pp *PushPromise) {
+	if c.Cache == nil || pp.Method() != "GET" {
+		_ = pp.Cancel()
+		return
+	}
+	requestTime := time.Now()
+	resp := pp.Response()
+	if resp == nil {
+		return
+	}
+	if !cacheable(resp.Status, cacheControl{}, resp.Headers) {
+		_ = resp.Cancel()
+		return
+	}
+	_, err := c.readAndStore(cacheKey(pp.Target()), resp, pp.Headers(), requestTime)
+	if err == errBodyTooLarge {
+		_ = resp.Cancel()
+	}
+}
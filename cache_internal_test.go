@@ -0,0 +1,101 @@
+package minhq
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/martinthomson/minhq/hc"
+	bitio "github.com/martinthomson/minhq/io"
+	"github.com/stvp/assert"
+)
+
+// Cached responses are matched using the header fields that would be sent,
+// not just the ones that the application provides.
+func TestFetchCachedVary(t *testing.T) {
+	connection := idleConnection()
+	defer connection.Close()
+	connection.config = &Config{AcceptCompression: true}
+
+	cache := &MemoryCache{}
+	client := Client{
+		Connections: map[string]*ClientConnection{"example.com:443": connection},
+		Cache:       cache,
+	}
+	now := time.Now()
+	cache.Store("https://example.com/", newCacheEntry(200, []hc.HeaderField{
+		{Name: "cache-control", Value: "max-age=60"},
+		{Name: "vary", Value: "accept-encoding"},
+	}, []byte("cached"), []hc.HeaderField{
+		{Name: "accept-encoding", Value: acceptEncoding},
+	}, now, now))
+
+	req, err := client.Fetch("GET", "https://example.com/")
+	assert.Nil(t, err)
+	assert.Equal(t, acceptEncoding, getHeader(req.Headers(), "accept-encoding"))
+	resp := req.Response()
+	assert.True(t, resp.FromCache)
+	assert.True(t, resp.Request == req)
+	body, err := ioutil.ReadAll(resp)
+	assert.Nil(t, err)
+	assert.Equal(t, "cached", string(body))
+	_, ok := <-req.Pushes
+	assert.False(t, ok)
+}
+
+// countingReader counts the bytes that are read from it.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += n
+	return n, err
+}
+
+// bodyResponse makes a cacheable response with the given body.
+func bodyResponse(body io.Reader) *ClientResponse {
+	reader := bitio.NewConcatenatingReader()
+	go func() {
+		reader.AddReader(body)
+		_ = reader.Close()
+	}()
+	return &ClientResponse{
+		IncomingMessage: IncomingMessage{
+			Headers: []hc.HeaderField{{Name: "cache-control", Value: "max-age=60"}},
+			reader:  reader,
+		},
+		Status: 200,
+	}
+}
+
+// A body that is larger than MemoryCache.MaxSize isn't read into memory just to
+// be rejected.  It isn't stored, but the response still has the whole body.
+func TestReadAndStoreLimit(t *testing.T) {
+	const limit = 100
+	cache := &MemoryCache{MaxSize: limit}
+	client := Client{Cache: cache}
+	const key = "https://example.com/"
+
+	small := bytes.Repeat([]byte{'a'}, limit)
+	cached, err := client.readAndStore(key, bodyResponse(bytes.NewReader(small)), nil, time.Now())
+	assert.Nil(t, err)
+	body, err := ioutil.ReadAll(cached)
+	assert.Nil(t, err)
+	assert.Equal(t, small, body)
+	assert.NotNil(t, cache.Load(key))
+
+	large := bytes.Repeat([]byte{'b'}, limit*100)
+	counter := &countingReader{r: bytes.NewReader(large)}
+	resp, err := client.readAndStore(key, bodyResponse(counter), nil, time.Now())
+	assert.Equal(t, errBodyTooLarge, err)
+	assert.Equal(t, limit+1, counter.n)
+	assert.Nil(t, cache.Load(key))
+	body, err = ioutil.ReadAll(resp)
+	assert.Nil(t, err)
+	assert.Equal(t, large, body)
+}
@@ -0,0 +1,62 @@
+package minhq_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/martinthomson/minhq"
+	"github.com/martinthomson/minhq/hc"
+	"github.com/stvp/assert"
+)
+
+func TestMemoryCacheEviction(t *testing.T) {
+	cache := &minhq.MemoryCache{MaxSize: 10}
+	cache.Store("a", &minhq.CacheEntry{Status: 200, Body: []byte("aaaa")})
+	cache.Store("b", &minhq.CacheEntry{Status: 200, Body: []byte("bbbb")})
+	// Using a makes b the least recently used entry.
+	assert.NotNil(t, cache.Load("a"))
+	cache.Store("c", &minhq.CacheEntry{Status: 200, Body: []byte("cccc")})
+
+	assert.NotNil(t, cache.Load("a"))
+	assert.Nil(t, cache.Load("b"))
+	assert.NotNil(t, cache.Load("c"))
+
+	// Entries that are too big aren't kept.
+	cache.Store("d", &minhq.CacheEntry{Status: 200, Body: make([]byte, 11)})
+	assert.Nil(t, cache.Load("d"))
+
+	cache.Remove("a")
+	assert.Nil(t, cache.Load("a"))
+}
+
+func TestDiskCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minhq-cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cache := &minhq.DiskCache{Dir: dir}
+	now := time.Now().Round(time.Second)
+	entry := &minhq.CacheEntry{
+		Status:       200,
+		Headers:      []hc.HeaderField{{Name: "etag", Value: `"x"`}},
+		Body:         []byte("body"),
+		Vary:         map[string]string{"accept": "text/plain"},
+		RequestTime:  now,
+		ResponseTime: now,
+	}
+	cache.Store("https://example.com/", entry)
+
+	loaded := cache.Load("https://example.com/")
+	assert.NotNil(t, loaded)
+	assert.Equal(t, 200, loaded.Status)
+	assert.Equal(t, "etag", loaded.Headers[0].Name)
+	assert.Equal(t, "body", string(loaded.Body))
+	assert.Equal(t, "text/plain", loaded.Vary["accept"])
+	assert.True(t, now.Equal(loaded.ResponseTime))
+
+	assert.Nil(t, cache.Load("https://example.com/other"))
+	cache.Remove("https://example.com/")
+	assert.Nil(t, cache.Load("https://example.com/"))
+}
@@ -1,11 +1,14 @@
 package minhq
 
 import (
+	"context"
 	"errors"
-	"io"
 	"net"
+	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/ekr/minq"
 	"github.com/martinthomson/minhq/hc"
@@ -17,90 +20,175 @@ import (
 type Client struct {
 	Connections map[string]*ClientConnection
 	Config      Config
+	// Resolver is used to find the addresses of servers.  If this is nil,
+	// net.DefaultResolver is used.
+	Resolver Resolver
+	// AttemptDelay is the time to wait for a connection attempt before trying
+	// the next address for a server.  Zero means DefaultAttemptDelay.
+	AttemptDelay time.Duration
+	// Jar holds cookies for Do.  If this is nil, cookies aren't used.
+	Jar http.CookieJar
+	// Redirects controls how Do follows redirects.
+	Redirects RedirectPolicy
+	// Cache stores responses to GET requests made with Fetch or Do, and any
+	// responses that are pushed in response to requests.  Use MemoryCache or
+	// DiskCache.  If this is nil, nothing is cached.
+	Cache CacheStorage
+	// ExpectContinue causes Do to send expect: 100-continue with requests
+	// that have a body.  The body is sent when the server sends 100
+	// (Continue), or after waiting this long.  The body isn't sent if the
+	// server sends a final response first.  Zero means that the body is sent
+	// without waiting.
+	ExpectContinue time.Duration
+	// Dialer creates the transport for each connection.  If this is nil, a
+	// UDPDialer creates a new socket for each connection.
+	Dialer Dialer
+
+	dialerOnce sync.Once
 }
 
 // Connect to a given host.
 func (c *Client) Connect(host string) (*ClientConnection, error) {
-	var serverName string
+	return c.ConnectContext(context.Background(), host)
+}
+
+// ConnectContext connects to a given host.  All of the addresses for the host
+// are tried, staggered by AttemptDelay, and the first connection that is
+// established is used.  The context limits how long this takes.
+func (c *Client) ConnectContext(ctx context.Context, host string) (*ClientConnection, error) {
+	return c.connect(ctx, host, "")
+}
+
+// connect makes a connection for host.  If alternative is set, the connection
+// is made to that address instead, though the server still needs to be
+// authoritative for host.
+func (c *Client) connect(ctx context.Context, host string, alternative string) (*ClientConnection, error) {
+	serverName, port := host, "443"
 	if strings.ContainsRune(host, 58 /* ":" */) {
 		var err error
-		serverName, _, err = net.SplitHostPort(host)
+		serverName, port, err = net.SplitHostPort(host)
 		if err != nil {
 			return nil, err
 		}
 	} else {
-		serverName = host
 		host += ":443"
 	}
-	addr, err := net.ResolveUDPAddr("udp", host)
+	addrHost, addrPort := serverName, port
+	if alternative != "" {
+		var err error
+		addrHost, addrPort, err = net.SplitHostPort(alternative)
+		if err != nil {
+			return nil, err
+		}
+	}
+	addrs, err := c.resolve(ctx, addrHost, addrPort)
 	if err != nil {
 		return nil, err
 	}
-	socket, err := net.ListenUDP("udp", nil) // ephemeral ports
+
+	connection, err := c.happyEyeballs(ctx, serverName, addrs)
 	if err != nil {
 		return nil, err
 	}
-
-	minqTransport := minq.NewUdpTransport(socket, addr)
-	minqConfig := minq.NewTlsConfig(serverName)
-	minq := minq.NewConnection(minqTransport, minq.RoleClient,
-		&minqConfig, nil)
-	connection := NewClientConnection(mw.NewConnection(minq), &c.Config)
+	err = connection.Connect()
+	if err != nil {
+		_ = connection.Close()
+		return nil, err
+	}
 	if c.Connections == nil {
 		c.Connections = make(map[string]*ClientConnection)
 	}
-
-	go serviceUdpSocket(connection.IncomingPackets, socket, connection)
-
 	c.Connections[host] = connection
-	<-connection.Connected
 	return connection, nil
 }
 
-func serviceUdpSocket(packets chan<- *mw.Packet, socket *net.UDPConn,
-	resource io.Closer) {
-	defer resource.Close()
+func (c *Client) dialer() Dialer {
+	c.dialerOnce.Do(func() {
+		if c.Dialer == nil {
+			c.Dialer = &UDPDialer{
+				PacketPool: mw.NewPacketPool(c.Config.maxPacketSize()),
+			}
+		}
+	})
+	return c.Dialer
+}
 
-	laddr := socket.LocalAddr()
-	localAddr, err := net.ResolveUDPAddr(laddr.Network(), laddr.String())
-	if err != nil {
-		panic("can't get UDP address of UDP socket")
+// hostKey adds the default port to a host, which is how connections are
+// indexed in Client.Connections.
+func hostKey(host string) string {
+	if strings.ContainsRune(host, 58 /* ":" */) {
+		return host
 	}
+	return host + ":443"
+}
 
-	for {
-		buf := make([]byte, 4096) // Increase to support larger MTU
-		n, remoteAddr, err := socket.ReadFromUDP(buf)
-		if err != nil {
-			return
-		}
-		packets <- &mw.Packet{
-			DestAddr: localAddr,
-			SrcAddr:  remoteAddr,
-			Data:     buf[:n],
-		}
+// dial creates a connection to a single address.  The packet source is closed
+// when the connection closes, and the connection is closed if the packet
+// source fails.
+func (c *Client) dial(serverName string, addr *net.UDPAddr) (*ClientConnection, error) {
+	minqTransport, source, err := c.dialer().Dial(addr)
+	if err != nil {
+		return nil, err
 	}
+
+	minqConfig := minq.NewTlsConfig(serverName)
+	minq := minq.NewConnection(minqTransport, minq.RoleClient,
+		&minqConfig, nil)
+	connection := NewClientConnection(mw.NewConnection(minq), &c.Config)
+	go func() {
+		source.Service(addr, connection.IncomingPackets)
+		_ = connection.Close()
+	}()
+	go func() {
+		<-connection.Closed()
+		_ = source.Close()
+	}()
+	return connection, nil
 }
 
 // Fetch is the basic client request handling function.  This isn't safe to
 // run concurrently, and it blocks.  If you need to make requests concurrently,
 // find the connection you need and use that directly.
+//
+// If there is a Client.Cache, GET requests use it, and pushes are stored in it
+// instead of appearing on ClientRequest.Pushes.  A request that the cache
+// answers isn't sent, so it can't have a body.
 func (c *Client) Fetch(method string, target string, headers ...hc.HeaderField) (*ClientRequest, error) {
 	u, err := url.Parse(target)
 	if err != nil {
 		return nil, err
 	}
+	connection, err := c.connectionFor(u)
+	if err != nil {
+		return nil, err
+	}
+	if c.Cache == nil {
+		return connection.Fetch(method, target, headers...)
+	}
+
+	var req *ClientRequest
+	if method == "GET" {
+		req, err = c.fetchCached(connection, u, headers)
+	} else {
+		req, err = connection.Fetch(method, target, headers...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.cachePushes(req)
+	return req, nil
+}
+
+// connectionFor finds or makes a connection for the URL.
+func (c *Client) connectionFor(u *url.URL) (*ClientConnection, error) {
 	if u.Scheme != "https" {
 		return nil, errors.New("only the 'https' scheme is supported")
 	}
-
-	connection := c.Connections[u.Host]
-	if connection == nil {
-		connection, err = c.Connect(u.Host)
-		if err != nil {
-			return nil, err
-		}
+	connection := c.Connections[hostKey(u.Host)]
+	if connection != nil {
+		return connection, nil
 	}
-	return connection.Fetch(method, target, headers...)
+	return c.Connect(u.Host)
 }
 
 // Close closes all connections indiscriminately.
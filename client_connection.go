@@ -22,6 +22,9 @@ type ClientConnection struct {
 	maxPushID uint64
 	pushLock  sync.Mutex
 	promises  map[uint64]*PushPromise
+	// unclaimed are promises that Config.PushPolicy accepted, which a
+	// matching Fetch can use.
+	unclaimed []*PushPromise
 }
 
 // NewClientConnection wraps an instance of minq.Connection.
@@ -70,7 +73,20 @@ func (c *ClientConnection) HandleFrame(t FrameType, r FrameReader) error {
 	}
 }
 
-// Fetch makes a request.
+// requestHeaders adds the header fields that the connection adds to every
+// request.  This also reports whether the response is to be decompressed.
+func (c *ClientConnection) requestHeaders(headers []hc.HeaderField) ([]hc.HeaderField, bool) {
+	decompress := c.config.AcceptCompression && !hasHeader(headers, "accept-encoding")
+	if decompress {
+		headers = append(headers[:len(headers):len(headers)],
+			hc.HeaderField{Name: "accept-encoding", Value: acceptEncoding})
+	}
+	return headers, decompress
+}
+
+// Fetch makes a request.  If Config.PushPolicy accepted a push promise that
+// matches the request, the pushed response is used instead of sending the
+// request.  Fetch waits for the response to that promise if it hasn't arrived.
 func (c *ClientConnection) Fetch(method string, target string, headers ...hc.HeaderField) (*ClientRequest, error) {
 	err := hc.ValidatePseudoHeaders(headers)
 	if err != nil {
@@ -82,10 +98,14 @@ func (c *ClientConnection) Fetch(method string, target string, headers ...hc.Hea
 		return nil, errors.New("connection not open")
 	}
 
+	headers, decompress := c.requestHeaders(headers)
 	url, allHeaders, err := buildRequestHeaderFields(method, nil, target, headers)
 	if err != nil {
 		return nil, err
 	}
+	if resp := c.claimPush(method, url, headers); resp != nil {
+		return newAnsweredRequest(method, url, allHeaders, resp, decompress), nil
+	}
 
 	s := newStream(c.CreateStream())
 	if s == nil {
@@ -107,6 +127,9 @@ func (c *ClientConnection) Fetch(method string, target string, headers ...hc.Hea
 		pushes:                 pushes,
 		InformationalResponses: informational,
 		informationalResponses: informational,
+		continued:              make(chan struct{}),
+		final:                  make(chan struct{}),
+		decompress:             decompress,
 	}
 
 	err = req.writeHeaderBlock(allHeaders)
@@ -123,7 +146,12 @@ func (c *ClientConnection) getPushPromise(pushID uint64) *PushPromise {
 	c.pushLock.Lock()
 	promise := c.promises[pushID]
 	if promise == nil {
-		promise = &PushPromise{pushID: pushID, responseChannel: make(chan *ClientResponse)}
+		promise = &PushPromise{
+			c:               c,
+			pushID:          pushID,
+			responseChannel: make(chan *ClientResponse, 1),
+			fulfilled:       make(chan struct{}),
+		}
 		c.promises[pushID] = promise
 	}
 	return promise
@@ -0,0 +1,18 @@
+package minhq
+
+import (
+	"github.com/ekr/minq"
+	"github.com/martinthomson/minhq/mw"
+)
+
+// nullTransport is a minq.Transport that drops everything.
+type nullTransport struct{}
+
+func (nullTransport) Send(p []byte) error { return nil }
+
+// idleConnection makes a client connection that doesn't send anything.
+func idleConnection() *ClientConnection {
+	tlsConfig := minq.NewTlsConfig("")
+	mc := minq.NewConnection(nullTransport{}, minq.RoleClient, &tlsConfig, nil)
+	return NewClientConnection(mw.NewConnection(mc), &Config{})
+}
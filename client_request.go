@@ -6,6 +6,7 @@ import (
 	"io"
 	"net/url"
 	"sync"
+	"time"
 
 	"github.com/martinthomson/minhq/hc"
 )
@@ -13,6 +14,9 @@ import (
 // ErrInvalidPushPromise occurs if a push promise isn't well formed.
 var ErrInvalidPushPromise = errors.New("invalid push promise")
 
+// ErrNoResponse is returned when a request failed before a response arrived.
+var ErrNoResponse = errors.New("no response was received")
+
 type requestID struct {
 	id    uint64
 	index int
@@ -60,14 +64,24 @@ type ClientRequest struct {
 	// Pushes is a feed of push promises.  Note that if pushes are not accepted
 	// the response will not be available.  So if you don't want these, then
 	// make sure to read and reject these using something like
-	// `for pp := range req.Pushes { pp.Cancel() }`
+	// `for pp := range req.Pushes { pp.Cancel() }`, or set Config.PushPolicy.
+	// Promises that Config.PushPolicy accepts or cancels don't appear here.
 	Pushes <-chan *PushPromise
 	pushes chan<- *PushPromise
 
 	// InformationalResponses is originally nil.  Assign to this if you intend to
-	// consume informational (1xx) responses.
+	// consume informational (1xx) responses.  This is closed when the final
+	// response arrives.
 	InformationalResponses <-chan *InformationalResponse
 	informationalResponses chan<- *InformationalResponse
+
+	// continued is closed when a 100 (Continue) response arrives.
+	continued chan struct{}
+	// final is closed when the final response arrives.
+	final chan struct{}
+
+	// decompress is set if the response is to be decoded.
+	decompress bool
 }
 
 // Method returns the obvious thing.
@@ -80,19 +94,38 @@ func (req *ClientRequest) Target() *url.URL {
 	return req.target
 }
 
-// Response awaits the response and returns it.
+// Response awaits the response and returns it.  This returns nil if the
+// request failed before a response arrived.
 func (req *ClientRequest) Response() *ClientResponse {
 	return <-req.response
 }
 
-func (req *ClientRequest) handlePushPromise(s *stream, c *ClientConnection, r io.Reader) error {
+// AwaitContinue is used with requests that include expect: 100-continue.  It
+// waits for a 100 (Continue) response before the body is sent.  This returns
+// true if the body should be sent, which is when 100 (Continue) arrives or the
+// timeout passes first.  This returns false if the final response arrives
+// first, in which case the server doesn't want the body.
+func (req *ClientRequest) AwaitContinue(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-req.continued:
+		return true
+	case <-req.final:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (req *ClientRequest) handlePushPromise(resp *ClientResponse, c *ClientConnection, r io.Reader) error {
 	fr := NewFrameReader(r)
 	pushID, err := fr.ReadVarint()
 	if err != nil {
 		return err
 	}
 
-	headers, err := c.connection.decoder.ReadHeaderBlock(fr, s.Id())
+	headers, err := resp.readHeaders(fr)
 	if err != nil {
 		return err
 	}
@@ -111,6 +144,13 @@ func (req *ClientRequest) handlePushPromise(s *stream, c *ClientConnection, r io
 		return err
 	}
 
+	switch c.pushAction(pp) {
+	case PushCancel:
+		return pp.Cancel()
+	case PushAccept:
+		c.keepPush(pp)
+		return nil
+	}
 	req.pushes <- pp
 	return nil
 }
@@ -121,24 +161,38 @@ func (req *ClientRequest) readResponse(s *stream, c *ClientConnection,
 		Request:         req,
 		IncomingMessage: newIncomingMessage(&s.recvStream, c.connection.decoder, nil),
 	}
+	continued := false
+	delivered := false
 	err := resp.handleMessage(func(headers headerFieldArray) (bool, error) {
 		resp.setHeaders(headers)
 		switch headers.GetStatus() / 100 {
 		case 0:
 			return false, errors.New("invalid or missing status")
 		case 1:
+			if headers.GetStatus() == 100 && !continued {
+				continued = true
+				close(req.continued)
+			}
 			if req.informationalResponses != nil {
 				req.informationalResponses <- &InformationalResponse{headers.GetStatus(), headers}
 			}
 			return false, nil
 		default:
+			if req.decompress {
+				resp.decompress()
+			}
+			close(req.final)
+			if req.informationalResponses != nil {
+				close(req.informationalResponses)
+			}
 			responseChannel <- resp
+			delivered = true
 			return true, nil
 		}
 	}, func(t FrameType, r io.Reader) error {
 		switch t {
 		case framePushPromise:
-			err := req.handlePushPromise(s, c, r)
+			err := req.handlePushPromise(resp, c, r)
 			if err != nil {
 				return err
 			}
@@ -148,7 +202,11 @@ func (req *ClientRequest) readResponse(s *stream, c *ClientConnection,
 		return nil
 	})
 	if err != nil {
+		c.checkDecoderError(err)
 		s.abort()
+		if !delivered {
+			close(responseChannel)
+		}
 		return
 	}
 	close(req.pushes)
@@ -159,6 +217,28 @@ type ClientResponse struct {
 	Request Request
 	IncomingMessage
 	Status int
+	// Via lists the redirect responses that Client.Do followed to get this
+	// response, oldest first.
+	Via []*ClientResponse
+	// Uncompressed is set if the response body was compressed and is being
+	// decoded.  See Config.AcceptCompression.
+	Uncompressed bool
+	// FromCache is set if the response came from Client.Cache without
+	// contacting the server.
+	FromCache bool
+
+	encoding string
+	decoder  io.Reader
+	// body replaces the stream for responses that were read into memory.
+	body io.Reader
+}
+
+// Cancel tells the server to stop sending the response.
+func (resp *ClientResponse) Cancel() error {
+	if resp.s == nil {
+		return nil
+	}
+	return resp.s.StopSending(uint16(ErrHttpRequestCancelled))
 }
 
 // setHeaders sets the header fields, and updates the Status field value.
@@ -184,6 +264,8 @@ type PushPromise struct {
 	responseChannel chan *ClientResponse
 	response        *ClientResponse
 	cancelled       bool
+	// fulfilled is closed when the response arrives or the push is cancelled.
+	fulfilled chan struct{}
 
 	InformationalResponses <-chan *InformationalResponse
 	informationalResponses chan<- *InformationalResponse
@@ -222,16 +304,42 @@ func (pp *PushPromise) setHeaders(h []hc.HeaderField) error {
 func (pp *PushPromise) fulfill(resp *ClientResponse, cancelled bool) {
 	defer pp.responseLock.Unlock()
 	pp.responseLock.Lock()
+	if pp.response != nil || pp.cancelled {
+		return
+	}
+	// responseChannel has space for this, so this doesn't block.
 	pp.responseChannel <- resp
 	pp.response = resp
 	pp.cancelled = cancelled
 	close(pp.responseChannel)
+	close(pp.fulfilled)
 }
 
-func (pp *PushPromise) isFulfilled() bool {
+// peekResponse waits until the deadline for the response, without claiming it.
+// This returns false if the response didn't arrive in time, and a nil response
+// if the push was cancelled.
+func (pp *PushPromise) peekResponse(deadline time.Time) (*ClientResponse, bool) {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-pp.fulfilled:
+	case <-timer.C:
+		return nil, false
+	}
+	return pp.fulfilledResponse()
+}
+
+// fulfilledResponse returns the response and true if the push is fulfilled.
+// The response is nil if the push was cancelled.
+func (pp *PushPromise) fulfilledResponse() (*ClientResponse, bool) {
 	defer pp.responseLock.RUnlock()
 	pp.responseLock.RLock()
-	return pp.response != nil || pp.cancelled
+	return pp.response, pp.response != nil || pp.cancelled
+}
+
+func (pp *PushPromise) isFulfilled() bool {
+	_, fulfilled := pp.fulfilledResponse()
+	return fulfilled
 }
 
 // Response returns a response.  Note that because multiple push promises
@@ -246,8 +354,11 @@ func (pp *PushPromise) Response() *ClientResponse {
 // Cancel cancels the push promise, either by sending CANCEL_PUSH, or by
 // stopping the stream if it has already started to arrive.
 func (pp *PushPromise) Cancel() error {
-	if pp.isFulfilled() {
-		return pp.response.s.StopSending(uint16(ErrHttpRequestCancelled))
+	if resp, fulfilled := pp.fulfilledResponse(); fulfilled {
+		if resp == nil {
+			return nil
+		}
+		return resp.s.StopSending(uint16(ErrHttpRequestCancelled))
 	}
 
 	var buf bytes.Buffer
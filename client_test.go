@@ -0,0 +1,68 @@
+package minhq_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/martinthomson/minhq"
+	"github.com/martinthomson/minhq/mw/test"
+	"github.com/stvp/assert"
+)
+
+type fakeResolver struct {
+	addrs []net.IPAddr
+	err   error
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return r.addrs, r.err
+}
+
+func TestConnectResolverError(t *testing.T) {
+	resolverErr := errors.New("no such host")
+	client := minhq.Client{Resolver: &fakeResolver{err: resolverErr}}
+	_, err := client.Connect("example.com")
+	assert.Equal(t, resolverErr, err)
+	assert.Equal(t, 0, len(client.Connections))
+}
+
+func TestConnectNoAddresses(t *testing.T) {
+	client := minhq.Client{Resolver: &fakeResolver{}}
+	_, err := client.Connect("example.com:4433")
+	assert.NotNil(t, err)
+}
+
+func TestConnectCancelled(t *testing.T) {
+	// Nothing listens on the discard port, so this can't succeed.
+	client := minhq.Client{Resolver: &fakeResolver{addrs: []net.IPAddr{
+		{IP: net.ParseIP("::1")},
+		{IP: net.ParseIP("127.0.0.1")},
+	}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := client.ConnectContext(ctx, "localhost:9")
+	assert.Equal(t, context.Canceled, err)
+}
+
+// test.Transport can be used with a Dialer.
+var _ minhq.PacketSource = &test.Transport{}
+
+func TestSharedDialer(t *testing.T) {
+	socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	assert.Nil(t, err)
+	dialer := minhq.NewSharedDialer(socket, nil)
+	defer dialer.Close()
+
+	remote := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9}
+	_, source, err := dialer.Dial(remote)
+	assert.Nil(t, err)
+	_, _, err = dialer.Dial(remote)
+	assert.Equal(t, minhq.ErrAlreadyDialed, err)
+
+	// Once the first source is closed, the address can be used again.
+	assert.Nil(t, source.Close())
+	_, _, err = dialer.Dial(remote)
+	assert.Nil(t, err)
+}
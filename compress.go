@@ -0,0 +1,250 @@
+package minhq
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/martinthomson/minhq/hc"
+)
+
+// acceptEncoding is what a client sends when Config.AcceptCompression is set.
+// Brotli isn't included because there is no decoder in the standard library.
+const acceptEncoding = "gzip, deflate"
+
+// hasHeader checks if a header field is present.
+func hasHeader(headers []hc.HeaderField, name string) bool {
+	for _, h := range headers {
+		if strings.EqualFold(h.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// newDecompressor makes a reader that decodes a body with the given content
+// coding.  This returns nil if the coding isn't supported.
+func newDecompressor(encoding string, r io.Reader) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		// This is supposed to be zlib, but some servers send raw deflate.
+		br := bufio.NewReader(r)
+		header, err := br.Peek(2)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if len(header) == 2 && header[0]&0x0f == 8 &&
+			(uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	}
+	return nil, nil
+}
+
+// decompress arranges for a response body to be decoded, if that's possible.
+// The content-encoding and content-length header fields are removed if so.
+func (resp *ClientResponse) decompress() {
+	encoding := resp.GetHeader("content-encoding")
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip", "deflate":
+	default:
+		return
+	}
+	resp.encoding = encoding
+	resp.Uncompressed = true
+	headers := make(headerFieldArray, 0, len(resp.Headers))
+	for _, h := range resp.Headers {
+		if h.Name != "content-encoding" && h.Name != "content-length" {
+			headers = append(headers, h)
+		}
+	}
+	resp.Headers = headers
+}
+
+// Read reads the response body, decoding it if necessary.
+func (resp *ClientResponse) Read(p []byte) (int, error) {
+	if resp.body != nil {
+		return resp.body.Read(p)
+	}
+	return resp.readStream(p)
+}
+
+// readStream reads the body from the stream, ignoring resp.body.
+func (resp *ClientResponse) readStream(p []byte) (int, error) {
+	if resp.encoding == "" {
+		return resp.IncomingMessage.Read(p)
+	}
+	if resp.decoder == nil {
+		// Making a decoder reads from the body, so it is deferred until now.
+		decoder, err := newDecompressor(resp.encoding, &resp.IncomingMessage)
+		if err != nil {
+			return 0, err
+		}
+		resp.decoder = decoder
+	}
+	return resp.decoder.Read(p)
+}
+
+// streamBody reads the body of a response from the stream.  This is used when
+// resp.body holds the start of the body.
+type streamBody struct {
+	resp *ClientResponse
+}
+
+func (sb streamBody) Read(p []byte) (int, error) {
+	return sb.resp.readStream(p)
+}
+
+// compressibleTypes are the media type prefixes that CompressHandler
+// compresses.
+var compressibleTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"image/svg+xml",
+}
+
+func isCompressible(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	for _, t := range compressibleTypes {
+		if strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// chooseEncoding picks gzip or deflate based on an accept-encoding header
+// field, or returns an empty string if neither is acceptable.
+func chooseEncoding(accept string) string {
+	best, bestQ := "", 0.0
+	for _, item := range strings.Split(accept, ",") {
+		parts := strings.Split(item, ";")
+		coding := strings.ToLower(strings.TrimSpace(parts[0]))
+		q := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				v, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					q = v
+				}
+			}
+		}
+		if coding == "*" {
+			coding = "gzip"
+		}
+		if (coding == "gzip" || coding == "deflate") && q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// CompressHandler wraps a handler so that responses are compressed with gzip or
+// deflate if the request allows it.  Only textual content is compressed, and
+// responses that already have a content-encoding are left alone.
+func CompressHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := chooseEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == "HEAD" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.Close()
+		handler.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter compresses a response, if that makes sense.  The decision is
+// made when the response starts.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding   string
+	started    bool
+	compressor io.WriteCloser
+}
+
+// start works out if the response is compressed and sends the header.
+func (cw *compressWriter) start(statusCode int, p []byte) {
+	cw.started = true
+	h := cw.Header()
+	if h.Get("Content-Type") == "" && p != nil {
+		h.Set("Content-Type", http.DetectContentType(p))
+	}
+	if statusCode >= 200 && statusCode != http.StatusNoContent &&
+		statusCode != http.StatusNotModified &&
+		h.Get("Content-Encoding") == "" && isCompressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", cw.encoding)
+		h.Add("Vary", "Accept-Encoding")
+		h.Del("Content-Length")
+		if cw.encoding == "gzip" {
+			cw.compressor = gzip.NewWriter(cw.ResponseWriter)
+		} else {
+			cw.compressor, _ = flate.NewWriter(cw.ResponseWriter, flate.DefaultCompression)
+		}
+	}
+	cw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (cw *compressWriter) WriteHeader(statusCode int) {
+	if statusCode < 200 {
+		cw.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+	if !cw.started {
+		cw.start(statusCode, nil)
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.started {
+		cw.start(http.StatusOK, p)
+	}
+	if cw.compressor != nil {
+		return cw.compressor.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher.
+func (cw *compressWriter) Flush() {
+	if !cw.started {
+		cw.start(http.StatusOK, nil)
+	}
+	if f, ok := cw.compressor.(interface {
+		Flush() error
+	}); ok {
+		_ = f.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Push implements http.Pusher, if the underlying writer does.
+func (cw *compressWriter) Push(target string, opts *http.PushOptions) error {
+	if p, ok := cw.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// Close finishes compression.
+func (cw *compressWriter) Close() error {
+	if cw.compressor != nil {
+		return cw.compressor.Close()
+	}
+	return nil
+}
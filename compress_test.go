@@ -0,0 +1,68 @@
+package minhq_test
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/martinthomson/minhq"
+	"github.com/stvp/assert"
+)
+
+var compressBody = strings.Repeat("compress me please ", 100)
+
+func serveCompressed(accept string, contentType string) *httptest.ResponseRecorder {
+	handler := minhq.CompressHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		w.Write([]byte(compressBody))
+	}))
+	r := httptest.NewRequest("GET", "https://example.com/", nil)
+	if accept != "" {
+		r.Header.Set("Accept-Encoding", accept)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestCompressGzip(t *testing.T) {
+	w := serveCompressed("deflate;q=0.5, gzip", "")
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	assert.True(t, w.Body.Len() < len(compressBody))
+
+	r, err := gzip.NewReader(w.Body)
+	assert.Nil(t, err)
+	decoded, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, compressBody, string(decoded))
+}
+
+func TestCompressDeflate(t *testing.T) {
+	w := serveCompressed("deflate", "text/plain")
+	assert.Equal(t, "deflate", w.Header().Get("Content-Encoding"))
+	decoded, err := ioutil.ReadAll(flate.NewReader(w.Body))
+	assert.Nil(t, err)
+	assert.Equal(t, compressBody, string(decoded))
+}
+
+func TestCompressNotAccepted(t *testing.T) {
+	w := serveCompressed("", "text/plain")
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, compressBody, w.Body.String())
+
+	w = serveCompressed("gzip;q=0, br", "text/plain")
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+}
+
+func TestCompressWrongType(t *testing.T) {
+	w := serveCompressed("gzip", "image/png")
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, compressBody, w.Body.String())
+}
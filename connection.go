@@ -5,6 +5,8 @@ import (
 	"errors"
 	"io"
 	"io/ioutil"
+	"strings"
+	"time"
 
 	"github.com/ekr/minq"
 	"github.com/martinthomson/minhq/hc"
@@ -23,6 +25,7 @@ const (
 	ErrHttpPushAlreadyInCache  = HTTPError(0x4)
 	ErrHttpRequestCancelled    = HTTPError(0x5)
 	ErrHttpDecompressionFailed = HTTPError(0x6)
+	ErrHttpExcessiveLoad       = HTTPError(0x8)
 	ErrHttpUnknownStreamType   = HTTPError(0xd)
 )
 
@@ -42,6 +45,8 @@ func (e HTTPError) String() string {
 		return "REQUEST_CANCELLED"
 	case ErrHttpDecompressionFailed:
 		return "HTTP_HPACK_DECOMPRESSION_FAILED"
+	case ErrHttpExcessiveLoad:
+		return "HTTP_EXCESSIVE_LOAD"
 	case ErrHttpUnknownStreamType:
 		return "HTTP_UNKNOWN_STREAM_TYPE"
 	default:
@@ -94,6 +99,122 @@ type Config struct {
 	// promises that emit informational responses.  Setting this to false causes
 	// informational responses to be discarded.
 	InformationalResponses bool
+	// MaxConcurrentRequests limits the number of goroutines that a server
+	// connection uses to handle requests.  Each request occupies one of these
+	// until the request body has been read.  Zero means a default of 100.
+	MaxConcurrentRequests int
+	// RequestQueueDepth is the number of new requests that a server connection
+	// will hold while waiting for a goroutine to become available.  Requests
+	// that arrive when the queue is full are rejected.  Zero means a default
+	// of 16.
+	RequestQueueDepth int
+	// MaxPacketSize is the size of the buffers used to receive UDP datagrams.
+	// Datagrams larger than this are truncated.  Zero means a default of 4096.
+	MaxPacketSize int
+	// AcceptCompression causes clients to add accept-encoding to requests
+	// that don't have one, and to decode gzip and deflate responses to those
+	// requests.  The content-encoding header field is removed from responses
+	// that are decoded.
+	AcceptCompression bool
+	// ServerShards is the number of service loops that Listen spreads
+	// connections across.  Each has its own goroutine, which allows a server
+	// to use more than one core.  Zero means a single loop.
+	ServerShards int
+	// PushPolicy decides what a client does with push promises.  If this is
+	// nil, all promises are sent to ClientRequest.Pushes.
+	PushPolicy PushPolicy
+	// UnclaimedPushLifetime is how long a client keeps a push that PushPolicy
+	// accepted, waiting for a Fetch that matches it.  Pushes that aren't
+	// claimed in this time are cancelled.  Zero means a default of 30 seconds.
+	UnclaimedPushLifetime time.Duration
+	// PushAuthorities lists the authorities, as host or host:port, that a
+	// server can push for in addition to the authority of the request.  The
+	// port defaults to 443.
+	PushAuthorities []string
+	// IndexingStrategy decides how the QPACK encoder uses the dynamic table.
+	// This is shared by all connections, so it needs to be safe for concurrent
+	// use.  If this is nil, hc.DefaultIndexing is used.
+	IndexingStrategy hc.IndexingStrategy
+	// AdaptiveEncoder puts the QPACK encoder in adaptive mode, which learns
+	// which header fields recur on each connection.  IndexingStrategy is not
+	// used while the encoder is in adaptive mode.
+	AdaptiveEncoder bool
+	// MaxHeaderBlockSize limits the size of header blocks that are accepted.
+	// This counts the length of each name and value plus 32 bytes for each
+	// header field, and it is advertised to peers.  Zero means no limit.
+	MaxHeaderBlockSize int
+	// MaxHeaderStringLength limits the length of header field names and values
+	// that are accepted.  Zero means no limit.
+	MaxHeaderStringLength int
+	// BlockedDecodeTimeout limits how long a header block can wait for QPACK
+	// table updates before the stream is reset.  Zero means no limit.  The
+	// number of header blocks that can wait is set by ConcurrentDecoders.
+	BlockedDecodeTimeout time.Duration
+	// SensitiveHeaders lists the names of header fields that are always sent
+	// as never-indexed literals, which intermediaries are not permitted to
+	// add to a table.  Short values of these are also sent without Huffman
+	// coding.  If this is nil, authorization, cookie, proxy-authorization and
+	// set-cookie are sensitive.  Use an empty list to mark nothing.
+	SensitiveHeaders []string
+}
+
+// defaultSensitiveHeaders is used if Config.SensitiveHeaders is nil.
+var defaultSensitiveHeaders = []string{
+	"authorization", "cookie", "proxy-authorization", "set-cookie",
+}
+
+const (
+	defaultMaxConcurrentRequests = 100
+	defaultRequestQueueDepth     = 16
+	defaultMaxPacketSize         = 4096
+	defaultUnclaimedPushLifetime = 30 * time.Second
+)
+
+func (config *Config) maxConcurrentRequests() int {
+	if config.MaxConcurrentRequests <= 0 {
+		return defaultMaxConcurrentRequests
+	}
+	return config.MaxConcurrentRequests
+}
+
+func (config *Config) requestQueueDepth() int {
+	if config.RequestQueueDepth <= 0 {
+		return defaultRequestQueueDepth
+	}
+	return config.RequestQueueDepth
+}
+
+func (config *Config) serverShards() int {
+	if config.ServerShards <= 0 {
+		return 1
+	}
+	return config.ServerShards
+}
+
+func (config *Config) maxPacketSize() int {
+	if config.MaxPacketSize <= 0 {
+		return defaultMaxPacketSize
+	}
+	return config.MaxPacketSize
+}
+
+func (config *Config) unclaimedPushLifetime() time.Duration {
+	if config.UnclaimedPushLifetime <= 0 {
+		return defaultUnclaimedPushLifetime
+	}
+	return config.UnclaimedPushLifetime
+}
+
+func (config *Config) sensitiveHeaders() map[string]bool {
+	names := config.SensitiveHeaders
+	if names == nil {
+		names = defaultSensitiveHeaders
+	}
+	sensitive := make(map[string]bool, len(names))
+	for _, n := range names {
+		sensitive[strings.ToLower(n)] = true
+	}
+	return sensitive
 }
 
 // connectionHandler is used by subclasses of connection to deal with frames that only they handle.
@@ -111,6 +232,8 @@ type connection struct {
 	decoder       *hc.QpackDecoder
 	encoder       *hc.QpackEncoder
 	controlStream *sendStream
+	// sensitive is the set of names that are marked as sensitive.
+	sensitive map[string]bool
 
 	// ready is closed when the connection is truly ready to send
 	// requests or responses.  Read from it before sending anything that
@@ -134,6 +257,9 @@ func (c *connection) connect(handler connectionHandler) error {
 		return err
 	}
 	c.encoder = hc.NewQpackEncoder(encoderStream, 0, 0)
+	c.encoder.SetIndexingStrategy(c.config.IndexingStrategy)
+	c.encoder.SetAdaptive(c.config.AdaptiveEncoder)
+	c.sensitive = c.config.sensitiveHeaders()
 
 	decoderStream := c.CreateSendStream()
 	_, err = decoderStream.Write([]byte{byte(unidirectionalStreamQpackDecoder)})
@@ -141,6 +267,10 @@ func (c *connection) connect(handler connectionHandler) error {
 		return err
 	}
 	c.decoder = hc.NewQpackDecoder(decoderStream, c.config.DecoderTableCapacity)
+	c.decoder.SetMaxBlockedStreams(int(c.config.ConcurrentDecoders))
+	c.decoder.SetBlockedTimeout(c.config.BlockedDecodeTimeout)
+	c.decoder.SetMaxStringLength(c.config.MaxHeaderStringLength)
+	c.decoder.SetMaxHeaderBlockSize(c.config.MaxHeaderBlockSize)
 
 	// Asynchronously wait for incoming streams and then spawn handlers for each.
 	// ready is used to signal that we have received settings from the other side.
@@ -148,6 +278,29 @@ func (c *connection) connect(handler connectionHandler) error {
 	return nil
 }
 
+// HeaderStats returns statistics for the QPACK encoder and decoder.  These are
+// empty if the connection hasn't been set up yet.
+func (c *connection) HeaderStats() (encoder hc.Stats, decoder hc.Stats) {
+	if c.encoder != nil {
+		encoder = c.encoder.Stats()
+	}
+	if c.decoder != nil {
+		decoder = c.decoder.Stats()
+	}
+	return encoder, decoder
+}
+
+// checkDecoderError closes the connection if an error from reading a header
+// block means that the decoder can't continue.  Other errors only affect the
+// stream.
+func (c *connection) checkDecoderError(err error) {
+	switch err {
+	case hc.ErrTooManyBlockedStreams, hc.ErrIndexError, hc.ErrTableOverflow,
+		hc.ErrIntegerOverflow:
+		c.FatalError(ErrHttpDecompressionFailed)
+	}
+}
+
 // FatalError is a helper that passes on HTTP errors to the underlying connection.
 func (c *connection) FatalError(e HTTPError) error {
 	return c.Error(uint16(e), "")
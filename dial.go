@@ -0,0 +1,188 @@
+package minhq
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/martinthomson/minhq/mw"
+)
+
+// Resolver finds the addresses for a host.  *net.Resolver implements this,
+// but tests can use something simpler to avoid DNS.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// DefaultAttemptDelay is the time between connection attempts that a client
+// makes to different addresses.  This is the value that RFC 8305 recommends.
+const DefaultAttemptDelay = 250 * time.Millisecond
+
+// errNoAddresses is returned when a host has no addresses.
+var errNoAddresses = errors.New("no addresses for host")
+
+func (c *Client) resolver() Resolver {
+	if c.Resolver == nil {
+		return net.DefaultResolver
+	}
+	return c.Resolver
+}
+
+func (c *Client) attemptDelay() time.Duration {
+	if c.AttemptDelay <= 0 {
+		return DefaultAttemptDelay
+	}
+	return c.AttemptDelay
+}
+
+// resolve finds all the addresses for a host and port, ordered so that address
+// families alternate, starting with the family of the first address.
+func (c *Client) resolve(ctx context.Context, host string, port string) ([]*net.UDPAddr, error) {
+	portNumber, err := net.LookupPort("udp", port)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IPAddr
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IPAddr{{IP: ip}}
+	} else {
+		ips, err = c.resolver().LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(ips) == 0 {
+		return nil, errNoAddresses
+	}
+
+	var first, second []*net.UDPAddr
+	firstIsV4 := ips[0].IP.To4() != nil
+	for _, ip := range ips {
+		addr := &net.UDPAddr{IP: ip.IP, Port: portNumber, Zone: ip.Zone}
+		if (ip.IP.To4() != nil) == firstIsV4 {
+			first = append(first, addr)
+		} else {
+			second = append(second, addr)
+		}
+	}
+	addrs := make([]*net.UDPAddr, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			addrs = append(addrs, first[i])
+		}
+		if i < len(second) {
+			addrs = append(addrs, second[i])
+		}
+	}
+	return addrs, nil
+}
+
+// connectAttempt is the outcome of trying to connect to one address.
+type connectAttempt struct {
+	connection *ClientConnection
+	err        error
+}
+
+// attempt starts a connection attempt and waits for it to complete.  The
+// outcome is reported on results, unless ctx is cancelled first, in which case
+// the connection is closed.
+func (c *Client) attempt(ctx context.Context, serverName string, addr *net.UDPAddr,
+	results chan<- *connectAttempt) {
+	connection, err := c.dial(serverName, addr)
+	if err != nil {
+		select {
+		case results <- &connectAttempt{err: err}:
+		case <-ctx.Done():
+		}
+		return
+	}
+
+	r := &connectAttempt{connection: connection}
+	err = awaitConnection(ctx, connection.Connected, connection.Closed())
+	if err == mw.ErrConnectionClosed {
+		r = &connectAttempt{err: err}
+	} else if err != nil {
+		_ = connection.Close()
+		return
+	}
+	select {
+	case results <- r:
+	case <-ctx.Done():
+		if r.connection != nil {
+			_ = r.connection.Close()
+		}
+	}
+}
+
+// awaitConnection waits for a connection attempt to finish.  A connection that
+// fails closes connected as well as closed, so closed is checked even if
+// connected is the one that is selected.
+func awaitConnection(ctx context.Context, connected <-chan struct{}, closed <-chan struct{}) error {
+	select {
+	case <-connected:
+		select {
+		case <-closed:
+			return mw.ErrConnectionClosed
+		default:
+			return nil
+		}
+	case <-closed:
+		return mw.ErrConnectionClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// happyEyeballs races connection attempts to each of the addresses.  Attempts
+// start in order, each one AttemptDelay after the last, or immediately if
+// every earlier attempt has failed.  The first connection to be established
+// is used and the others are closed.
+func (c *Client) happyEyeballs(ctx context.Context, serverName string, addrs []*net.UDPAddr) (*ClientConnection, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan *connectAttempt)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	next := 0
+	pending := 0
+	var lastErr error
+	for {
+		var start <-chan time.Time
+		if next < len(addrs) {
+			start = timer.C
+		}
+		select {
+		case <-start:
+			go c.attempt(ctx, serverName, addrs[next], results)
+			next++
+			pending++
+			timer.Reset(c.attemptDelay())
+
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				return r.connection, nil
+			}
+			lastErr = r.err
+			if pending == 0 {
+				if next >= len(addrs) {
+					return nil, lastErr
+				}
+				// Don't wait to start the next attempt.
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(0)
+			}
+
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package minhq
+
+import (
+	"context"
+	"testing"
+
+	"github.com/martinthomson/minhq/mw"
+	"github.com/stvp/assert"
+)
+
+func TestAwaitConnection(t *testing.T) {
+	open := make(chan struct{})
+	done := make(chan struct{})
+	close(done)
+
+	assert.Nil(t, awaitConnection(context.Background(), done, open))
+	assert.Equal(t, mw.ErrConnectionClosed, awaitConnection(context.Background(), open, done))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, awaitConnection(ctx, open, open))
+}
+
+// A failed connection closes both channels.  That mustn't look like success,
+// whichever channel is selected.
+func TestAwaitConnectionFailed(t *testing.T) {
+	done := make(chan struct{})
+	close(done)
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, mw.ErrConnectionClosed, awaitConnection(context.Background(), done, done))
+	}
+}
@@ -0,0 +1,212 @@
+package minhq
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/ekr/minq"
+	"github.com/martinthomson/minhq/mw"
+)
+
+// sharedSourceDepth is the number of packets that are held for each
+// connection on a shared socket.  Packets are dropped if a connection doesn't
+// keep up.
+const sharedSourceDepth = 16
+
+// ErrAlreadyDialed is returned by SharedDialer if there is already a connection
+// to the same remote address.  Packets on a shared socket are routed using the
+// remote address, so only one connection to each address is possible.
+var ErrAlreadyDialed = errors.New("already connected to that address")
+
+// PacketSource provides packets for a client connection.  mw/test.Transport
+// implements this, as well as minq.Transport.
+type PacketSource interface {
+	// Service passes packets to the given channel until the source is closed
+	// or fails.  Packets that don't have a source address are marked as coming
+	// from addr.
+	Service(addr *net.UDPAddr, packets chan<- *mw.Packet)
+	// Close stops the flow of packets.
+	Close() error
+}
+
+// Dialer creates what a client needs to talk to a server at the given address:
+// a transport for sending packets and a source of incoming packets.
+type Dialer interface {
+	Dial(remote *net.UDPAddr) (minq.Transport, PacketSource, error)
+}
+
+// UDPDialer creates a new UDP socket for each connection.
+type UDPDialer struct {
+	// LocalAddr is the address that sockets are bound to.  If this is nil,
+	// an ephemeral port is used.  Setting the Zone selects an interface.
+	LocalAddr *net.UDPAddr
+	// PacketPool provides buffers for incoming packets.  If this is nil, a
+	// pool with buffers of 4096 octets is used.
+	PacketPool *mw.PacketPool
+
+	poolOnce sync.Once
+}
+
+func (d *UDPDialer) pool() *mw.PacketPool {
+	d.poolOnce.Do(func() {
+		if d.PacketPool == nil {
+			d.PacketPool = mw.NewPacketPool(defaultMaxPacketSize)
+		}
+	})
+	return d.PacketPool
+}
+
+// Dial implements Dialer.
+func (d *UDPDialer) Dial(remote *net.UDPAddr) (minq.Transport, PacketSource, error) {
+	socket, err := net.ListenUDP("udp", d.LocalAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return minq.NewUdpTransport(socket, remote), &socketSource{socket, d.pool()}, nil
+}
+
+// socketSource reads packets from a socket that is used by one connection.
+type socketSource struct {
+	socket net.PacketConn
+	pool   *mw.PacketPool
+}
+
+func (s *socketSource) Service(addr *net.UDPAddr, packets chan<- *mw.Packet) {
+	servicePacketConn(packets, s.socket, s.socket, s.pool, nil)
+}
+
+func (s *socketSource) Close() error {
+	return s.socket.Close()
+}
+
+// SharedDialer uses the same socket for multiple connections.  Incoming
+// packets are routed to connections based on the address they come from.
+type SharedDialer struct {
+	socket net.PacketConn
+
+	lock    sync.Mutex
+	sources map[string]*sharedSource
+	closed  bool
+}
+
+// NewSharedDialer creates a SharedDialer that uses the given socket, which
+// it takes ownership of.  If pool is nil, a pool with buffers of 4096 octets
+// is used.
+func NewSharedDialer(socket net.PacketConn, pool *mw.PacketPool) *SharedDialer {
+	if pool == nil {
+		pool = mw.NewPacketPool(defaultMaxPacketSize)
+	}
+	d := &SharedDialer{
+		socket:  socket,
+		sources: make(map[string]*sharedSource),
+	}
+	go d.service(pool)
+	return d
+}
+
+// Dial implements Dialer.
+func (d *SharedDialer) Dial(remote *net.UDPAddr) (minq.Transport, PacketSource, error) {
+	key := remote.String()
+
+	defer d.lock.Unlock()
+	d.lock.Lock()
+	if d.closed {
+		return nil, nil, errors.New("dialer is closed")
+	}
+	if d.sources[key] != nil {
+		return nil, nil, ErrAlreadyDialed
+	}
+	s := &sharedSource{
+		d:       d,
+		key:     key,
+		packets: make(chan *mw.Packet, sharedSourceDepth),
+		closed:  make(chan struct{}),
+	}
+	d.sources[key] = s
+	return &packetConnTransport{d.socket, remote}, s, nil
+}
+
+// service reads from the socket and routes packets.
+func (d *SharedDialer) service(pool *mw.PacketPool) {
+	defer d.closeSources()
+
+	reader := newPacketReader(d.socket, pool)
+	for {
+		batch, err := reader.ReadPackets()
+		if err != nil {
+			return
+		}
+		for _, p := range batch {
+			d.route(p)
+		}
+	}
+}
+
+func (d *SharedDialer) route(p *mw.Packet) {
+	defer d.lock.Unlock()
+	d.lock.Lock()
+	s := d.sources[p.SrcAddr.String()]
+	if s == nil {
+		p.Release()
+		return
+	}
+	select {
+	case s.packets <- p:
+	default:
+		p.Release()
+	}
+}
+
+func (d *SharedDialer) remove(s *sharedSource) {
+	defer d.lock.Unlock()
+	d.lock.Lock()
+	if d.sources[s.key] == s {
+		delete(d.sources, s.key)
+		close(s.closed)
+	}
+}
+
+func (d *SharedDialer) closeSources() {
+	defer d.lock.Unlock()
+	d.lock.Lock()
+	d.closed = true
+	for key, s := range d.sources {
+		delete(d.sources, key)
+		close(s.closed)
+	}
+}
+
+// Close closes the socket, which stops all connections that use it.
+func (d *SharedDialer) Close() error {
+	return d.socket.Close()
+}
+
+// sharedSource is the PacketSource for one connection on a shared socket.
+type sharedSource struct {
+	d       *SharedDialer
+	key     string
+	packets chan *mw.Packet
+	closed  chan struct{}
+}
+
+func (s *sharedSource) Service(addr *net.UDPAddr, packets chan<- *mw.Packet) {
+	for {
+		select {
+		case p := <-s.packets:
+			select {
+			case packets <- p:
+			case <-s.closed:
+				p.Release()
+				return
+			}
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+func (s *sharedSource) Close() error {
+	s.d.remove(s)
+	return nil
+}
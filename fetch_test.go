@@ -2,11 +2,15 @@ package minhq_test
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"io"
 	"io/ioutil"
+	"net/http/cookiejar"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/ekr/minq"
 
@@ -27,14 +31,21 @@ func (cs *clientServer) Close() error {
 	return cs.cs.Close()
 }
 
-func newClientServerPair(t *testing.T) *clientServer {
-	config := &minhq.Config{
+func testConfig() *minhq.Config {
+	return &minhq.Config{
 		DecoderTableCapacity:   4096,
 		ConcurrentDecoders:     10,
 		MaxConcurrentPushes:    10,
 		TrackConnections:       true,
 		InformationalResponses: true,
 	}
+}
+
+func newClientServerPair(t *testing.T) *clientServer {
+	return newClientServerPairWithConfig(t, testConfig())
+}
+
+func newClientServerPairWithConfig(t *testing.T, config *minhq.Config) *clientServer {
 	var server *minhq.Server
 	cs := test.NewClientServerPair(func(ms *minq.Server) *mw.Server {
 		server = minhq.RunServer(ms, config)
@@ -185,3 +196,447 @@ func TestPushOnRequest(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestDoRedirect(t *testing.T) {
+	cs := newClientServerPair(t)
+	defer cs.Close()
+
+	jar, err := cookiejar.New(nil)
+	assert.Nil(t, err)
+	client := &minhq.Client{
+		Connections: map[string]*minhq.ClientConnection{"example.com:443": cs.client},
+		Jar:         jar,
+	}
+
+	done := make(chan *minhq.ClientResponse)
+	go func() {
+		resp, err := client.Do("POST", "https://example.com/start", []byte("body"),
+			hc.HeaderField{Name: "Content-Type", Value: "text/plain"})
+		assert.Nil(t, err)
+		done <- resp
+	}()
+
+	serverRequest := <-cs.server.Requests
+	assert.Equal(t, "POST", serverRequest.Method())
+	_, err = io.Copy(ioutil.Discard, serverRequest)
+	assert.Nil(t, err)
+	serverResponse, err := serverRequest.Respond(302,
+		hc.HeaderField{Name: "Location", Value: "/next"},
+		hc.HeaderField{Name: "Set-Cookie", Value: "a=b; Path=/"})
+	assert.Nil(t, err)
+	assert.Nil(t, serverResponse.Close())
+
+	// A 302 turns POST into GET, without the body.
+	serverRequest = <-cs.server.Requests
+	assert.Equal(t, "GET", serverRequest.Method())
+	assert.Equal(t, "https://example.com/next", serverRequest.Target().String())
+	assert.Equal(t, "a=b", serverRequest.GetHeader("cookie"))
+	assert.Equal(t, "", serverRequest.GetHeader("content-type"))
+	serverResponse, err = serverRequest.Respond(200)
+	assert.Nil(t, err)
+	assert.Nil(t, serverResponse.Close())
+
+	resp := <-done
+	assert.Equal(t, 200, resp.Status)
+	assert.Equal(t, 1, len(resp.Via))
+	assert.Equal(t, 302, resp.Via[0].Status)
+
+	// A 301 turns PUT into GET too.
+	go func() {
+		resp, err := client.Do("PUT", "https://example.com/put", []byte("body"),
+			hc.HeaderField{Name: "Content-Type", Value: "text/plain"})
+		assert.Nil(t, err)
+		done <- resp
+	}()
+
+	serverRequest = <-cs.server.Requests
+	assert.Equal(t, "PUT", serverRequest.Method())
+	_, err = io.Copy(ioutil.Discard, serverRequest)
+	assert.Nil(t, err)
+	serverResponse, err = serverRequest.Respond(301,
+		hc.HeaderField{Name: "Location", Value: "/moved"})
+	assert.Nil(t, err)
+	assert.Nil(t, serverResponse.Close())
+
+	serverRequest = <-cs.server.Requests
+	assert.Equal(t, "GET", serverRequest.Method())
+	assert.Equal(t, "https://example.com/moved", serverRequest.Target().String())
+	assert.Equal(t, "", serverRequest.GetHeader("content-type"))
+	serverResponse, err = serverRequest.Respond(200)
+	assert.Nil(t, err)
+	assert.Nil(t, serverResponse.Close())
+
+	resp = <-done
+	assert.Equal(t, 200, resp.Status)
+	assert.Equal(t, 301, resp.Via[0].Status)
+}
+
+func TestFetchDecompress(t *testing.T) {
+	config := testConfig()
+	config.AcceptCompression = true
+	cs := newClientServerPairWithConfig(t, config)
+	defer cs.Close()
+
+	clientRequest, err := cs.client.Fetch("GET", "https://example.com/gzip")
+	assert.Nil(t, err)
+	assert.Nil(t, clientRequest.Close())
+
+	serverRequest := <-cs.server.Requests
+	assert.Equal(t, "gzip, deflate", serverRequest.GetHeader("accept-encoding"))
+	serverResponse, err := serverRequest.Respond(200,
+		hc.HeaderField{Name: "Content-Encoding", Value: "gzip"})
+	assert.Nil(t, err)
+	gz := gzip.NewWriter(serverResponse)
+	_, err = gz.Write(responseMessage)
+	assert.Nil(t, err)
+	assert.Nil(t, gz.Close())
+	assert.Nil(t, serverResponse.Close())
+
+	clientResponse := clientRequest.Response()
+	assert.True(t, clientResponse.Uncompressed)
+	assert.Equal(t, "", clientResponse.GetHeader("content-encoding"))
+	body, err := ioutil.ReadAll(clientResponse)
+	assert.Nil(t, err)
+	assert.Equal(t, responseMessage, body)
+}
+
+// findHeader returns the first header field with the given name.
+func findHeader(headers []hc.HeaderField, name string) *hc.HeaderField {
+	for i := range headers {
+		if headers[i].Name == name {
+			return &headers[i]
+		}
+	}
+	return nil
+}
+
+func TestFetchSensitive(t *testing.T) {
+	config := testConfig()
+	config.SensitiveHeaders = []string{"Authorization", "x-token"}
+	cs := newClientServerPairWithConfig(t, config)
+	defer cs.Close()
+
+	clientRequest, err := cs.client.Fetch("GET", "https://example.com/",
+		hc.HeaderField{Name: "authorization", Value: "secret"},
+		hc.HeaderField{Name: "x-token", Value: "secret"},
+		hc.HeaderField{Name: "cookie", Value: "a=b"},
+	)
+	assert.Nil(t, err)
+	assert.Nil(t, clientRequest.Close())
+
+	serverRequest := <-cs.server.Requests
+	assert.True(t, findHeader(serverRequest.Headers, "authorization").Sensitive)
+	assert.True(t, findHeader(serverRequest.Headers, "x-token").Sensitive)
+	// The default list isn't used if the list is set.
+	assert.False(t, findHeader(serverRequest.Headers, "cookie").Sensitive)
+
+	serverResponse, err := serverRequest.Respond(200)
+	assert.Nil(t, err)
+	assert.Nil(t, serverResponse.Close())
+	assert.Equal(t, 200, clientRequest.Response().Status)
+}
+
+func TestDoCache(t *testing.T) {
+	cs := newClientServerPair(t)
+	defer cs.Close()
+
+	client := &minhq.Client{
+		Connections: map[string]*minhq.ClientConnection{"example.com:443": cs.client},
+		Cache:       &minhq.MemoryCache{},
+	}
+
+	done := make(chan *minhq.ClientResponse)
+	go func() {
+		resp, err := client.Do("GET", "https://example.com/cached", nil)
+		assert.Nil(t, err)
+		done <- resp
+	}()
+
+	serverRequest := <-cs.server.Requests
+	serverResponse, err := serverRequest.Respond(200,
+		hc.HeaderField{Name: "Cache-Control", Value: "max-age=60"})
+	assert.Nil(t, err)
+	_, err = serverResponse.Write([]byte("cached"))
+	assert.Nil(t, err)
+	assert.Nil(t, serverResponse.Close())
+
+	resp := <-done
+	assert.False(t, resp.FromCache)
+	body, err := ioutil.ReadAll(resp)
+	assert.Nil(t, err)
+	assert.Equal(t, "cached", string(body))
+
+	// The second request doesn't reach the server.
+	resp, err = client.Do("GET", "https://example.com/cached", nil)
+	assert.Nil(t, err)
+	assert.True(t, resp.FromCache)
+	assert.Equal(t, 200, resp.Status)
+	body, err = ioutil.ReadAll(resp)
+	assert.Nil(t, err)
+	assert.Equal(t, "cached", string(body))
+}
+
+// Fetch uses the cache, and responses are matched on the header fields that
+// are sent, including the accept-encoding that the connection adds.
+func TestFetchCache(t *testing.T) {
+	config := testConfig()
+	config.AcceptCompression = true
+	cs := newClientServerPairWithConfig(t, config)
+	defer cs.Close()
+
+	client := &minhq.Client{
+		Connections: map[string]*minhq.ClientConnection{"example.com:443": cs.client},
+		Cache:       &minhq.MemoryCache{},
+	}
+
+	clientRequest, err := client.Fetch("GET", "https://example.com/cached")
+	assert.Nil(t, err)
+	assert.Nil(t, clientRequest.Close())
+	serverRequest := <-cs.server.Requests
+	assert.Equal(t, "gzip, deflate", serverRequest.GetHeader("accept-encoding"))
+	serverResponse, err := serverRequest.Respond(200,
+		hc.HeaderField{Name: "Cache-Control", Value: "max-age=60"},
+		hc.HeaderField{Name: "Vary", Value: "accept-encoding"})
+	assert.Nil(t, err)
+	_, err = serverResponse.Write([]byte("cached"))
+	assert.Nil(t, err)
+	assert.Nil(t, serverResponse.Close())
+	resp := clientRequest.Response()
+	assert.False(t, resp.FromCache)
+	body, err := ioutil.ReadAll(resp)
+	assert.Nil(t, err)
+	assert.Equal(t, "cached", string(body))
+
+	// The same request is answered from the cache.
+	clientRequest, err = client.Fetch("GET", "https://example.com/cached")
+	assert.Nil(t, err)
+	assert.Nil(t, clientRequest.Close())
+	resp = clientRequest.Response()
+	assert.True(t, resp.FromCache)
+	body, err = ioutil.ReadAll(resp)
+	assert.Nil(t, err)
+	assert.Equal(t, "cached", string(body))
+
+	// A different accept-encoding doesn't match.
+	clientRequest, err = client.Fetch("GET", "https://example.com/cached",
+		hc.HeaderField{Name: "accept-encoding", Value: "identity"})
+	assert.Nil(t, err)
+	assert.Nil(t, clientRequest.Close())
+	serverRequest = <-cs.server.Requests
+	assert.Equal(t, "identity", serverRequest.GetHeader("accept-encoding"))
+	serverResponse, err = serverRequest.Respond(200)
+	assert.Nil(t, err)
+	assert.Nil(t, serverResponse.Close())
+	assert.False(t, clientRequest.Response().FromCache)
+}
+
+// Pushes that arrive on a request made with Fetch are stored in the cache.
+func TestFetchCachePush(t *testing.T) {
+	cs := newClientServerPair(t)
+	defer cs.Close()
+
+	cache := &minhq.MemoryCache{}
+	client := &minhq.Client{
+		Connections: map[string]*minhq.ClientConnection{"example.com:443": cs.client},
+		Cache:       cache,
+	}
+
+	clientRequest, err := client.Fetch("GET", "https://example.com/main")
+	assert.Nil(t, err)
+	assert.Nil(t, clientRequest.Close())
+
+	serverRequest := <-cs.server.Requests
+	serverPromise, err := serverRequest.Push("GET", "/pushed")
+	assert.Nil(t, err)
+	serverPushResponse, err := serverPromise.Respond(200,
+		hc.HeaderField{Name: "Cache-Control", Value: "max-age=60"})
+	assert.Nil(t, err)
+	_, err = serverPushResponse.Write(pushMessage)
+	assert.Nil(t, err)
+	assert.Nil(t, serverPushResponse.Close())
+	serverResponse, err := serverRequest.Respond(200)
+	assert.Nil(t, err)
+	assert.Nil(t, serverResponse.Close())
+
+	assert.Equal(t, 200, clientRequest.Response().Status)
+	_, ok := <-clientRequest.Pushes
+	assert.False(t, ok)
+
+	// The push is stored asynchronously.
+	for cache.Load("https://example.com/pushed") == nil {
+		time.Sleep(time.Millisecond)
+	}
+	pushedRequest, err := client.Fetch("GET", "https://example.com/pushed")
+	assert.Nil(t, err)
+	assert.Nil(t, pushedRequest.Close())
+	pushedResponse := pushedRequest.Response()
+	assert.True(t, pushedResponse.FromCache)
+	body, err := ioutil.ReadAll(pushedResponse)
+	assert.Nil(t, err)
+	assert.Equal(t, pushMessage, body)
+}
+
+func TestPushPolicyAccept(t *testing.T) {
+	config := testConfig()
+	config.PushPolicy = minhq.AcceptAllPushes
+	cs := newClientServerPairWithConfig(t, config)
+	defer cs.Close()
+
+	clientRequest, err := cs.client.Fetch("GET", "https://example.com/main")
+	assert.Nil(t, err)
+	assert.Nil(t, clientRequest.Close())
+
+	serverRequest := <-cs.server.Requests
+	serverPromise, err := serverRequest.Push("GET", "/pushed")
+	assert.Nil(t, err)
+	serverPushResponse, err := serverPromise.Respond(200)
+	assert.Nil(t, err)
+	_, err = serverPushResponse.Write(pushMessage)
+	assert.Nil(t, err)
+	assert.Nil(t, serverPushResponse.Close())
+
+	serverResponse, err := serverRequest.Respond(200)
+	assert.Nil(t, err)
+	assert.Nil(t, serverResponse.Close())
+
+	// The accepted promise isn't delivered to the application.
+	response := clientRequest.Response()
+	assert.Equal(t, 200, response.Status)
+	_, ok := <-clientRequest.Pushes
+	assert.False(t, ok)
+
+	// Requesting the pushed resource uses the push.
+	pushedRequest, err := cs.client.Fetch("GET", "https://example.com/pushed")
+	assert.Nil(t, err)
+	assert.Nil(t, pushedRequest.Close())
+	pushedResponse := pushedRequest.Response()
+	assert.Equal(t, 200, pushedResponse.Status)
+	var buf bytes.Buffer
+	_, err = io.Copy(&buf, pushedResponse)
+	assert.Nil(t, err)
+	assert.Equal(t, pushMessage, buf.Bytes())
+}
+
+func TestPushValidation(t *testing.T) {
+	config := testConfig()
+	config.PushAuthorities = []string{"static.example.com"}
+	cs := newClientServerPairWithConfig(t, config)
+	defer cs.Close()
+
+	clientRequest, err := cs.client.Fetch("GET", "https://example.com/main")
+	assert.Nil(t, err)
+	assert.Nil(t, clientRequest.Close())
+	go func() {
+		for pp := range clientRequest.Pushes {
+			_ = pp.Cancel()
+		}
+	}()
+
+	serverRequest := <-cs.server.Requests
+	_, err = serverRequest.Push("POST", "/other")
+	assert.Equal(t, minhq.ErrPushMethod, err)
+	_, err = serverRequest.Push("GET", "https://elsewhere.example.com/other")
+	assert.Equal(t, minhq.ErrPushAuthority, err)
+	_, err = serverRequest.Push("GET", "http://example.com/other")
+	assert.Equal(t, minhq.ErrPushAuthority, err)
+	_, err = serverRequest.Push("GET", "https://EXAMPLE.com:443/other")
+	assert.Nil(t, err)
+	_, err = serverRequest.Push("GET", "https://static.example.com/other")
+	assert.Nil(t, err)
+
+	serverResponse, err := serverRequest.Respond(200)
+	assert.Nil(t, err)
+	assert.Nil(t, serverResponse.Close())
+}
+
+func TestPushWaitForCredit(t *testing.T) {
+	config := testConfig()
+	config.MaxConcurrentPushes = 1
+	cs := newClientServerPairWithConfig(t, config)
+	defer cs.Close()
+
+	clientRequest, err := cs.client.Fetch("GET", "https://example.com/main")
+	assert.Nil(t, err)
+	assert.Nil(t, clientRequest.Close())
+
+	serverRequest := <-cs.server.Requests
+	serverPromise, err := serverRequest.Push("GET", "/one")
+	assert.Nil(t, err)
+	_, err = serverRequest.Push("GET", "/two")
+	assert.Equal(t, minhq.ErrNoPushIDs, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	_, err = serverRequest.PushContext(ctx, "GET", "/two")
+	cancel()
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	serverPushResponse, err := serverPromise.Respond(200)
+	assert.Nil(t, err)
+	_, err = serverPushResponse.Write(pushMessage)
+	assert.Nil(t, err)
+	assert.Nil(t, serverPushResponse.Close())
+
+	// Reading the pushed response gives the server credit for another push.
+	promise := <-clientRequest.Pushes
+	_, err = io.Copy(ioutil.Discard, promise.Response())
+	assert.Nil(t, err)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = serverRequest.PushContext(ctx, "GET", "/two")
+	assert.Nil(t, err)
+}
+
+func TestExpectContinue(t *testing.T) {
+	cs := newClientServerPair(t)
+	defer cs.Close()
+
+	clientRequest, err := cs.client.Fetch("POST", "https://example.com/upload",
+		hc.HeaderField{Name: "Expect", Value: "100-continue"})
+	assert.Nil(t, err)
+	sent := make(chan struct{})
+	go func() {
+		assert.True(t, clientRequest.AwaitContinue(5*time.Second))
+		_, err := clientRequest.Write(responseMessage)
+		assert.Nil(t, err)
+		assert.Nil(t, clientRequest.Close())
+		close(sent)
+	}()
+
+	// Reading the body sends 100 (Continue).
+	serverRequest := <-cs.server.Requests
+	body, err := ioutil.ReadAll(serverRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, responseMessage, body)
+	<-sent
+
+	info := <-clientRequest.InformationalResponses
+	assert.Equal(t, 100, info.StatusCode)
+
+	serverResponse, err := serverRequest.Respond(200)
+	assert.Nil(t, err)
+	assert.Nil(t, serverResponse.Close())
+	assert.Equal(t, 200, clientRequest.Response().Status)
+}
+
+func TestExpectContinueRefused(t *testing.T) {
+	cs := newClientServerPair(t)
+	defer cs.Close()
+
+	clientRequest, err := cs.client.Fetch("POST", "https://example.com/upload",
+		hc.HeaderField{Name: "Expect", Value: "100-continue"})
+	assert.Nil(t, err)
+
+	serverRequest := <-cs.server.Requests
+	err = serverRequest.SendInformational(200)
+	assert.Equal(t, minhq.ErrNotInformational, err)
+	serverResponse, err := serverRequest.Respond(417)
+	assert.Nil(t, err)
+	assert.Nil(t, serverResponse.Close())
+	_, err = serverRequest.Respond(200)
+	assert.Equal(t, minhq.ErrResponseStarted, err)
+
+	// The final response arrives before 100 (Continue), so the body isn't sent.
+	assert.False(t, clientRequest.AwaitContinue(5*time.Second))
+	assert.Nil(t, clientRequest.Close())
+	assert.Equal(t, 417, clientRequest.Response().Status)
+}
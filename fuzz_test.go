@@ -0,0 +1,94 @@
+//go:build go1.18
+// +build go1.18
+
+package minhq_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/martinthomson/minhq"
+)
+
+func FuzzReadVarint(f *testing.F) {
+	for _, tc := range varints {
+		f.Add(tc.e)
+	}
+	f.Fuzz(func(t *testing.T, input []byte) {
+		fr := minhq.NewFrameReader(bytes.NewReader(input))
+		v, err := fr.ReadVarint()
+		if err != nil {
+			return
+		}
+
+		// Re-encoding produces the shortest encoding, which reads the same.
+		var buf bytes.Buffer
+		fw := minhq.NewFrameWriter(&buf)
+		_, err = fw.WriteVarint(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() > len(input) {
+			t.Fatalf("encoding of %v is longer than %x", v, input)
+		}
+		again, err := minhq.NewFrameReader(&buf).ReadVarint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again != v {
+			t.Fatalf("read %v, expected %v", again, v)
+		}
+	})
+}
+
+func FuzzReadFrame(f *testing.F) {
+	f.Add([]byte{1, 7, 0})
+	f.Add([]byte{0, 4, 2, 1, 0})
+	f.Fuzz(func(t *testing.T, input []byte) {
+		fr := minhq.NewFrameReader(bytes.NewReader(input))
+		for {
+			_, r, err := fr.ReadFrame()
+			if err != nil {
+				return
+			}
+			_, err = ioutil.ReadAll(r)
+			if err != nil {
+				return
+			}
+		}
+	})
+}
+
+func FuzzFrameRoundTrip(f *testing.F) {
+	f.Add(byte(7), []byte{0})
+	f.Add(byte(4), make([]byte, 64))
+	f.Fuzz(func(t *testing.T, frameType byte, payload []byte) {
+		var buf bytes.Buffer
+		fw := minhq.NewFrameWriter(&buf)
+		_, err := fw.WriteFrame(minhq.FrameType(frameType), payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fr := minhq.NewFrameReader(&buf)
+		readType, r, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if readType != minhq.FrameType(frameType) {
+			t.Fatalf("read type %v, expected %v", readType, frameType)
+		}
+		readPayload, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(readPayload, payload) {
+			t.Fatalf("read payload %x, expected %x", readPayload, payload)
+		}
+		err = fr.CheckForEOF()
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
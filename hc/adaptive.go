@@ -0,0 +1,141 @@
+package hc
+
+const (
+	// adaptiveLimit is the number of header fields and names that adaptive
+	// mode tracks.
+	adaptiveLimit = 1024
+	// adaptiveSamples is the number of times that a name needs to be seen
+	// before adaptive mode trusts what it has learned about the name.
+	adaptiveSamples = 4
+)
+
+// nameStats counts how often a name is seen and how many of those included a
+// value that hadn't been seen before.
+type nameStats struct {
+	seen     int
+	distinct int
+}
+
+// highCardinality is true if most values for this name are new.
+func (ns *nameStats) highCardinality() bool {
+	return ns.distinct*2 > ns.seen
+}
+
+// adaptiveIndexing is the IndexingStrategy used in adaptive mode.  This
+// tracks how often header fields and names recur.  A header field is
+// inserted if it has been seen before, or if values for that name tend to
+// repeat.  Values for names with many different values aren't inserted until
+// they repeat.  Instead, one value for the name is inserted so that other
+// values can be sent as literals that reference the name.  Names that haven't
+// been seen often enough use DefaultIndexing.
+//
+// This isn't safe for concurrent use; the encoder serializes access.
+type adaptiveIndexing struct {
+	fields map[fieldKey]int
+	names  map[string]*nameStats
+}
+
+func newAdaptiveIndexing() *adaptiveIndexing {
+	return &adaptiveIndexing{
+		fields: make(map[fieldKey]int),
+		names:  make(map[string]*nameStats),
+	}
+}
+
+// age halves all counts so that old observations count for less, and to
+// make space for new header fields.
+func (ai *adaptiveIndexing) age() {
+	for k, v := range ai.fields {
+		if v <= 1 {
+			delete(ai.fields, k)
+		} else {
+			ai.fields[k] = v / 2
+		}
+	}
+	for k, ns := range ai.names {
+		if ns.seen <= 1 {
+			delete(ai.names, k)
+		} else {
+			ns.seen /= 2
+			ns.distinct /= 2
+		}
+	}
+}
+
+// observe counts a header field and returns the number of times it has been
+// seen, including this one.
+func (ai *adaptiveIndexing) observe(h HeaderField) (int, *nameStats) {
+	key := fieldKey{h.Name, h.Value}
+	count, ok := ai.fields[key]
+	ns := ai.names[h.Name]
+	if (!ok && len(ai.fields) >= adaptiveLimit) ||
+		(ns == nil && len(ai.names) >= adaptiveLimit) {
+		ai.age()
+		count = ai.fields[key]
+		ns = ai.names[h.Name]
+	}
+	if ns == nil {
+		ns = &nameStats{}
+		ai.names[h.Name] = ns
+	}
+	ns.seen++
+	if count == 0 {
+		ns.distinct++
+	}
+	count++
+	ai.fields[key] = count
+	return count, ns
+}
+
+// decide is Index, but it also reports whether an insert is only wanted if
+// no referenceable entry has the same name.  That is the case for names with
+// many different values: one value is inserted so that there is a name for
+// later values to reference, and those are sent as literals.
+func (ai *adaptiveIndexing) decide(h HeaderField) (IndexDecision, bool) {
+	count, ns := ai.observe(h)
+	if count > 1 {
+		return IndexInsert, false
+	}
+	if ns.seen < adaptiveSamples {
+		return DefaultIndexing{}.Index(h), false
+	}
+	return IndexInsert, ns.highCardinality()
+}
+
+// Index implements IndexingStrategy.
+func (ai *adaptiveIndexing) Index(h HeaderField) IndexDecision {
+	decision, _ := ai.decide(h)
+	return decision
+}
+
+// Duplicate implements IndexingStrategy.  Only acknowledged entries that have
+// been seen more than once are duplicated.
+func (ai *adaptiveIndexing) Duplicate(h HeaderField, acknowledged bool) bool {
+	return acknowledged && ai.fields[fieldKey{h.Name, h.Value}] > 1
+}
+
+// ackLag estimates how much is inserted into the table in the time it takes
+// the decoder to acknowledge an insert.  This is a moving average of the
+// number of unacknowledged bytes when acknowledgments arrive.
+type ackLag struct {
+	lag TableCapacity
+}
+
+func (al *ackLag) sample(inFlight TableCapacity) {
+	if al.lag == 0 {
+		al.lag = inFlight
+	} else {
+		al.lag = (7*al.lag + inFlight) / 8
+	}
+}
+
+// referenceableLimit leaves a margin of twice the lag at the end of the table
+// so that entries can be evicted without waiting for acknowledgments.  At
+// least half of the table is always referenceable.
+func (al *ackLag) referenceableLimit(capacity TableCapacity) TableCapacity {
+	margin := 2 * al.lag
+	if margin > capacity/2 {
+		return capacity - capacity/2
+	}
+	return capacity - margin
+}
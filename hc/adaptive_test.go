@@ -0,0 +1,132 @@
+package hc_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/martinthomson/minhq/hc"
+	"github.com/stvp/assert"
+)
+
+func TestQpackAdaptiveCardinality(t *testing.T) {
+	var updateBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 4096, 4096)
+	encoder.SetMaxBlockedStreams(100)
+	encoder.SetAdaptive(true)
+
+	writeBlock := func(id uint64, value string) {
+		updateBuf.Reset()
+		var headerBuf bytes.Buffer
+		err := encoder.WriteHeaderBlock(&headerBuf, id,
+			hc.HeaderField{Name: "name1", Value: "value1"},
+			hc.HeaderField{Name: "x-id", Value: value})
+		assert.Nil(t, err)
+		t.Logf("%v: [%x] %x", value, updateBuf.Bytes(), headerBuf.Bytes())
+	}
+
+	// Until there are enough samples, the default strategy inserts everything.
+	for i := 1; i <= 3; i++ {
+		writeBlock(uint64(i), fmt.Sprintf("id%d", i))
+		assert.NotEqual(t, 0, updateBuf.Len())
+		assert.Nil(t, encoder.AcknowledgeHeader(uint64(i)))
+	}
+	base := encoder.Table.Base()
+	assert.Equal(t, 4, base)
+
+	// Every value for x-id has been different, so a new value isn't inserted.
+	writeBlock(4, "id4")
+	assert.Equal(t, 0, updateBuf.Len())
+	assert.Equal(t, base, encoder.Table.Base())
+	assert.Nil(t, encoder.AcknowledgeHeader(4))
+
+	// A value that repeats is inserted.
+	writeBlock(5, "id4")
+	assert.NotEqual(t, 0, updateBuf.Len())
+	assert.Equal(t, base+1, encoder.Table.Base())
+}
+
+func TestQpackAdaptiveNameInsert(t *testing.T) {
+	var updateBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 4096, 4096)
+	encoder.SetMaxBlockedStreams(100)
+	encoder.SetAdaptive(true)
+
+	writeBlock := func(id uint64, value string) {
+		updateBuf.Reset()
+		var headerBuf bytes.Buffer
+		err := encoder.WriteHeaderBlock(&headerBuf, id,
+			hc.HeaderField{Name: "x-id", Value: value})
+		assert.Nil(t, err)
+	}
+
+	// Learn that x-id has many values without putting any in the table.
+	encoder.SetIndexPreference("x-id", false)
+	for i := 1; i <= 4; i++ {
+		writeBlock(uint64(i), fmt.Sprintf("id%d", i))
+		assert.Equal(t, 0, updateBuf.Len())
+	}
+	encoder.ClearIndexPreference("x-id")
+
+	// The table has no entry with this name, so one value is inserted.
+	writeBlock(5, "id5")
+	assert.NotEqual(t, 0, updateBuf.Len())
+	assert.Equal(t, 1, encoder.Table.Base())
+	assert.Nil(t, encoder.AcknowledgeHeader(5))
+
+	// Later values reference the name instead.
+	writeBlock(6, "id6")
+	assert.Equal(t, 0, updateBuf.Len())
+	assert.Equal(t, 1, encoder.Table.Base())
+}
+
+func TestQpackAdaptiveRestoreStrategy(t *testing.T) {
+	var updateBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 4096, 4096)
+	encoder.SetMaxBlockedStreams(100)
+
+	writeBlock := func() {
+		var headerBuf bytes.Buffer
+		err := encoder.WriteHeaderBlock(&headerBuf, defaultToken,
+			hc.HeaderField{Name: "name1", Value: "value1"})
+		assert.Nil(t, err)
+	}
+
+	// The strategy from before adaptive mode is used again afterwards.
+	encoder.SetIndexingStrategy(hc.StaticOnlyIndexing{})
+	encoder.SetAdaptive(true)
+	encoder.SetAdaptive(false)
+	writeBlock()
+	assert.Equal(t, 0, encoder.Table.Base())
+
+	// A strategy that is set in adaptive mode waits until adaptive mode ends.
+	encoder.SetAdaptive(true)
+	encoder.SetIndexingStrategy(nil)
+	encoder.SetAdaptive(false)
+	writeBlock()
+	assert.Equal(t, 1, encoder.Table.Base())
+}
+
+func TestQpackAdaptiveReferenceableLimit(t *testing.T) {
+	var updateBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 1000, 1000)
+	encoder.SetMaxBlockedStreams(100)
+	encoder.SetAdaptive(true)
+	assert.Equal(t, hc.TableCapacity(1000), encoder.ReferenceableLimit())
+
+	var headerBuf bytes.Buffer
+	err := encoder.WriteHeaderBlock(&headerBuf, defaultToken,
+		hc.HeaderField{Name: "name1", Value: "value1"},
+		hc.HeaderField{Name: "name2", Value: "value2"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, encoder.Table.Base())
+
+	// Two entries of 43 bytes each were waiting when the acknowledgment
+	// arrived, so the margin is twice that.
+	assert.Nil(t, encoder.AcknowledgeHeader(defaultToken))
+	assert.Equal(t, hc.TableCapacity(1000-2*2*43), encoder.ReferenceableLimit())
+
+	// Turning adaptive mode off leaves the limit alone.
+	encoder.SetAdaptive(false)
+	assert.Equal(t, hc.TableCapacity(1000-2*2*43), encoder.ReferenceableLimit())
+}
@@ -0,0 +1,172 @@
+package hc
+
+import (
+	"io"
+	"strings"
+
+	bitio "github.com/martinthomson/minhq/io"
+)
+
+// staticNames maps the names from the static tables to themselves.  Literal
+// names that match are replaced with the string from the table.
+var staticNames = makeStaticNames()
+
+func makeStaticNames() map[string]string {
+	names := make(map[string]string)
+	for _, table := range [][]staticTableEntry{hpackStaticTable, qpackStaticTable} {
+		for _, e := range table {
+			names[e.name] = e.name
+		}
+	}
+	return names
+}
+
+// blockString is a string that was decoded into a HeaderBlock.  Strings that
+// come from a table are held in s.  Literal strings are held in the arena of
+// the block between start and end.
+type blockString struct {
+	s          string
+	start, end int
+}
+
+func (bs blockString) len() int {
+	return len(bs.s) + bs.end - bs.start
+}
+
+// blockLiteral records where a literal name or value has to be put once the
+// arena is turned into a string.
+type blockLiteral struct {
+	field      int
+	name       bool
+	start, end int
+}
+
+// HeaderBlock holds the header fields from a decoded header block.  A
+// HeaderBlock can be reused for multiple header blocks, which avoids most of
+// the allocations involved in decoding.  Literal names and values share a
+// single string, and names that are in the static table are not copied.
+//
+// Fields is overwritten each time the block is reused, so any header fields
+// that need to be kept have to be copied out first.  The strings in those
+// header fields remain valid.
+type HeaderBlock struct {
+	Fields []HeaderField
+
+	size  int
+	limit int
+
+	arena    []byte
+	literals []blockLiteral
+
+	// These are reused for each header block.
+	counter countingReader
+	reader  Reader
+}
+
+// reset prepares the block for decoding and returns a Reader for r.
+func (hb *HeaderBlock) reset(r io.Reader, maxStringLength int, limit int) *Reader {
+	if hb.Fields == nil {
+		hb.Fields = []HeaderField{}
+	}
+	hb.Fields = hb.Fields[:0]
+	hb.size = 0
+	hb.limit = limit
+	hb.arena = hb.arena[:0]
+	hb.literals = hb.literals[:0]
+	hb.counter = countingReader{r: r}
+	hb.reader = Reader{
+		BitReader:       bitio.NewBitReader(&hb.counter),
+		MaxStringLength: maxStringLength,
+	}
+	return &hb.reader
+}
+
+// readName reads a name into the arena.  Names from the static table are used
+// in place of the literal.
+func (hb *HeaderBlock) readName(reader *Reader, prefix byte) (blockString, error) {
+	bs, err := hb.readValue(reader, prefix)
+	if err != nil {
+		return bs, err
+	}
+	// This lookup doesn't allocate.
+	if name, ok := staticNames[string(hb.arena[bs.start:bs.end])]; ok {
+		hb.arena = hb.arena[:bs.start]
+		return blockString{s: name}, nil
+	}
+	return bs, nil
+}
+
+// readValue reads a value into the arena.
+func (hb *HeaderBlock) readValue(reader *Reader, prefix byte) (blockString, error) {
+	start := len(hb.arena)
+	var err error
+	hb.arena, err = reader.readStringInto(prefix, hb.arena)
+	if err != nil {
+		return blockString{}, err
+	}
+	return blockString{start: start, end: len(hb.arena)}, nil
+}
+
+// stringOf returns the string, which allocates if it is in the arena.
+func (hb *HeaderBlock) stringOf(bs blockString) string {
+	if bs.end > bs.start {
+		return string(hb.arena[bs.start:bs.end])
+	}
+	return bs.s
+}
+
+// add adds a header field, enforcing the size limit.
+func (hb *HeaderBlock) add(name blockString, value blockString, sensitive bool) error {
+	hb.size += int(tableOverhead) + name.len() + value.len()
+	if hb.limit > 0 && hb.size > hb.limit {
+		return ErrHeaderBlockTooLarge
+	}
+	field := len(hb.Fields)
+	hb.Fields = append(hb.Fields, HeaderField{name.s, value.s, sensitive})
+	if name.end > name.start {
+		hb.literals = append(hb.literals, blockLiteral{field, true, name.start, name.end})
+	}
+	if value.end > value.start {
+		hb.literals = append(hb.literals, blockLiteral{field, false, value.start, value.end})
+	}
+	return nil
+}
+
+// finish fills in the literal names and values.
+func (hb *HeaderBlock) finish() {
+	if len(hb.literals) == 0 {
+		return
+	}
+	s := string(hb.arena)
+	for _, l := range hb.literals {
+		if l.name {
+			hb.Fields[l.field].Name = s[l.start:l.end]
+		} else {
+			hb.Fields[l.field].Value = s[l.start:l.end]
+		}
+	}
+}
+
+// GetHeader performs a case-insensitive lookup for a given name.  See
+// GetHeader.
+func (hb *HeaderBlock) GetHeader(name string) string {
+	return GetHeader(hb.Fields, name)
+}
+
+// GetHeader performs a case-insensitive lookup for a given name.  This returns
+// an empty string if the header field wasn't present.  Multiple values are
+// concatenated using commas, which is the only case where this allocates.
+func GetHeader(headers []HeaderField, name string) string {
+	v := ""
+	for _, h := range headers {
+		if !strings.EqualFold(h.Name, name) {
+			continue
+		}
+		if len(v) > 0 {
+			v += "," + h.Value
+		} else {
+			v = h.Value
+		}
+	}
+	return v
+}
@@ -0,0 +1,172 @@
+package hc_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/martinthomson/minhq/hc"
+	"github.com/stvp/assert"
+)
+
+// discardCloser accepts and discards acknowledgments from a decoder.
+type discardCloser struct{}
+
+func (discardCloser) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (discardCloser) Close() error {
+	return nil
+}
+
+func TestHeaderBlockReuse(t *testing.T) {
+	first := []hc.HeaderField{
+		{Name: ":status", Value: "200"},
+		{Name: "content-type", Value: "text/plain"},
+		{Name: "x-first", Value: "one"},
+	}
+	second := []hc.HeaderField{
+		{Name: ":status", Value: "404"},
+		{Name: "x-second", Value: "two"},
+	}
+
+	encoder := hc.NewHpackEncoder(0)
+	decoder := hc.NewHpackDecoder()
+	var block hc.HeaderBlock
+
+	var buf bytes.Buffer
+	err := encoder.WriteHeaderBlock(&buf, first...)
+	assert.Nil(t, err)
+	err = decoder.ReadHeaderBlockInto(&buf, &block)
+	assert.Nil(t, err)
+	assert.Equal(t, first, block.Fields)
+	kept := append([]hc.HeaderField{}, block.Fields...)
+
+	buf.Reset()
+	err = encoder.WriteHeaderBlock(&buf, second...)
+	assert.Nil(t, err)
+	err = decoder.ReadHeaderBlockInto(&buf, &block)
+	assert.Nil(t, err)
+	assert.Equal(t, second, block.Fields)
+	// Strings from the first block are unaffected.
+	assert.Equal(t, first, kept)
+
+	// An empty header block leaves no fields.
+	err = decoder.ReadHeaderBlockInto(bytes.NewReader(nil), &block)
+	assert.Nil(t, err)
+	assert.Equal(t, []hc.HeaderField{}, block.Fields)
+}
+
+func TestHeaderBlockError(t *testing.T) {
+	decoder := hc.NewQpackDecoder(discardCloser{}, 0)
+	decoder.SetMaxHeaderBlockSize(40)
+	var block hc.HeaderBlock
+	// This has a literal name and value that are too large together.
+	encoded := []byte{0x00, 0x00, 0x24, 'n', 'a', 'm', 'e', 0x05, 'v', 'a', 'l', 'u', 'e'}
+	err := decoder.ReadHeaderBlockInto(bytes.NewReader(encoded), 1, &block)
+	assert.Equal(t, hc.ErrHeaderBlockTooLarge, err)
+
+	// The block can be used again after an error.
+	decoder.SetMaxHeaderBlockSize(0)
+	err = decoder.ReadHeaderBlockInto(bytes.NewReader(encoded), 2, &block)
+	assert.Nil(t, err)
+	assert.Equal(t, []hc.HeaderField{{Name: "name", Value: "value"}}, block.Fields)
+}
+
+// Literal names that are in the static table don't need to be copied.
+func TestHeaderBlockInternNames(t *testing.T) {
+	decoder := hc.NewHpackDecoder()
+	var block hc.HeaderBlock
+	decode := func(encoded []byte) func() {
+		return func() {
+			err := decoder.ReadHeaderBlockInto(bytes.NewReader(encoded), &block)
+			assert.Nil(t, err)
+		}
+	}
+	// Literal names with empty values, one that is in the static table and one
+	// that isn't.
+	static := []byte{0x00, 0x06, 'a', 'c', 'c', 'e', 'p', 't', 0x00}
+	other := []byte{0x00, 0x06, 'x', 'c', 'c', 'e', 'p', 't', 0x00}
+	decode(static)()
+	assert.Equal(t, []hc.HeaderField{{Name: "accept", Value: ""}}, block.Fields)
+	decode(other)()
+	assert.Equal(t, []hc.HeaderField{{Name: "xccept", Value: ""}}, block.Fields)
+
+	assert.True(t, testing.AllocsPerRun(10, decode(static)) < testing.AllocsPerRun(10, decode(other)))
+}
+
+func TestGetHeader(t *testing.T) {
+	block := hc.HeaderBlock{Fields: []hc.HeaderField{
+		{Name: ":status", Value: "200"},
+		{Name: "content-type", Value: "text/plain"},
+		{Name: "cache-control", Value: "no-cache"},
+		{Name: "cache-control", Value: "no-store"},
+	}}
+	assert.Equal(t, "200", block.GetHeader(":status"))
+	assert.Equal(t, "text/plain", block.GetHeader("Content-Type"))
+	assert.Equal(t, "text/plain", block.GetHeader("CONTENT-TYPE"))
+	assert.Equal(t, "no-cache,no-store", block.GetHeader("Cache-Control"))
+	assert.Equal(t, "", block.GetHeader("content-length"))
+
+	allocs := testing.AllocsPerRun(10, func() {
+		block.GetHeader("Content-Type")
+	})
+	assert.Equal(t, 0.0, allocs)
+}
+
+// benchmarkRequest encodes a typical request for the decoding benchmarks.
+func benchmarkRequest(b *testing.B) (*hc.QpackDecoder, []byte) {
+	fields := []hc.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":authority", Value: "example.com"},
+		{Name: ":path", Value: "/index.html?q=1234"},
+		{Name: "user-agent", Value: "minhq/1.0"},
+		{Name: "accept", Value: "*/*"},
+		{Name: "accept-encoding", Value: "gzip, deflate"},
+		{Name: "cookie", Value: "session=abcdef0123456789"},
+		{Name: "x-request-id", Value: "0123456789abcdef"},
+	}
+	var updates bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updates, 4096, 4096)
+	encoder.SetMaxBlockedStreams(100)
+	var encoded bytes.Buffer
+	err := encoder.WriteHeaderBlock(&encoded, 1, fields...)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	decoder := hc.NewQpackDecoder(discardCloser{}, 4096)
+	err = decoder.ReadTableUpdates(&updates)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return decoder, encoded.Bytes()
+}
+
+func BenchmarkQpackDecode(b *testing.B) {
+	decoder, encoded := benchmarkRequest(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := decoder.ReadHeaderBlock(bytes.NewReader(encoded), uint64(i))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkQpackDecodeInto(b *testing.B) {
+	decoder, encoded := benchmarkRequest(b)
+	var block hc.HeaderBlock
+	var r bytes.Reader
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Reset(encoded)
+		err := decoder.ReadHeaderBlockInto(&r, uint64(i), &block)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
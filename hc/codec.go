@@ -11,6 +11,10 @@ import (
 // received.
 var ErrIndexError = errors.New("decoder read an invalid index")
 
+// ErrHeaderBlockTooLarge is a decoder error for when a header block is larger
+// than the limit set with SetMaxHeaderBlockSize.
+var ErrHeaderBlockTooLarge = errors.New("header block too large")
+
 // ErrPseudoHeaderOrdering indicates that a pseudo header field was placed after
 // a non-pseudo header field.
 var ErrPseudoHeaderOrdering = errors.New("invalid pseudo header field order")
@@ -35,7 +39,7 @@ func (hf HeaderField) size() TableCapacity {
 func ValidatePseudoHeaders(headers []HeaderField) error {
 	pseudo := true
 	for _, h := range headers {
-		if h.Name[0] == ':' {
+		if len(h.Name) > 0 && h.Name[0] == ':' {
 			if !pseudo {
 				return ErrPseudoHeaderOrdering
 			}
@@ -65,55 +69,127 @@ type decoderCommon struct {
 	// Table is public to provide access to its methods.
 	Table Table
 	logged
+	counters
+
+	// maxStringLength limits the length of names and values.
+	maxStringLength int
+	// maxHeaderBlockSize limits the size of decoded header blocks.
+	maxHeaderBlockSize int
+}
+
+// SetMaxStringLength limits the length of names and values that the decoder
+// accepts.  Longer strings cause ErrStringTooLong.  Zero means no limit.  Call
+// this before reading anything.
+func (decoder *decoderCommon) SetMaxStringLength(n int) {
+	decoder.maxStringLength = n
+}
+
+// SetMaxHeaderBlockSize limits the size of header blocks that the decoder
+// accepts.  The size is that of the decoded header fields, counted in the same
+// way as table entries: the length of the name and value plus 32 for each.
+// Larger header blocks cause ErrHeaderBlockTooLarge.  Zero means no limit.
+// Call this before reading anything.
+func (decoder *decoderCommon) SetMaxHeaderBlockSize(n int) {
+	decoder.maxHeaderBlockSize = n
+}
+
+// newReader makes a Reader that applies the string length limit.
+func (decoder *decoderCommon) newReader(r io.Reader) *Reader {
+	reader := NewReader(r)
+	reader.MaxStringLength = decoder.maxStringLength
+	return reader
+}
+
+// startBlock prepares a HeaderBlock for decoding from r.
+func (decoder *decoderCommon) startBlock(block *HeaderBlock, r io.Reader) *Reader {
+	return block.reset(r, decoder.maxStringLength, decoder.maxHeaderBlockSize)
+}
+
+// Stats returns statistics for the decoder.
+func (decoder *decoderCommon) Stats() Stats {
+	return decoder.snapshot(decoder.Table)
 }
 
 type encoderCommon struct {
 	// Table is public to provide access to its methods.
 	Table Table
 	logged
+	counters
 
 	// HuffmanPreference records preferences for Huffman coding of strings.
 	HuffmanPreference HuffmanCodingChoice
 
 	// This stores preferences for indexing on a per-name basis.
 	indexPrefs map[string]bool
+	// strategy decides how the table is used.
+	strategy IndexingStrategy
 }
 
-func (encoder encoderCommon) shouldIndex(h HeaderField) bool {
-	// Ignore the values here.
-	var dontIndex = map[string]bool{
-		":path":               true,
-		"content-length":      true,
-		"content-range":       true,
-		"date":                true,
-		"expires":             true,
-		"etag":                true,
-		"if-modified-since":   true,
-		"if-range":            true,
-		"if-unmodified-since": true,
-		"last-modified":       true,
-		"link":                true,
-		"range":               true,
-		"referer":             true,
-		"refresh":             true,
+// Stats returns statistics for the encoder.
+func (encoder *encoderCommon) Stats() Stats {
+	return encoder.snapshot(encoder.Table)
+}
+
+// SetIndexingStrategy sets the strategy that the encoder uses to decide how to
+// use the table.  Setting this to nil restores the default.
+func (encoder *encoderCommon) SetIndexingStrategy(strategy IndexingStrategy) {
+	encoder.strategy = strategy
+}
+
+func (encoder *encoderCommon) indexingStrategy() IndexingStrategy {
+	if encoder.strategy == nil {
+		return DefaultIndexing{}
+	}
+	return encoder.strategy
+}
+
+// indexDecision works out what to do with a header field.  Preferences set with
+// SetIndexPreference override the strategy, and nothing is inserted if it
+// can't fit in the table.
+func (encoder *encoderCommon) indexDecision(h HeaderField) IndexDecision {
+	if h.Sensitive {
+		return IndexNever
 	}
+	return encoder.overrideDecision(h, encoder.indexingStrategy().Index(h))
+}
 
-	if TableCapacity(len(h.Name)+len(h.Value)+32) > encoder.Table.Capacity() {
-		return false
+// overrideDecision applies preferences and the table capacity to what the
+// strategy decided.  Values that aren't IndexInsert or IndexNever are treated
+// as IndexLiteral.
+func (encoder *encoderCommon) overrideDecision(h HeaderField, decision IndexDecision) IndexDecision {
+	if decision == IndexNever {
+		return IndexNever
 	}
 	pref, ok := encoder.indexPrefs[h.Name]
 	if ok {
-		return pref
+		decision = IndexLiteral
+		if pref {
+			decision = IndexInsert
+		}
+	}
+	if decision != IndexInsert || h.size() > encoder.Table.Capacity() {
+		return IndexLiteral
 	}
-	_, d := dontIndex[h.Name]
-	if d {
-		return false
+	return IndexInsert
+}
+
+// sensitiveHuffmanLimit is the length below which sensitive values are never
+// Huffman coded.  The length of a Huffman-coded string depends on what it
+// contains, so an attacker that can observe lengths can use that to test
+// guesses about a short secret.
+const sensitiveHuffmanLimit = 64
+
+// valueHuffman decides whether to use Huffman coding for a value.
+func (encoder *encoderCommon) valueHuffman(h HeaderField) HuffmanCodingChoice {
+	if h.Sensitive && len(h.Value) < sensitiveHuffmanLimit {
+		return HuffmanCodingNever
 	}
-	return true
+	return encoder.HuffmanPreference
 }
 
 // SetIndexPreference sets preferences for header fields with the given name.
-// Set to true to index, false to never index.
+// Set to true to index, false to never index.  This overrides the decision of
+// the IndexingStrategy, except where the strategy picks IndexNever.
 func (encoder *encoderCommon) SetIndexPreference(name string, pref bool) {
 	encoder.logger.Printf("set indexing pref for %v to %v", name, pref)
 	if encoder.indexPrefs == nil {
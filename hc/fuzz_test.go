@@ -0,0 +1,296 @@
+//go:build go1.18
+// +build go1.18
+
+package hc_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/martinthomson/minhq/hc"
+)
+
+// qifSeedLimit limits the number of seeds taken from each QIF file.
+const qifSeedLimit = 16
+
+// qifFiles lists files from the qifs repository, if QIFDIR is set to the
+// location of a copy of that repository.  This is the same variable that
+// qif/decode-all.sh uses.
+func qifFiles(pattern string) []string {
+	dir := os.Getenv("QIFDIR")
+	if dir == "" {
+		return nil
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, pattern))
+	return files
+}
+
+// addQifEncodedSeeds adds header blocks from encoded QIF files, along with
+// everything that the encoder sent before each header block.
+func addQifEncodedSeeds(f *testing.F) {
+	for _, file := range qifFiles("encoded/qpack-03/*/*") {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var updates []byte
+		seeds := 0
+		// Each block is a 64-bit stream ID and a 32-bit length.  Stream 0 is
+		// the encoder stream.
+		for len(data) >= 12 && seeds < qifSeedLimit {
+			stream := binary.BigEndian.Uint64(data)
+			length := int(binary.BigEndian.Uint32(data[8:]))
+			data = data[12:]
+			if length > len(data) {
+				break
+			}
+			if stream == 0 {
+				updates = append(updates, data[:length]...)
+			} else {
+				f.Add(updates, data[:length])
+				seeds++
+			}
+			data = data[length:]
+		}
+	}
+}
+
+// addQifHeaderSeeds adds pairs of header fields from QIF files.
+func addQifHeaderSeeds(f *testing.F) {
+	for _, file := range qifFiles("qifs/*.qif") {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var fields []string
+		seeds := 0
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimRight(line, "\r")
+			if strings.HasPrefix(line, "#") {
+				continue
+			}
+			if line != "" {
+				fields = append(fields, line)
+			}
+			if len(fields) < 2 {
+				continue
+			}
+			n1 := strings.SplitN(fields[0], "\t", 2)
+			n2 := strings.SplitN(fields[1], "\t", 2)
+			if len(n1) == 2 && len(n2) == 2 && seeds < qifSeedLimit {
+				f.Add(n1[0], n1[1], n2[0], n2[1])
+				seeds++
+			}
+			fields = nil
+		}
+	}
+}
+
+func mustDecodeHex(f *testing.F, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		f.Fatal(err)
+	}
+	return b
+}
+
+func FuzzHpackDecoder(f *testing.F) {
+	for _, tc := range testCases {
+		f.Add(mustDecodeHex(f, tc.hpack))
+	}
+	f.Fuzz(func(t *testing.T, input []byte) {
+		decoder := hc.NewHpackDecoder()
+		decoder.SetMaxHeaderBlockSize(1 << 16)
+		_, _ = decoder.ReadHeaderBlock(bytes.NewReader(input))
+	})
+}
+
+func FuzzQpackDecoder(f *testing.F) {
+	for _, tc := range testCases {
+		f.Add(mustDecodeHex(f, tc.qpackUpdates), mustDecodeHex(f, tc.qpackHeader))
+	}
+	addQifEncodedSeeds(f)
+	f.Fuzz(func(t *testing.T, updates []byte, headerBlock []byte) {
+		decoder := hc.NewQpackDecoder(discardCloser{}, 256)
+		defer decoder.Close()
+		decoder.SetMaxHeaderBlockSize(1 << 16)
+		// Header blocks that reference entries that don't arrive need to fail.
+		decoder.SetBlockedTimeout(time.Millisecond)
+		err := decoder.ReadTableUpdates(bytes.NewReader(updates))
+		if err != nil {
+			return
+		}
+		_, _ = decoder.ReadHeaderBlock(bytes.NewReader(headerBlock), 0)
+	})
+}
+
+func FuzzHuffmanDecompressor(f *testing.F) {
+	for _, v := range tests {
+		f.Add(mustDecodeHex(f, v.encoded))
+	}
+	f.Fuzz(func(t *testing.T, input []byte) {
+		_, _ = ioutil.ReadAll(hc.NewHuffmanDecompressor(bytes.NewReader(input)))
+	})
+}
+
+func FuzzHuffmanRoundTrip(f *testing.F) {
+	for _, v := range tests {
+		f.Add([]byte(v.text))
+	}
+	f.Fuzz(func(t *testing.T, input []byte) {
+		var buf bytes.Buffer
+		compressor := hc.NewHuffmanCompressor(&buf)
+		_, err := compressor.Write(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = compressor.Pad()
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := ioutil.ReadAll(hc.NewHuffmanDecompressor(&buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(input, output) {
+			t.Fatalf("decompressed %x, expected %x", output, input)
+		}
+	})
+}
+
+func FuzzReadInt(f *testing.F) {
+	for _, tc := range encodedIntegers {
+		f.Add(mustDecodeHex(f, tc.encoded), tc.prefix)
+	}
+	f.Fuzz(func(t *testing.T, input []byte, prefix byte) {
+		prefix = prefix%8 + 1
+		reader := hc.NewReader(bytes.NewReader(input))
+		v, err := reader.ReadInt(prefix)
+		if err != nil {
+			return
+		}
+
+		// Anything that can be read can be written and read again, though the
+		// encoding might be shorter.
+		var buf bytes.Buffer
+		writer := hc.NewWriter(&buf)
+		err = writer.WriteInt(v, prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = writer.Pad(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = hc.NewReader(&buf)
+		again, err := reader.ReadInt(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again != v {
+			t.Fatalf("read %v, expected %v", again, v)
+		}
+	})
+}
+
+// fuzzHeaders makes a header list from fuzzer input.  This returns nil if the
+// header fields can't be encoded.
+func fuzzHeaders(name1, value1, name2, value2 string) []hc.HeaderField {
+	headers := []hc.HeaderField{
+		{Name: name1, Value: value1},
+		{Name: name2, Value: value2},
+	}
+	if hc.ValidatePseudoHeaders(headers) != nil {
+		return nil
+	}
+	return headers
+}
+
+func checkHeadersEqual(t *testing.T, expected []hc.HeaderField, actual []hc.HeaderField) {
+	if len(expected) != len(actual) {
+		t.Fatalf("decoded %v, expected %v", actual, expected)
+	}
+	for i := range expected {
+		if expected[i].Name != actual[i].Name || expected[i].Value != actual[i].Value {
+			t.Fatalf("decoded %v, expected %v", actual, expected)
+		}
+	}
+}
+
+func addHeaderSeeds(f *testing.F) {
+	for _, tc := range testCases {
+		if len(tc.headers) >= 2 {
+			f.Add(tc.headers[0].Name, tc.headers[0].Value,
+				tc.headers[1].Name, tc.headers[1].Value)
+		}
+	}
+	addQifHeaderSeeds(f)
+}
+
+func FuzzHpackRoundTrip(f *testing.F) {
+	addHeaderSeeds(f)
+	f.Fuzz(func(t *testing.T, name1, value1, name2, value2 string) {
+		headers := fuzzHeaders(name1, value1, name2, value2)
+		if headers == nil {
+			return
+		}
+		encoder := hc.NewHpackEncoder(256)
+		decoder := hc.NewHpackDecoder()
+		// Encode twice so that the second block uses the dynamic table.
+		for i := 0; i < 2; i++ {
+			var buf bytes.Buffer
+			err := encoder.WriteHeaderBlock(&buf, headers...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := decoder.ReadHeaderBlock(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkHeadersEqual(t, headers, decoded)
+		}
+	})
+}
+
+func FuzzQpackRoundTrip(f *testing.F) {
+	addHeaderSeeds(f)
+	f.Fuzz(func(t *testing.T, name1, value1, name2, value2 string) {
+		headers := fuzzHeaders(name1, value1, name2, value2)
+		if headers == nil {
+			return
+		}
+		var updateBuf bytes.Buffer
+		encoder := hc.NewQpackEncoder(&updateBuf, 256, 256)
+		encoder.SetMaxBlockedStreams(100)
+		decoder := hc.NewQpackDecoder(discardCloser{}, 256)
+		defer decoder.Close()
+		// The QPACK encoder makes names lowercase.
+		lowercase := make([]hc.HeaderField, len(headers))
+		for i, h := range headers {
+			lowercase[i] = hc.HeaderField{Name: strings.ToLower(h.Name), Value: h.Value}
+		}
+		for i := 0; i < 2; i++ {
+			var headerBuf bytes.Buffer
+			err := encoder.WriteHeaderBlock(&headerBuf, uint64(i), headers...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = decoder.ReadTableUpdates(&updateBuf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := decoder.ReadHeaderBlock(&headerBuf, uint64(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkHeadersEqual(t, lowercase, decoded)
+		}
+	})
+}
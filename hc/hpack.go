@@ -36,7 +36,7 @@ func (table *HpackTable) GetStatic(i int) Entry {
 	if i <= 0 || i > len(hpackStaticTable) {
 		return nil
 	}
-	return hpackStaticTable[i-1]
+	return &hpackStaticTable[i-1]
 }
 
 // Get retrieves an entry.
@@ -53,7 +53,7 @@ func (table *HpackTable) Get(i int) Entry {
 
 // Lookup finds an entry, see Table.Lookup.
 func (table *HpackTable) Lookup(name string, value string) (Entry, Entry) {
-	return table.lookupImpl(hpackStaticTable, name, value, 0, len(table.dynamic))
+	return table.lookupImpl(hpackStaticIndex, name, value, 0, table.dynamic.len())
 }
 
 // Index returns the HPACK table index for the given entry.
@@ -77,53 +77,61 @@ func NewHpackDecoder() *HpackDecoder {
 	decoder.table = new(HpackTable)
 	decoder.Table = decoder.table
 	decoder.initLogging(nil)
+	decoder.initStats()
 	return decoder
 }
 
-func (decoder *HpackDecoder) readIndexed(reader *Reader) (*HeaderField, error) {
+func (decoder *HpackDecoder) readIndexed(reader *Reader, block *HeaderBlock) error {
 	index, err := reader.ReadIndex(7)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	entry := decoder.table.Get(index)
 	if entry == nil {
-		return nil, ErrIndexError
+		return ErrIndexError
 	}
-	return &HeaderField{entry.Name(), entry.Value(), false}, nil
+	decoder.count(&decoder.stats.Indexed)
+	return block.add(blockString{s: entry.Name()}, blockString{s: entry.Value()}, false)
 }
 
-func (decoder *HpackDecoder) readNameValue(reader *Reader, prefix byte) (string, string, error) {
+func (decoder *HpackDecoder) readNameValue(reader *Reader, block *HeaderBlock, prefix byte) (blockString, blockString, error) {
 	index, err := reader.ReadIndex(prefix)
 	if err != nil {
-		return "", "", err
+		return blockString{}, blockString{}, err
 	}
-	var name string
+	var name blockString
 	if index == 0 {
-		name, err = reader.ReadString(7)
+		name, err = block.readName(reader, 7)
 		if err != nil {
-			return "", "", err
+			return blockString{}, blockString{}, err
 		}
+		decoder.count(&decoder.stats.Literals)
 	} else {
 		entry := decoder.table.Get(index)
 		if entry == nil {
-			return "", "", ErrIndexError
+			return blockString{}, blockString{}, ErrIndexError
 		}
-		name = entry.Name()
+		name = blockString{s: entry.Name()}
+		decoder.count(&decoder.stats.NameReferences)
 	}
-	value, err := reader.ReadString(7)
+	value, err := block.readValue(reader, 7)
 	if err != nil {
-		return "", "", err
+		return blockString{}, blockString{}, err
 	}
 	return name, value, nil
 }
 
-func (decoder *HpackDecoder) readIncremental(reader *Reader) (*HeaderField, error) {
-	name, value, err := decoder.readNameValue(reader, 6)
+func (decoder *HpackDecoder) readIncremental(reader *Reader, block *HeaderBlock) error {
+	nameString, valueString, err := decoder.readNameValue(reader, block, 6)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	// The table needs its own copy of these strings.
+	name := block.stringOf(nameString)
+	value := block.stringOf(valueString)
 	decoder.Table.Insert(name, value, nil)
-	return &HeaderField{name, value, false}, nil
+	decoder.count(&decoder.stats.Inserts)
+	return block.add(blockString{s: name}, blockString{s: value}, false)
 }
 
 func (decoder *HpackDecoder) readCapacity(reader *Reader) error {
@@ -135,87 +143,90 @@ func (decoder *HpackDecoder) readCapacity(reader *Reader) error {
 	return nil
 }
 
-func (decoder *HpackDecoder) readLiteral(reader *Reader) (*HeaderField, error) {
+func (decoder *HpackDecoder) readLiteral(reader *Reader, block *HeaderBlock) error {
 	ni, err := reader.ReadBit()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	name, value, err := decoder.readNameValue(reader, 4)
+	name, value, err := decoder.readNameValue(reader, block, 4)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return &HeaderField{name, value, ni == 1}, nil
+	return block.add(name, value, ni == 1)
 }
 
 // ReadHeaderBlock decodes header fields as they arrive.
 func (decoder *HpackDecoder) ReadHeaderBlock(r io.Reader) ([]HeaderField, error) {
-	reader := NewReader(r)
-	headers := []HeaderField{}
+	var block HeaderBlock
+	err := decoder.ReadHeaderBlockInto(r, &block)
+	if err != nil {
+		return nil, err
+	}
+	return block.Fields, nil
+}
+
+// ReadHeaderBlockInto decodes header fields into the given block.  Reusing the
+// same block avoids most of the allocations that ReadHeaderBlock makes.
+func (decoder *HpackDecoder) ReadHeaderBlockInto(r io.Reader, block *HeaderBlock) error {
+	reader := decoder.startBlock(block, r)
 	for {
 		b, err := reader.ReadBit()
 		if err == io.EOF {
 			break // Success!
 		}
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		if b == 1 {
-			h, err := decoder.readIndexed(reader)
+			err = decoder.readIndexed(reader, block)
 			if err != nil {
-				return nil, err
+				return err
 			}
-			headers = append(headers, *h)
 			continue
 		}
 
 		b, err = reader.ReadBit()
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		if b == 1 {
-			h, err := decoder.readIncremental(reader)
+			err = decoder.readIncremental(reader, block)
 			if err != nil {
-				return nil, err
+				return err
 			}
-			headers = append(headers, *h)
 			continue
 		}
 
 		b, err = reader.ReadBit()
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		if b == 1 {
 			err := decoder.readCapacity(reader)
 			if err != nil {
-				return nil, err
+				return err
 			}
 			continue
 		}
 
-		h, err := decoder.readLiteral(reader)
+		err = decoder.readLiteral(reader, block)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		headers = append(headers, *h)
 	}
+	block.finish()
 
 	// Sanity-check header ordering.
-	pseudo := true
-	for _, h := range headers {
-		if h.Name[0] == ':' {
-			if !pseudo {
-				return nil, ErrPseudoHeaderOrdering
-			}
-		} else {
-			pseudo = false
-		}
+	err := ValidatePseudoHeaders(block.Fields)
+	if err != nil {
+		return err
 	}
-	return headers, nil
+	decoder.countBlock(block.Fields, block.counter.n)
+	return nil
 }
 
 // HpackEncoder is the top-level class for header compression.
@@ -234,6 +245,7 @@ func NewHpackEncoder(capacity TableCapacity) *HpackEncoder {
 	encoder.Table = encoder.table
 	encoder.SetCapacity(capacity)
 	encoder.initLogging(nil)
+	encoder.initStats()
 	return encoder
 }
 
@@ -273,6 +285,7 @@ func (encoder *HpackEncoder) writeIndexed(writer *Writer, entry Entry) error {
 	if err != nil {
 		return err
 	}
+	encoder.count(&encoder.stats.Indexed)
 	return writer.WriteInt(uint64(encoder.Table.Index(entry)), 7)
 }
 
@@ -283,6 +296,9 @@ func (encoder *HpackEncoder) writeNameValue(writer *Writer, h HeaderField,
 	nameIndex := uint64(0)
 	if nameEntry != nil {
 		nameIndex = uint64(encoder.Table.Index(nameEntry))
+		encoder.count(&encoder.stats.NameReferences)
+	} else {
+		encoder.count(&encoder.stats.Literals)
 	}
 	err := writer.WriteInt(nameIndex, prefix)
 	if err != nil {
@@ -295,7 +311,7 @@ func (encoder *HpackEncoder) writeNameValue(writer *Writer, h HeaderField,
 		}
 	}
 
-	return writer.WriteStringRaw(h.Value, 7, encoder.HuffmanPreference)
+	return writer.WriteStringRaw(h.Value, 7, encoder.valueHuffman(h))
 }
 
 func (encoder *HpackEncoder) writeIncremental(writer *Writer, h HeaderField, nameEntry Entry) error {
@@ -309,6 +325,7 @@ func (encoder *HpackEncoder) writeIncremental(writer *Writer, h HeaderField, nam
 		return err
 	}
 	encoder.Table.Insert(h.Name, h.Value, nil)
+	encoder.count(&encoder.stats.Inserts)
 	return nil
 }
 
@@ -327,31 +344,34 @@ func (encoder HpackEncoder) writeLiteral(writer *Writer, h HeaderField, nameEntr
 
 // WriteHeaderBlock writes out a header block.
 func (encoder *HpackEncoder) WriteHeaderBlock(w io.Writer, headers ...HeaderField) error {
-	writer := NewWriter(w)
+	cw := &countingWriter{w: w}
+	writer := NewWriter(cw)
 	err := encoder.writeCapacityChange(writer)
 	if err != nil {
 		return err
 	}
 	pseudo := true
 	for _, h := range headers {
-		if h.Name[0] == ':' {
+		if len(h.Name) > 0 && h.Name[0] == ':' {
 			if !pseudo {
 				return ErrPseudoHeaderOrdering
 			}
 		} else {
 			pseudo = false
 		}
-		if h.Sensitive {
+		decision := encoder.indexDecision(h)
+		if decision == IndexNever {
 			// It's not clear here whether the name is sensitive, but let's assume that
 			// it might be. It's not exactly rational to put secrets in header field
 			// names (how do you find them again?), but it's safer not to assume rational
 			// behaviour.
+			h.Sensitive = true
 			err = encoder.writeLiteral(writer, h, nil)
 		} else {
 			m, nm := encoder.Table.Lookup(h.Name, h.Value)
 			if m != nil {
 				err = encoder.writeIndexed(writer, m)
-			} else if encoder.shouldIndex(h) {
+			} else if decision == IndexInsert {
 				err = encoder.writeIncremental(writer, h, nm)
 			} else {
 				err = encoder.writeLiteral(writer, h, nm)
@@ -361,6 +381,7 @@ func (encoder *HpackEncoder) WriteHeaderBlock(w io.Writer, headers ...HeaderFiel
 			return err
 		}
 	}
+	encoder.countBlock(headers, cw.n)
 	return nil
 }
 
@@ -3,6 +3,7 @@ package hc_test
 import (
 	"bytes"
 	"encoding/hex"
+	"strings"
 	"testing"
 
 	"github.com/martinthomson/minhq/hc"
@@ -66,6 +67,23 @@ func TestHpackEncoderPseudoHeaderOrder(t *testing.T) {
 	assert.Equal(t, hc.ErrPseudoHeaderOrdering, err)
 }
 
+// An empty name used to cause the encoder to panic.
+func TestHpackEmptyName(t *testing.T) {
+	encoder := hc.NewHpackEncoder(256)
+	var buf bytes.Buffer
+	err := encoder.WriteHeaderBlock(&buf,
+		hc.HeaderField{Name: "", Value: "307"},
+		hc.HeaderField{Name: "regular", Value: "1"})
+	assert.Nil(t, err)
+
+	decoder := hc.NewHpackDecoder()
+	headers, err := decoder.ReadHeaderBlock(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(headers))
+	assert.Equal(t, "", headers[0].Name)
+	assert.Equal(t, "307", headers[0].Value)
+}
+
 func resetDecoderCapacity(t *testing.T, decoder *hc.HpackDecoder) {
 	t.Log("Reset decoder table")
 	reader := bytes.NewReader([]byte{0x20, 0x3f, 0xe1, 0x01})
@@ -127,3 +145,37 @@ func TestHpackEviction(t *testing.T) {
 	assert.Equal(t, headers, h)
 	checkDynamicTable(t, decoder.Table, dynamicTable)
 }
+
+func TestHpackSensitive(t *testing.T) {
+	encoder := hc.NewHpackEncoder(256)
+	encoder.HuffmanPreference = hc.HuffmanCodingAlways
+	var buf bytes.Buffer
+	long := strings.Repeat("secret", 11)
+	err := encoder.WriteHeaderBlock(&buf,
+		hc.HeaderField{Name: "authorization", Value: "secret", Sensitive: true},
+		hc.HeaderField{Name: "cookie", Value: long, Sensitive: true})
+	assert.Nil(t, err)
+	checkDynamicTable(t, encoder.Table, &[]dynamicTableEntry{})
+	// Short sensitive values aren't Huffman coded; longer values are.
+	assert.True(t, bytes.Contains(buf.Bytes(), []byte("secret")))
+	assert.False(t, bytes.Contains(buf.Bytes(), []byte(long)))
+
+	decoder := hc.NewHpackDecoder()
+	headers, err := decoder.ReadHeaderBlock(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(headers))
+	assert.True(t, headers[0].Sensitive)
+	assert.True(t, headers[1].Sensitive)
+
+	// Passing the decoded header fields on to another encoder keeps them out
+	// of the table.
+	proxy := hc.NewHpackEncoder(256)
+	buf.Reset()
+	err = proxy.WriteHeaderBlock(&buf, headers...)
+	assert.Nil(t, err)
+	checkDynamicTable(t, proxy.Table, &[]dynamicTableEntry{})
+	headers, err = hc.NewHpackDecoder().ReadHeaderBlock(&buf)
+	assert.Nil(t, err)
+	assert.True(t, headers[0].Sensitive)
+	assert.True(t, headers[1].Sensitive)
+}
@@ -3,118 +3,254 @@ package hc
 import (
 	"errors"
 	"io"
-
-	bitio "github.com/martinthomson/minhq/io"
+	"sync"
 )
 
+// ErrInvalidHuffman is returned when Huffman-coded data can't be decoded.
+// This includes padding that is longer than 7 bits or padding that isn't all
+// ones.
+var ErrInvalidHuffman = errors.New("invalid Huffman coding")
+
+// HuffmanEncodedLength returns the number of octets that Huffman coding of s
+// produces, including padding.
+func HuffmanEncodedLength(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanTable[s[i]].len)
+	}
+	return (bits + 7) / 8
+}
+
+// huffmanAppend Huffman codes s and appends the result to dst.  saved holds
+// savedBits bits that are left over from a previous call.  The bits that don't
+// fill an octet are returned.
+func huffmanAppend(dst []byte, s []byte, saved uint64, savedBits byte) ([]byte, uint64, byte) {
+	for _, c := range s {
+		e := huffmanTable[c]
+		// There are never more than 7 saved bits, and codes are no longer than
+		// 30 bits, so this can't overflow.
+		saved = (saved << e.len) | uint64(e.val)
+		savedBits += e.len
+		for savedBits >= 8 {
+			savedBits -= 8
+			dst = append(dst, byte(saved>>savedBits))
+		}
+	}
+	return dst, saved, savedBits
+}
+
+// huffmanPad returns the last octet of Huffman-coded data, which is filled
+// with the high bits of EOS.
+func huffmanPad(saved uint64, savedBits byte) byte {
+	return byte(saved<<(8-savedBits)) | (0xff >> savedBits)
+}
+
 // HuffmanCompressor is a progressive compressor for Huffman-encoded data.
 type HuffmanCompressor struct {
-	writer    bitio.BitWriter
-	saved     byte
+	writer    io.Writer
+	saved     uint64
 	savedBits byte
+	buf       []byte
 }
 
 // NewHuffmanCompressor wraps the underlying io.Writer.
 func NewHuffmanCompressor(writer io.Writer) *HuffmanCompressor {
-	return &HuffmanCompressor{bitio.NewBitWriter(writer), 0, 0}
+	return &HuffmanCompressor{writer: writer}
 }
 
 // Add compresses a string using the Huffman table.  Strings are provided as byte slices.
 func (compressor *HuffmanCompressor) Write(input []byte) (int, error) {
-	for i, c := range input {
-		entry := huffmanTable[c]
-		err := compressor.writer.WriteBits(uint64(entry.val), entry.len)
-		if err != nil {
-			return i, err
-		}
+	compressor.buf, compressor.saved, compressor.savedBits = huffmanAppend(
+		compressor.buf[:0], input, compressor.saved, compressor.savedBits)
+	_, err := compressor.writer.Write(compressor.buf)
+	if err != nil {
+		return 0, err
 	}
 	return len(input), nil
 }
 
 // Pad adds a terminator value and returns the full compressed value.
 func (compressor *HuffmanCompressor) Pad() error {
-	return compressor.writer.Pad(0xff)
+	if compressor.savedBits == 0 {
+		return nil
+	}
+	last := [1]byte{huffmanPad(compressor.saved, compressor.savedBits)}
+	compressor.saved = 0
+	compressor.savedBits = 0
+	_, err := compressor.writer.Write(last[:])
+	return err
 }
 
-// This is a huffmanDecoderNode in the reverse mapping tree.  We use 4-bit chunks because those result in at most a single emission of a character.
-type huffmanDecoderNode struct {
-	next [2]*huffmanDecoderNode
-	leaf bool
-	val  byte
+// The decoder is a state machine that consumes 4 bits at a time.  Each state is
+// an internal node of the Huffman tree, which has 256 internal nodes.  A
+// transition from each state for each of the 16 possible nibbles leads to
+// another state and emits at most one symbol, because no code is shorter than
+// 5 bits.
+const (
+	// huffmanEmit is set if the transition emits a symbol.
+	huffmanEmit = 1 << iota
+	// huffmanAccept is set if the input can end after this transition.  That
+	// is when the bits after the last symbol are all ones and there are fewer
+	// than 8 of them.
+	huffmanAccept
+	// huffmanFail is set if the transition reaches EOS or an unused code.
+	huffmanFail
+)
+
+type huffmanTransition struct {
+	next  byte
+	sym   byte
+	flags byte
 }
 
-func makeLayer(prefix uint32, prefixLen byte) *huffmanDecoderNode {
-	layer := new(huffmanDecoderNode)
-	found := false
-	for i, e := range huffmanTable {
-		if e.len < prefixLen+1 {
-			continue
-		}
-		if (e.val >> (e.len - prefixLen)) != prefix {
-			continue
-		}
-		arity := (e.val >> (e.len - prefixLen - 1)) & 1
-		var child *huffmanDecoderNode
-		if e.len == prefixLen+1 {
-			child = new(huffmanDecoderNode)
-			child.leaf = true
-			child.val = byte(i)
-			layer.next[arity] = child
-			if layer.next[arity^1] != nil {
-				return layer
+var huffmanDecodeTable [256][16]huffmanTransition
+var huffmanDecodeTableOnce sync.Once
+
+// huffmanTreeNode is used to build huffmanDecodeTable.
+type huffmanTreeNode struct {
+	next [2]int // The index of the next node, or -1 - symbol for leaves.
+	// depth is the number of bits since the root of the tree.  allOnes is
+	// true if all of those bits are set.
+	depth   int
+	allOnes bool
+}
+
+const huffmanNoNode = 1 << 16
+
+func buildHuffmanTree() []huffmanTreeNode {
+	tree := []huffmanTreeNode{{next: [2]int{huffmanNoNode, huffmanNoNode}, allOnes: true}}
+	for sym, e := range huffmanTable {
+		node := 0
+		for i := int(e.len) - 1; i >= 0; i-- {
+			bit := (e.val >> uint(i)) & 1
+			if i == 0 {
+				tree[node].next[bit] = -1 - sym
+				break
 			}
-		}
-		found = true
-	}
-	// There are unused parts of the tree, so leave the branches as nil if we reach those
-	if found {
-		if layer.next[0] == nil {
-			layer.next[0] = makeLayer(prefix<<1, prefixLen+1)
-		}
-		if layer.next[1] == nil {
-			layer.next[1] = makeLayer((prefix<<1)|1, prefixLen+1)
+			if tree[node].next[bit] == huffmanNoNode {
+				tree = append(tree, huffmanTreeNode{
+					next:    [2]int{huffmanNoNode, huffmanNoNode},
+					depth:   tree[node].depth + 1,
+					allOnes: tree[node].allOnes && bit == 1,
+				})
+				tree[node].next[bit] = len(tree) - 1
+			}
+			node = tree[node].next[bit]
 		}
 	}
-	return layer
+	return tree
 }
 
-var decompressorTree *huffmanDecoderNode
-
-func initDecompressorTree() {
-	if decompressorTree == nil {
-		decompressorTree = makeLayer(0, 0)
+func initHuffmanDecodeTable() {
+	tree := buildHuffmanTree()
+	for state := range tree {
+		for nibble := 0; nibble < 16; nibble++ {
+			t := &huffmanDecodeTable[state][nibble]
+			node := state
+			for i := 3; i >= 0; i-- {
+				next := tree[node].next[(nibble>>uint(i))&1]
+				if next == huffmanNoNode {
+					t.flags = huffmanFail
+					break
+				}
+				if next < 0 {
+					t.sym = byte(-1 - next)
+					t.flags |= huffmanEmit
+					next = 0
+				}
+				node = next
+			}
+			if t.flags&huffmanFail != 0 {
+				continue
+			}
+			t.next = byte(node)
+			if tree[node].allOnes && tree[node].depth < 8 {
+				t.flags |= huffmanAccept
+			}
+		}
 	}
 }
 
 // HuffmanDecompressor is the opposite of huffmanCompressor
 type HuffmanDecompressor struct {
-	reader bitio.BitReader
-	cursor *huffmanDecoderNode
+	reader io.Reader
+	state  byte
+	accept bool
+	// pending holds a symbol that didn't fit in the output.
+	pending    byte
+	hasPending bool
+	buf        [64]byte
 }
 
 // NewHuffmanDecompressor makes a new decompressor, which implements io.Reader.
 func NewHuffmanDecompressor(reader io.Reader) *HuffmanDecompressor {
-	initDecompressorTree()
-	return &HuffmanDecompressor{bitio.NewBitReader(reader), decompressorTree}
+	decompressor := new(HuffmanDecompressor)
+	decompressor.reset(reader)
+	return decompressor
+}
+
+// reset prepares the decompressor to read a new string.
+func (decompressor *HuffmanDecompressor) reset(reader io.Reader) {
+	huffmanDecodeTableOnce.Do(initHuffmanDecodeTable)
+	decompressor.reader = reader
+	decompressor.state = 0
+	decompressor.accept = true
+	decompressor.hasPending = false
+}
+
+// decodeNibble runs the state machine for one nibble.  This returns true if a
+// symbol was emitted.
+func (decompressor *HuffmanDecompressor) decodeNibble(nibble byte) (byte, bool, error) {
+	t := &huffmanDecodeTable[decompressor.state][nibble]
+	if t.flags&huffmanFail != 0 {
+		return 0, false, ErrInvalidHuffman
+	}
+	decompressor.state = t.next
+	decompressor.accept = t.flags&huffmanAccept != 0
+	return t.sym, t.flags&huffmanEmit != 0, nil
 }
 
 // Read bytes of input and decode.
 func (decompressor *HuffmanDecompressor) Read(p []byte) (int, error) {
 	i := 0
+	if decompressor.hasPending && len(p) > 0 {
+		p[0] = decompressor.pending
+		decompressor.hasPending = false
+		i++
+	}
 	for i < len(p) {
-		b, err := decompressor.reader.ReadBit()
-		if err != nil {
-			return i, err
+		// Each octet produces at most two symbols.  Only read as much as is
+		// needed to fill p so that at most one symbol is left over.
+		want := (len(p) - i) / 2
+		if want < 1 {
+			want = 1
+		} else if want > len(decompressor.buf) {
+			want = len(decompressor.buf)
 		}
-
-		decompressor.cursor = decompressor.cursor.next[b]
-		if decompressor.cursor == nil {
-			return i, errors.New("invalid Huffman coding")
+		n, err := decompressor.reader.Read(decompressor.buf[:want])
+		for _, b := range decompressor.buf[:n] {
+			for _, nibble := range [2]byte{b >> 4, b & 0xf} {
+				sym, emit, err := decompressor.decodeNibble(nibble)
+				if err != nil {
+					return i, err
+				}
+				if !emit {
+					continue
+				}
+				if i < len(p) {
+					p[i] = sym
+					i++
+				} else {
+					decompressor.pending = sym
+					decompressor.hasPending = true
+				}
+			}
+		}
+		if err == io.EOF && !decompressor.accept {
+			return i, ErrInvalidHuffman
 		}
-		if decompressor.cursor.leaf {
-			p[i] = decompressor.cursor.val
-			i++
-			decompressor.cursor = decompressorTree
+		if err != nil {
+			return i, err
 		}
 	}
 	return i, nil
@@ -0,0 +1,219 @@
+package hc
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	bitio "github.com/martinthomson/minhq/io"
+)
+
+// This file has the original Huffman coder, which works a bit at a time.  It is
+// used to check the table-driven coder, and for comparing performance.
+
+type bitwiseDecoderNode struct {
+	next [2]*bitwiseDecoderNode
+	leaf bool
+	val  byte
+}
+
+func makeBitwiseLayer(prefix uint32, prefixLen byte) *bitwiseDecoderNode {
+	layer := new(bitwiseDecoderNode)
+	found := false
+	for i, e := range huffmanTable {
+		if e.len < prefixLen+1 {
+			continue
+		}
+		if (e.val >> (e.len - prefixLen)) != prefix {
+			continue
+		}
+		arity := (e.val >> (e.len - prefixLen - 1)) & 1
+		if e.len == prefixLen+1 {
+			child := new(bitwiseDecoderNode)
+			child.leaf = true
+			child.val = byte(i)
+			layer.next[arity] = child
+			if layer.next[arity^1] != nil {
+				return layer
+			}
+		}
+		found = true
+	}
+	if found {
+		if layer.next[0] == nil {
+			layer.next[0] = makeBitwiseLayer(prefix<<1, prefixLen+1)
+		}
+		if layer.next[1] == nil {
+			layer.next[1] = makeBitwiseLayer((prefix<<1)|1, prefixLen+1)
+		}
+	}
+	return layer
+}
+
+var bitwiseTree = makeBitwiseLayer(0, 0)
+
+type bitwiseDecompressor struct {
+	reader bitio.BitReader
+	cursor *bitwiseDecoderNode
+}
+
+func (decompressor *bitwiseDecompressor) Read(p []byte) (int, error) {
+	i := 0
+	for i < len(p) {
+		b, err := decompressor.reader.ReadBit()
+		if err != nil {
+			return i, err
+		}
+		decompressor.cursor = decompressor.cursor.next[b]
+		if decompressor.cursor == nil {
+			return i, ErrInvalidHuffman
+		}
+		if decompressor.cursor.leaf {
+			p[i] = decompressor.cursor.val
+			i++
+			decompressor.cursor = bitwiseTree
+		}
+	}
+	return i, nil
+}
+
+func bitwiseCompress(w io.Writer, input []byte) error {
+	writer := bitio.NewBitWriter(w)
+	for _, c := range input {
+		entry := huffmanTable[c]
+		err := writer.WriteBits(uint64(entry.val), entry.len)
+		if err != nil {
+			return err
+		}
+	}
+	return writer.Pad(0xff)
+}
+
+// huffmanSamples makes header field values with a mix of characters.
+func huffmanSamples() [][]byte {
+	r := rand.New(rand.NewSource(1))
+	const chars = "abcdefghijklmnopqrstuvwxyz0123456789-_=;/.:, ABCXYZ\x00\xff"
+	samples := make([][]byte, 64)
+	for i := range samples {
+		s := make([]byte, 1+r.Intn(100))
+		for j := range s {
+			s[j] = chars[r.Intn(len(chars))]
+		}
+		samples[i] = s
+	}
+	return samples
+}
+
+func TestHuffmanMatchesBitwise(t *testing.T) {
+	for _, s := range huffmanSamples() {
+		var expected bytes.Buffer
+		err := bitwiseCompress(&expected, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var actual bytes.Buffer
+		compressor := NewHuffmanCompressor(&actual)
+		_, err = compressor.Write(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = compressor.Pad()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(expected.Bytes(), actual.Bytes()) {
+			t.Fatalf("encoding %q: got %x, expected %x", s, actual.Bytes(), expected.Bytes())
+		}
+		if HuffmanEncodedLength(string(s)) != actual.Len() {
+			t.Fatalf("length of %q: got %v, expected %v",
+				s, HuffmanEncodedLength(string(s)), actual.Len())
+		}
+
+		decoded, err := ioutil.ReadAll(NewHuffmanDecompressor(&actual))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(s, decoded) {
+			t.Fatalf("decoded %q, expected %q", decoded, s)
+		}
+	}
+}
+
+func compressSamples(b *testing.B) [][]byte {
+	var encoded [][]byte
+	for _, s := range huffmanSamples() {
+		var buf bytes.Buffer
+		err := bitwiseCompress(&buf, s)
+		if err != nil {
+			b.Fatal(err)
+		}
+		encoded = append(encoded, buf.Bytes())
+	}
+	return encoded
+}
+
+func BenchmarkHuffmanDecodeBitwise(b *testing.B) {
+	encoded := compressSamples(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, e := range encoded {
+			d := &bitwiseDecompressor{bitio.NewBitReader(bytes.NewReader(e)), bitwiseTree}
+			_, _ = ioutil.ReadAll(d)
+		}
+	}
+}
+
+func BenchmarkHuffmanDecodeTable(b *testing.B) {
+	encoded := compressSamples(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, e := range encoded {
+			_, _ = ioutil.ReadAll(NewHuffmanDecompressor(bytes.NewReader(e)))
+		}
+	}
+}
+
+func BenchmarkHuffmanEncodeBitwise(b *testing.B) {
+	samples := huffmanSamples()
+	var buf bytes.Buffer
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, s := range samples {
+			buf.Reset()
+			_ = bitwiseCompress(&buf, s)
+		}
+	}
+}
+
+func BenchmarkHuffmanEncodeTable(b *testing.B) {
+	samples := huffmanSamples()
+	var buf bytes.Buffer
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, s := range samples {
+			buf.Reset()
+			compressor := NewHuffmanCompressor(&buf)
+			_, _ = compressor.Write(s)
+			_ = compressor.Pad()
+		}
+	}
+}
+
+func BenchmarkWriteStringRaw(b *testing.B) {
+	var samples []string
+	for _, s := range huffmanSamples() {
+		samples = append(samples, string(s))
+	}
+	var buf bytes.Buffer
+	writer := NewWriter(&buf)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, s := range samples {
+			buf.Reset()
+			_ = writer.WriteStringRaw(s, 7, HuffmanCodingAuto)
+		}
+	}
+}
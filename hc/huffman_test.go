@@ -3,6 +3,8 @@ package hc_test
 import (
 	"bytes"
 	"encoding/hex"
+	"io"
+	"io/ioutil"
 	"testing"
 
 	"github.com/martinthomson/minhq/hc"
@@ -59,3 +61,46 @@ func TestHuffmanDecompress(t *testing.T) {
 		assert.Equal(t, decompressed[0:n], []byte(v.text))
 	}
 }
+
+func TestHuffmanEncodedLength(t *testing.T) {
+	for _, v := range tests {
+		assert.Equal(t, len(v.encoded)/2, hc.HuffmanEncodedLength(v.text))
+	}
+	assert.Equal(t, 0, hc.HuffmanEncodedLength(""))
+}
+
+func TestHuffmanDecompressInvalid(t *testing.T) {
+	for _, encoded := range []string{
+		// EOS can't appear in the input.
+		"ffffffff",
+		// Padding is longer than 7 bits.
+		"f1e3c2e5f23a6ba0ab90f4ffff",
+		// Padding isn't all ones.
+		"18",
+	} {
+		compressed, err := hex.DecodeString(encoded)
+		assert.Nil(t, err)
+		decompressor := hc.NewHuffmanDecompressor(bytes.NewReader(compressed))
+		_, err = ioutil.ReadAll(decompressor)
+		assert.Equal(t, hc.ErrInvalidHuffman, err)
+	}
+}
+
+func TestHuffmanDecompressSmallReads(t *testing.T) {
+	for _, v := range tests {
+		compressed, err := hex.DecodeString(v.encoded)
+		assert.Nil(t, err)
+		decompressor := hc.NewHuffmanDecompressor(bytes.NewReader(compressed))
+		var out []byte
+		var p [1]byte
+		for {
+			n, err := decompressor.Read(p[:])
+			out = append(out, p[:n]...)
+			if err == io.EOF {
+				break
+			}
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, v.text, string(out))
+	}
+}
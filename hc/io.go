@@ -1,7 +1,6 @@
 package hc
 
 import (
-	"bytes"
 	"errors"
 	"io"
 
@@ -11,14 +10,24 @@ import (
 // ErrIntegerOverflow is used to signal integer overflow.
 var ErrIntegerOverflow = errors.New("integer overflow")
 
+// ErrStringTooLong is used when a string is longer than Reader.MaxStringLength.
+var ErrStringTooLong = errors.New("string too long")
+
 // Reader wraps BitReader with more methods
 type Reader struct {
 	bitio.BitReader
+	// MaxStringLength limits the length of strings that ReadString reads, both
+	// before and after Huffman decoding.  Zero means no limit.
+	MaxStringLength int
+
+	// These are reused for each string.
+	limited io.LimitedReader
+	huffman HuffmanDecompressor
 }
 
 // NewReader wraps the reader with HPACK-specific reading functions.
 func NewReader(reader io.Reader) *Reader {
-	return &Reader{bitio.NewBitReader(reader)}
+	return &Reader{BitReader: bitio.NewBitReader(reader)}
 }
 
 // ReadInt reads an HPACK integer with the specified prefix length.
@@ -67,33 +76,87 @@ func (hr *Reader) ReadIndex(prefix byte) (int, error) {
 	return int(offset), nil
 }
 
+// maxPreallocate is the longest string that ReadString allocates space for
+// before reading.  Longer strings need to arrive before space is allocated.
+const maxPreallocate = 4096
+
 // ReadString reads an HPACK-encoded string.  prefix is the size of the length
 // prefix, which does not include the Huffman bit that precedes it.  (All uses of
-// this in HPACK have a 7-bit prefix.)
+// this in HPACK have a 7-bit prefix.)  A string that is cut short is an error.
 func (hr *Reader) ReadString(prefix byte) (string, error) {
+	buf, err := hr.readStringInto(prefix, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// growBytes ensures that there is space for at least n more bytes in b.
+func growBytes(b []byte, n int) []byte {
+	if cap(b)-len(b) >= n {
+		return b
+	}
+	grown := make([]byte, len(b), 2*cap(b)+n)
+	copy(grown, b)
+	return grown
+}
+
+// readStringInto reads a string like ReadString, except that the string is
+// appended to dst.
+func (hr *Reader) readStringInto(prefix byte, dst []byte) ([]byte, error) {
 	huffman, err := hr.ReadBit()
 	if err != nil {
-		return "", nil
+		return dst, err
 	}
-	len, err := hr.ReadInt(prefix)
+	length, err := hr.ReadInt(prefix)
 	if err != nil {
-		return "", nil
+		return dst, err
 	}
-	var valueReader io.Reader = &io.LimitedReader{R: hr, N: int64(len)}
-	var buf []byte
-	if huffman != 0 {
-		valueReader = NewHuffmanDecompressor(valueReader)
-		// Allocate enough for maximum HPACK expansion.
-		buf = make([]byte, len*8/5+1)
-	} else {
-		buf = make([]byte, len)
+	if hr.MaxStringLength > 0 && length > uint64(hr.MaxStringLength) {
+		return dst, ErrStringTooLong
+	}
+	if length > uint64(int64(^uint64(0)>>1)) {
+		return dst, ErrIntegerOverflow
 	}
 
-	n, err := io.ReadFull(valueReader, buf)
-	if err != nil && err != io.ErrUnexpectedEOF {
-		return "", err
+	hr.limited = io.LimitedReader{R: hr.BitReader, N: int64(length)}
+	var r io.Reader = &hr.limited
+	// Huffman coding uses at least 5 bits for each octet.
+	expected := length
+	if huffman != 0 {
+		hr.huffman.reset(&hr.limited)
+		r = &hr.huffman
+		expected = length * 8 / 5
+	}
+	if expected > maxPreallocate {
+		expected = maxPreallocate
+	}
+	start := len(dst)
+	dst = growBytes(dst, int(expected)+1)
+	for {
+		if len(dst) == cap(dst) {
+			dst = growBytes(dst, maxPreallocate)
+		}
+		n, err := r.Read(dst[len(dst):cap(dst)])
+		dst = dst[:len(dst)+n]
+		if hr.MaxStringLength > 0 && len(dst)-start > hr.MaxStringLength {
+			return dst, ErrStringTooLong
+		}
+		if err == io.EOF {
+			break
+		}
+		if err == ErrInvalidHuffman && hr.limited.N > 0 {
+			// The padding is bad because the string was truncated.
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return dst, err
+		}
+	}
+	if hr.limited.N > 0 {
+		return dst, io.ErrUnexpectedEOF
 	}
-	return string(buf[0:n]), nil
+	return dst, nil
 }
 
 // Writer wraps BitWriter with more methods specific to HPACK.
@@ -151,30 +214,13 @@ const (
 
 // WriteStringRaw writes out the specified string.
 func (hw *Writer) WriteStringRaw(s string, prefix byte, huffman HuffmanCodingChoice) error {
-	var reader io.Reader = bytes.NewReader([]byte(s))
 	l := len(s)
 	hbit := byte(0)
 	if huffman != HuffmanCodingNever {
-		var buf bytes.Buffer
-		compressor := NewHuffmanCompressor(&buf)
-		n, err := io.Copy(compressor, reader)
-		if err != nil {
-			return err
-		}
-		if n < int64(l) {
-			return io.ErrShortWrite
-		}
-		err = compressor.Pad()
-		if err != nil {
-			return err
-		}
-
-		if (huffman == HuffmanCodingAlways) || (buf.Len() < l) {
-			reader = &buf
-			l = buf.Len()
+		hl := HuffmanEncodedLength(s)
+		if (huffman == HuffmanCodingAlways) || (hl < l) {
+			l = hl
 			hbit = 1
-		} else {
-			reader = bytes.NewReader([]byte(s))
 		}
 	}
 
@@ -186,11 +232,23 @@ func (hw *Writer) WriteStringRaw(s string, prefix byte, huffman HuffmanCodingCho
 	if err != nil {
 		return err
 	}
-	n, err := io.Copy(hw, reader)
+	var p []byte
+	if hbit == 1 {
+		var scratch [64]byte
+		var saved uint64
+		var savedBits byte
+		p, saved, savedBits = huffmanAppend(scratch[:0], []byte(s), saved, savedBits)
+		if savedBits > 0 {
+			p = append(p, huffmanPad(saved, savedBits))
+		}
+	} else {
+		p = []byte(s)
+	}
+	n, err := hw.Write(p)
 	if err != nil {
 		return err
 	}
-	if n < int64(l) {
+	if n < l {
 		return io.ErrShortWrite
 	}
 	return nil
@@ -3,6 +3,7 @@ package hc_test
 import (
 	"bytes"
 	"encoding/hex"
+	"io"
 	"testing"
 
 	"github.com/martinthomson/minhq/hc"
@@ -98,6 +99,48 @@ func TestReadString(t *testing.T) {
 	}
 }
 
+func TestReadStringLimit(t *testing.T) {
+	for _, tc := range encodedStrings {
+		encoded, err := hex.DecodeString(tc.encoded)
+		assert.Nil(t, err)
+		reader := hc.NewReader(bytes.NewReader(encoded))
+		reader.MaxStringLength = len(tc.value)
+		s, err := reader.ReadString(7)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.value, s)
+
+		// Zero means no limit, so a limit of 0 can't be tested.
+		if len(tc.value) > 1 {
+			reader = hc.NewReader(bytes.NewReader(encoded))
+			reader.MaxStringLength = len(tc.value) - 1
+			_, err = reader.ReadString(7)
+			assert.Equal(t, hc.ErrStringTooLong, err)
+		}
+	}
+}
+
+func TestReadStringTruncated(t *testing.T) {
+	for _, tc := range encodedStrings {
+		encoded, err := hex.DecodeString(tc.encoded)
+		assert.Nil(t, err)
+		reader := hc.NewReader(bytes.NewReader(encoded[:len(encoded)-1]))
+		_, err = reader.ReadString(7)
+		assert.Equal(t, io.ErrUnexpectedEOF, err)
+	}
+
+	// A huge length doesn't cause a huge allocation.
+	encoded, err := hex.DecodeString("7f80808080800131")
+	assert.Nil(t, err)
+	reader := hc.NewReader(bytes.NewReader(encoded))
+	_, err = reader.ReadString(7)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	// Errors reading the length are reported.
+	reader = hc.NewReader(bytes.NewReader([]byte{0x7f}))
+	_, err = reader.ReadString(7)
+	assert.Equal(t, io.EOF, err)
+}
+
 func TestWriteString(t *testing.T) {
 	for _, tc := range encodedStrings {
 		expected, err := hex.DecodeString(tc.encoded)
@@ -16,9 +16,11 @@ var logbuf bytes.Buffer
 func usage() {
 	msg := "Usage: %s <cmd> [args]\n\n" +
 		"Encode from a QIF file:\n" +
-		"    ... encode [-a] [-b blocked] [-t cap] [-r cap] [-v] [in [out]]\n\n" +
+		"    ... encode [-a] [-b blocked] [-t cap] [-r cap] [-s strategy] [-v] [in [out]]\n\n" +
 		"    -a    Treat every block as immediately acknowledged\n" +
 		"    -b    Set the number of blocked streams\n" +
+		"    -s    Set the indexing strategy:\n" +
+		"          default, static, aggressive, frequency, or adaptive\n" +
 		"    -t    Set the capacity of the table\n" +
 		"    -r    Set the referenceable capacity (must be after -t)\n" +
 		"    -v    Verbose logging\n\n" +
@@ -26,7 +28,10 @@ func usage() {
 		"    ... decode [-a] [-t cap] [-v] [in [out]]\n" +
 		"    -a    Enable asynchronous decoding\n" +
 		"    -t    Set the capacity of the table\n" +
-		"    -v    Verbose logging\n\n"
+		"    -v    Verbose logging\n\n" +
+		"Report on compression for QIF files:\n" +
+		"    ... report [-a] [-b blocked] [-t cap] [-r cap] [-s strategy] [-v] in...\n" +
+		"    Options are the same as for encode\n\n"
 	fmt.Fprintf(os.Stderr, msg, os.Args[0])
 	os.Exit(2)
 }
@@ -43,38 +48,84 @@ func check(err error) {
 	}
 }
 
-func encode(args []string) {
-	logger := log.New(&devnull, "", log.Lmicroseconds|log.Lshortfile)
+// encoderOptions are the options shared by the encode and report commands.
+type encoderOptions struct {
+	logger        *log.Logger
+	ack           bool
+	capacity      hc.TableCapacity
+	referenceable hc.TableCapacity
+	maxBlocked    int
+	strategy      hc.IndexingStrategy
+	adaptive      bool
+}
 
-	ack := false
-	capacity := hc.TableCapacity(4096)
-	referenceable := hc.TableCapacity(4096)
-	maxBlocked := 0
+func setStrategy(opts *encoderOptions, name string) {
+	switch name {
+	case "default":
+		opts.strategy = hc.DefaultIndexing{}
+	case "static":
+		opts.strategy = hc.StaticOnlyIndexing{}
+	case "aggressive":
+		opts.strategy = hc.AggressiveIndexing{}
+	case "frequency":
+		opts.strategy = hc.NewFrequencyIndexing(0, 0)
+	case "adaptive":
+		opts.adaptive = true
+	default:
+		check(fmt.Errorf("unknown indexing strategy: %v", name))
+	}
+}
+
+// parseEncoderOptions reads options from the start of args, and returns the
+// remaining arguments.
+func parseEncoderOptions(args []string) (*encoderOptions, []string) {
+	opts := &encoderOptions{
+		logger:        log.New(&devnull, "", log.Lmicroseconds|log.Lshortfile),
+		capacity:      hc.TableCapacity(4096),
+		referenceable: hc.TableCapacity(4096),
+	}
 	for len(args) > 1 && args[0][0:1] == "-" {
 		if args[0] == "-a" {
-			ack = true
+			opts.ack = true
 			args = args[1:]
 		} else if args[0] == "-v" {
-			logger = log.New(os.Stderr, "", log.Lmicroseconds|log.Lshortfile)
+			opts.logger = log.New(os.Stderr, "", log.Lmicroseconds|log.Lshortfile)
 			args = args[1:]
 		} else if len(args) >= 2 && args[0] == "-b" {
 			sz, err := strconv.Atoi(args[1])
 			check(err)
-			maxBlocked = sz
+			opts.maxBlocked = sz
 			args = args[2:]
 		} else if len(args) >= 2 && args[0] == "-t" {
 			sz, err := strconv.Atoi(args[1])
 			check(err)
-			capacity = hc.TableCapacity(sz)
-			referenceable = capacity
+			opts.capacity = hc.TableCapacity(sz)
+			opts.referenceable = opts.capacity
 			args = args[2:]
 		} else if len(args) >= 2 && args[0] == "-r" {
 			sz, err := strconv.Atoi(args[1])
 			check(err)
-			referenceable = hc.TableCapacity(sz)
+			opts.referenceable = hc.TableCapacity(sz)
+			args = args[2:]
+		} else if len(args) >= 2 && args[0] == "-s" {
+			setStrategy(opts, args[1])
 			args = args[2:]
 		}
 	}
+	return opts, args
+}
+
+// configure applies the options to an encoder.
+func (opts *encoderOptions) configure(qpack *hc.QpackEncoder) {
+	check(qpack.SetMaxCapacity(opts.capacity))
+	qpack.SetReferenceableLimit(opts.referenceable)
+	qpack.SetMaxBlockedStreams(opts.maxBlocked)
+	qpack.SetIndexingStrategy(opts.strategy)
+	qpack.SetAdaptive(opts.adaptive)
+}
+
+func encode(args []string) {
+	opts, args := parseEncoderOptions(args)
 
 	var enc *encoder
 	switch len(args) {
@@ -86,11 +137,26 @@ func encode(args []string) {
 		enc = newEncoder(args[0], args[1])
 	}
 	defer enc.Close()
-	enc.acknowledge = ack
-	enc.qpack.SetCapacity(capacity)
-	enc.qpack.SetReferenceableLimit(referenceable)
-	enc.qpack.SetMaxBlockedStreams(maxBlocked)
-	enc.Encode(logger)
+	enc.acknowledge = opts.ack
+	opts.configure(enc.qpack)
+	enc.Encode(opts.logger)
+}
+
+func report(args []string) {
+	opts, args := parseEncoderOptions(args)
+	if len(args) == 0 {
+		usage()
+	}
+	var total compressionReport
+	fmt.Println(reportHeading)
+	for _, name := range args {
+		r := reportFile(name, opts)
+		fmt.Println(r.String(name))
+		total.add(r)
+	}
+	if len(args) > 1 {
+		fmt.Println(total.String("total"))
+	}
 }
 
 func decode(args []string) {
@@ -122,7 +188,7 @@ func decode(args []string) {
 		dec = newDecoder(args[0], args[1])
 	}
 	defer dec.Close()
-	dec.qpack.Table.SetCapacity(capacity)
+	dec.qpack.SetCapacity(capacity)
 	if async {
 		dec.DecodeAsync(logger)
 	} else {
@@ -142,6 +208,9 @@ func main() {
 	case "decode":
 		decode(os.Args[2:])
 
+	case "report":
+		report(os.Args[2:])
+
 	default:
 		usage()
 	}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/martinthomson/minhq/hc"
+)
+
+const reportHeading = "file                     blocks      plain     header    encoder   ratio"
+
+// compressionReport summarizes how well a QIF file compresses.
+type compressionReport struct {
+	blocks  int
+	plain   int
+	header  int
+	encoder int
+}
+
+func (r *compressionReport) add(other *compressionReport) {
+	r.blocks += other.blocks
+	r.plain += other.plain
+	r.header += other.header
+	r.encoder += other.encoder
+}
+
+// ratio is the size of everything the encoder produced relative to the size
+// of the names and values.
+func (r *compressionReport) ratio() float64 {
+	if r.plain == 0 {
+		return 0
+	}
+	return float64(r.header+r.encoder) / float64(r.plain)
+}
+
+func (r *compressionReport) String(name string) string {
+	return fmt.Sprintf("%-24s %7d %10d %10d %10d  %6.3f",
+		name, r.blocks, r.plain, r.header, r.encoder, r.ratio())
+}
+
+// reportFile encodes a QIF file and counts the bytes that are produced.
+func reportFile(name string, opts *encoderOptions) *compressionReport {
+	f, err := os.Open(name)
+	check(err)
+	defer f.Close()
+
+	var updates bytes.Buffer
+	qpack := hc.NewQpackEncoder(&updates, 4096, 3072)
+	qpack.SetLogger(opts.logger)
+	opts.configure(qpack)
+
+	r := &compressionReport{}
+	inserts := 0
+	input := NewReader(bufio.NewReader(f))
+	for {
+		block, err := input.ReadHeaderBlock()
+		if err == io.EOF {
+			break
+		}
+		check(err)
+
+		r.blocks++
+		for _, h := range block {
+			r.plain += len(h.Name) + len(h.Value)
+		}
+		var headerBlock bytes.Buffer
+		id := uint64(r.blocks)
+		check(qpack.WriteHeaderBlock(&headerBlock, id, block...))
+		r.header += headerBlock.Len()
+		if opts.ack {
+			// The decoder acknowledges the inserts as well as the header block.
+			// Blocks that don't use the table aren't acknowledged.
+			if qpack.Table.Base() > inserts {
+				check(qpack.AcknowledgeInsert(qpack.Table.Base() - inserts))
+				inserts = qpack.Table.Base()
+			}
+			_ = qpack.AcknowledgeHeader(id)
+		}
+	}
+	r.encoder = updates.Len()
+	return r
+}
@@ -3,7 +3,9 @@ package hc_test
 import (
 	"bytes"
 	"encoding/hex"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"sync"
 	"testing"
 	"time"
@@ -851,3 +853,282 @@ func TestDecoderLargestReferenceOverflow(t *testing.T) {
 		hc.HeaderField{Name: "name5", Value: "value5"},
 	}, headers)
 }
+
+// TestQpackCapacityShrink reduces the capacity while entries are in use.  The
+// change waits until they can be evicted.
+func TestQpackCapacityShrink(t *testing.T) {
+	var updateBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 200, 200)
+	setupEncoder(t, encoder, &updateBuf)
+
+	// Both entries are used by an unacknowledged header block.
+	assert.Nil(t, encoder.SetCapacity(50))
+	assert.Equal(t, 0, updateBuf.Len())
+	assert.Equal(t, hc.TableCapacity(200), encoder.Table.Capacity())
+
+	// Until the capacity changes, the dynamic table isn't used.
+	var headerBuf bytes.Buffer
+	err := encoder.WriteHeaderBlock(&headerBuf, defaultToken,
+		hc.HeaderField{Name: "name1", Value: "value1"},
+		hc.HeaderField{Name: "name3", Value: "value3"})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, updateBuf.Len())
+	assert.Equal(t, []byte{0x00, 0x00}, headerBuf.Bytes()[:2])
+
+	// Acknowledging the header block allows the oldest entry to be evicted.
+	assert.Nil(t, encoder.AcknowledgeHeader(setupToken))
+	checkExpectedUpdates(t, &updateBuf, "3f13")
+	assert.Equal(t, hc.TableCapacity(50), encoder.Table.Capacity())
+	checkDynamicTable(t, encoder.Table, &[]dynamicTableEntry{
+		{"name2", "value2"},
+	})
+
+	// Growing happens straight away.
+	updateBuf.Reset()
+	assert.Nil(t, encoder.SetCapacity(200))
+	checkExpectedUpdates(t, &updateBuf, "3fa901")
+	assert.Equal(t, hc.TableCapacity(200), encoder.Table.Capacity())
+
+	// Now the table can be used again.
+	updateBuf.Reset()
+	headerBuf.Reset()
+	err = encoder.WriteHeaderBlock(&headerBuf, defaultToken+1,
+		hc.HeaderField{Name: "name2", Value: "value2"})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x03, 0x00, 0x80}, headerBuf.Bytes())
+	assert.Nil(t, encoder.AcknowledgeHeader(defaultToken+1))
+
+	// A decoder that has seen all of the updates so far.
+	decoder := hc.NewQpackDecoder(newAckChecker(t), 200)
+	defer decoder.Close()
+	decoder.SetBlockedTimeout(time.Second)
+	updates, err := hex.DecodeString("64a874943f85ee3a2d287f64a874945f85ee3a2d28bf3f133fa901")
+	assert.Nil(t, err)
+	assert.Nil(t, decoder.ReadTableUpdates(bytes.NewReader(updates)))
+
+	// Shrink again, then keep inserting until the table has wrapped past
+	// twice the number of entries that the peer allows.  Both sides have to
+	// encode the largest reference using the peer's maximum, not the current
+	// capacity, or the decoder waits for an entry that never arrives.
+	updateBuf.Reset()
+	assert.Nil(t, encoder.SetCapacity(100))
+	assert.Equal(t, hc.TableCapacity(100), encoder.Table.Capacity())
+	maxEntries := 200 / 32
+	for i := 0; encoder.Table.Base() <= 2*maxEntries+2; i++ {
+		token := defaultToken + 2 + uint64(i)
+		field := hc.HeaderField{Name: fmt.Sprintf("shrunk%d", i), Value: "value"}
+		headerBuf.Reset()
+		err = encoder.WriteHeaderBlock(&headerBuf, token, field)
+		assert.Nil(t, err)
+		assert.Nil(t, decoder.ReadTableUpdates(bytes.NewReader(updateBuf.Bytes())))
+		updateBuf.Reset()
+
+		headers, err := decoder.ReadHeaderBlock(bytes.NewReader(headerBuf.Bytes()), token)
+		assert.Nil(t, err)
+		assert.Equal(t, []hc.HeaderField{field}, headers)
+		assert.Nil(t, encoder.AcknowledgeHeader(token))
+	}
+	assert.Equal(t, hc.TableCapacity(100), decoder.Table.Capacity())
+
+	// The capacity can't exceed what the peer allows.
+	assert.Equal(t, hc.ErrTableOverflow, encoder.SetCapacity(201))
+	assert.Equal(t, hc.ErrMaxCapacityFixed, encoder.SetMaxCapacity(300))
+}
+
+// TestQpackCapacityShrinkUnacknowledged checks that entries the decoder hasn't
+// acknowledged aren't evicted.
+func TestQpackCapacityShrinkUnacknowledged(t *testing.T) {
+	var updateBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 200, 200)
+	setupEncoder(t, encoder, &updateBuf)
+	assert.Nil(t, encoder.AcknowledgeHeader(setupToken))
+
+	var headerBuf bytes.Buffer
+	err := encoder.WriteHeaderBlock(&headerBuf, defaultToken,
+		hc.HeaderField{Name: "name3", Value: "value3"})
+	assert.Nil(t, err)
+	assert.Nil(t, encoder.AcknowledgeHeader(defaultToken))
+	updateBuf.Reset()
+
+	// name3 has been acknowledged, so everything can go.
+	assert.Nil(t, encoder.SetCapacity(0))
+	checkExpectedUpdates(t, &updateBuf, "20")
+	checkDynamicTable(t, encoder.Table, &[]dynamicTableEntry{})
+}
+
+func TestQpackDecoderCapacityUpdate(t *testing.T) {
+	ackChecker := newAckChecker(t)
+	decoder := hc.NewQpackDecoder(ackChecker, 200)
+	defer decoder.Close()
+
+	updates, err := hex.DecodeString("64a874943f85ee3a2d287f64a874945f85ee3a2d28bf3f13")
+	assert.Nil(t, err)
+	err = decoder.ReadTableUpdates(bytes.NewReader(updates))
+	assert.Nil(t, err)
+	assert.Equal(t, hc.TableCapacity(50), decoder.Table.Capacity())
+	checkDynamicTable(t, decoder.Table, &[]dynamicTableEntry{
+		{"name2", "value2"},
+	})
+
+	updates, err = hex.DecodeString("3fa901")
+	assert.Nil(t, err)
+	err = decoder.ReadTableUpdates(bytes.NewReader(updates))
+	assert.Nil(t, err)
+	assert.Equal(t, hc.TableCapacity(200), decoder.Table.Capacity())
+
+	// More than the decoder allows.
+	updates, err = hex.DecodeString("3f8d02")
+	assert.Nil(t, err)
+	err = decoder.ReadTableUpdates(bytes.NewReader(updates))
+	assert.Equal(t, hc.ErrTableOverflow, err)
+}
+
+// writeBlockingHeaderBlock makes a header block that references two entries
+// that the decoder doesn't have yet.
+func writeBlockingHeaderBlock(t *testing.T) (*bytes.Buffer, []byte) {
+	var updateBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 200, 200)
+	encoder.SetMaxBlockedStreams(100)
+	var headerBuf bytes.Buffer
+	err := encoder.WriteHeaderBlock(&headerBuf, defaultToken,
+		hc.HeaderField{Name: "name1", Value: "value1"},
+		hc.HeaderField{Name: "name2", Value: "value2"})
+	assert.Nil(t, err)
+	return &updateBuf, headerBuf.Bytes()
+}
+
+func TestQpackDecoderMaxBlockedStreams(t *testing.T) {
+	updates, headerBlock := writeBlockingHeaderBlock(t)
+	ackChecker := newAckChecker(t)
+	decoder := hc.NewQpackDecoder(ackChecker, 200)
+	defer decoder.Close()
+	decoder.SetMaxBlockedStreams(1)
+
+	done := make(chan struct{})
+	go func() {
+		_, err := decoder.ReadHeaderBlock(bytes.NewReader(headerBlock), 1)
+		assert.Nil(t, err)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// The first header block is blocked, so the second can't block.
+	_, err := decoder.ReadHeaderBlock(bytes.NewReader(headerBlock), 2)
+	assert.Equal(t, hc.ErrTooManyBlockedStreams, err)
+
+	assert.Nil(t, decoder.ReadTableUpdates(updates))
+	<-done
+}
+
+func TestQpackDecoderBlockedTimeout(t *testing.T) {
+	_, headerBlock := writeBlockingHeaderBlock(t)
+	ackChecker := newAckChecker(t)
+	decoder := hc.NewQpackDecoder(ackChecker, 200)
+	defer decoder.Close()
+	decoder.SetBlockedTimeout(10 * time.Millisecond)
+
+	_, err := decoder.ReadHeaderBlock(bytes.NewReader(headerBlock), 1)
+	assert.Equal(t, hc.ErrBlockedTimeout, err)
+	assert.Equal(t, uint64(1), decoder.Stats().BlockedStreams)
+}
+
+func TestQpackDecoderMaxHeaderBlockSize(t *testing.T) {
+	var updateBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 0, 0)
+	var headerBuf bytes.Buffer
+	err := encoder.WriteHeaderBlock(&headerBuf, defaultToken,
+		hc.HeaderField{Name: "name1", Value: "value1"},
+		hc.HeaderField{Name: "name2", Value: "value2"})
+	assert.Nil(t, err)
+
+	ackChecker := newAckChecker(t)
+	decoder := hc.NewQpackDecoder(ackChecker, 0)
+	defer decoder.Close()
+	decoder.SetMaxHeaderBlockSize(2 * 43)
+	headers, err := decoder.ReadHeaderBlock(bytes.NewReader(headerBuf.Bytes()), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(headers))
+
+	decoder.SetMaxHeaderBlockSize(2*43 - 1)
+	_, err = decoder.ReadHeaderBlock(bytes.NewReader(headerBuf.Bytes()), 2)
+	assert.Equal(t, hc.ErrHeaderBlockTooLarge, err)
+
+	decoder.SetMaxHeaderBlockSize(0)
+	decoder.SetMaxStringLength(5)
+	_, err = decoder.ReadHeaderBlock(bytes.NewReader(headerBuf.Bytes()), 3)
+	assert.Equal(t, hc.ErrStringTooLong, err)
+}
+
+func TestQpackDecoderInvalidLargestReference(t *testing.T) {
+	ackChecker := newAckChecker(t)
+	decoder := hc.NewQpackDecoder(ackChecker, 0)
+	defer decoder.Close()
+
+	// There can't be a largest reference without a dynamic table.
+	_, err := decoder.ReadHeaderBlock(bytes.NewReader([]byte{0x01, 0x00, 0xc0}), 1)
+	assert.Equal(t, hc.ErrIndexError, err)
+
+	// A base that is less than zero is invalid.  After two inserts, a largest
+	// reference of 2 (encoded as 3) with a delta of -5 produces a base of -3.
+	updates, _ := writeBlockingHeaderBlock(t)
+	decoder = hc.NewQpackDecoder(newAckChecker(t), 200)
+	defer decoder.Close()
+	assert.Nil(t, decoder.ReadTableUpdates(updates))
+	_, err = decoder.ReadHeaderBlock(bytes.NewReader([]byte{0x03, 0x85, 0x80}), 2)
+	assert.Equal(t, hc.ErrIndexError, err)
+}
+
+func TestQpackSensitive(t *testing.T) {
+	var updateBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 256, 256)
+	encoder.SetMaxBlockedStreams(100)
+	encoder.HuffmanPreference = hc.HuffmanCodingAlways
+	var headerBuf bytes.Buffer
+	err := encoder.WriteHeaderBlock(&headerBuf, defaultToken,
+		hc.HeaderField{Name: "authorization", Value: "secret", Sensitive: true},
+		hc.HeaderField{Name: "x-secret", Value: "secret", Sensitive: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, updateBuf.Len())
+	assert.True(t, bytes.Contains(headerBuf.Bytes(), []byte("secret")))
+
+	decoder := hc.NewQpackDecoder(newAckChecker(t), 256)
+	defer decoder.Close()
+	headers, err := decoder.ReadHeaderBlock(&headerBuf, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(headers))
+	assert.True(t, headers[0].Sensitive)
+	assert.True(t, headers[1].Sensitive)
+
+	// A proxy that passes these on doesn't add them to its table.
+	var proxyUpdates bytes.Buffer
+	proxy := hc.NewQpackEncoder(&proxyUpdates, 256, 256)
+	proxy.SetMaxBlockedStreams(100)
+	proxy.SetIndexingStrategy(hc.AggressiveIndexing{})
+	headerBuf.Reset()
+	err = proxy.WriteHeaderBlock(&headerBuf, defaultToken, headers...)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, proxyUpdates.Len())
+}
+
+// The encoder lowercases names and marks some fields as sensitive, but it
+// doesn't change the header fields that it is given.
+func TestQpackEncoderKeepsHeaders(t *testing.T) {
+	headers := []hc.HeaderField{
+		{Name: "Content-Type", Value: "text/plain"},
+		{Name: "cookie", Value: "1"},
+	}
+	original := append([]hc.HeaderField{}, headers...)
+
+	encoder := hc.NewQpackEncoder(ioutil.Discard, 256, 256)
+	encoder.SetIndexingStrategy(neverIndexCookies{})
+	var buf bytes.Buffer
+	err := encoder.WriteHeaderBlock(&buf, 1, headers...)
+	assert.Nil(t, err)
+	assert.Equal(t, original, headers)
+
+	decoder := hc.NewQpackDecoder(discardCloser{}, 256)
+	decoded, err := decoder.ReadHeaderBlock(&buf, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "content-type", decoded[0].Name)
+	assert.True(t, decoded[1].Sensitive)
+}
@@ -3,6 +3,7 @@ package hc
 import (
 	"errors"
 	"io"
+	"sync"
 	"time"
 )
 
@@ -10,6 +11,15 @@ import (
 // Unlike HPACK, QPACK doesn't allow this.
 var ErrTableOverflow = errors.New("inserting entry that is too large for the table")
 
+// ErrTooManyBlockedStreams is raised when a header block would block while the
+// maximum number of header blocks are already blocked.  The encoder has
+// exceeded the limit that was advertised, so this is a connection error.
+var ErrTooManyBlockedStreams = errors.New("too many blocked streams")
+
+// ErrBlockedTimeout is raised when a header block waits for table updates for
+// longer than the time set with SetBlockedTimeout.
+var ErrBlockedTimeout = errors.New("timed out waiting for table updates")
+
 type headerBlockAck struct {
 	id               uint64
 	largestReference int
@@ -26,6 +36,18 @@ type QpackDecoder struct {
 	cancelled    chan<- uint64
 	available    chan<- int
 	ackDelay     time.Duration
+	// maxCapacity is the largest capacity that the encoder can use.  This is
+	// used to decode the largest reference.
+	maxCapacity TableCapacity
+
+	// blockedLock protects blockedStreams.
+	blockedLock sync.Mutex
+	// blockedStreams is the number of header blocks that are waiting.
+	blockedStreams int
+	// maxBlockedStreams is the number of header blocks that can wait.
+	maxBlockedStreams int
+	// blockedTimeout limits how long a header block can wait.
+	blockedTimeout time.Duration
 }
 
 // NewQpackDecoder makes and sets up a QpackDecoder.
@@ -33,6 +55,9 @@ func NewQpackDecoder(aw io.WriteCloser, capacity TableCapacity) *QpackDecoder {
 	decoder := new(QpackDecoder)
 	decoder.table = NewQpackDecoderTable(capacity)
 	decoder.Table = decoder.table
+	decoder.maxCapacity = capacity
+	decoder.maxBlockedStreams = intMax
+	decoder.initStats()
 	available := make(chan int)
 	decoder.available = available
 	acknowledged := make(chan *headerBlockAck)
@@ -133,6 +158,7 @@ func (decoder *QpackDecoder) readValueAndInsert(reader *Reader, name string) err
 	}
 	added := decoder.Table.Insert(name, value, nil)
 	decoder.logger.Printf("inserted %v = %v @ %v", name, value, added.Base())
+	decoder.count(&decoder.stats.Inserts)
 	decoder.available <- added.Base()
 	return nil
 }
@@ -178,6 +204,7 @@ func (decoder *QpackDecoder) readDuplicate(reader *Reader, base int) error {
 		return ErrIndexError
 	}
 	added := decoder.table.Insert(entry.Name(), entry.Value(), nil)
+	decoder.count(&decoder.stats.Duplicates)
 	decoder.available <- added.Base()
 	return nil
 }
@@ -188,14 +215,84 @@ func (decoder *QpackDecoder) readDynamicUpdate(reader *Reader) error {
 		return err
 	}
 	decoder.logger.Printf("update capacity %v", capacity)
+	if TableCapacity(capacity) > decoder.maxCapacity {
+		return ErrTableOverflow
+	}
 	decoder.Table.SetCapacity(TableCapacity(capacity))
 	return nil
 }
 
+// SetCapacity sets the largest capacity that the encoder can use, which is
+// what this advertises to its peer.  The table starts with this capacity.  Call
+// this before reading anything.
+func (decoder *QpackDecoder) SetCapacity(capacity TableCapacity) {
+	decoder.maxCapacity = capacity
+	decoder.Table.SetCapacity(capacity)
+}
+
+// SetMaxBlockedStreams sets the number of header blocks that can wait for table
+// updates at the same time.  This should match what is advertised to the
+// encoder.  If a header block would block when this many are already blocked,
+// ReadHeaderBlock fails with ErrTooManyBlockedStreams.  By default, there is no
+// limit.
+func (decoder *QpackDecoder) SetMaxBlockedStreams(n int) {
+	defer decoder.blockedLock.Unlock()
+	decoder.blockedLock.Lock()
+	decoder.maxBlockedStreams = n
+}
+
+// SetBlockedTimeout limits how long a header block can wait for table updates.
+// ReadHeaderBlock fails with ErrBlockedTimeout when this expires.  Zero, the
+// default, means that there is no limit.
+func (decoder *QpackDecoder) SetBlockedTimeout(timeout time.Duration) {
+	defer decoder.blockedLock.Unlock()
+	decoder.blockedLock.Lock()
+	decoder.blockedTimeout = timeout
+}
+
+// startBlocking records a header block that is waiting.  It returns the
+// timeout to use for waiting.
+func (decoder *QpackDecoder) startBlocking() (time.Duration, error) {
+	defer decoder.blockedLock.Unlock()
+	decoder.blockedLock.Lock()
+	if decoder.blockedStreams >= decoder.maxBlockedStreams {
+		return 0, ErrTooManyBlockedStreams
+	}
+	decoder.blockedStreams++
+	return decoder.blockedTimeout, nil
+}
+
+func (decoder *QpackDecoder) stopBlocking() {
+	defer decoder.blockedLock.Unlock()
+	decoder.blockedLock.Lock()
+	decoder.blockedStreams--
+}
+
+// waitForEntry waits for the table to include the given base.  This enforces
+// the limits on blocking.
+func (decoder *QpackDecoder) waitForEntry(largestBase int) error {
+	if decoder.table.Base() >= largestBase {
+		return nil
+	}
+	timeout, err := decoder.startBlocking()
+	if err != nil {
+		return err
+	}
+	defer decoder.stopBlocking()
+	start := time.Now()
+	err = decoder.table.waitForEntry(largestBase, timeout)
+	decoder.countBlocked(time.Since(start))
+	return err
+}
+
 // ReadTableUpdates reads a single block of table updates.  If you use ServiceUpdates,
 // this function should need to be used at all.
 func (decoder *QpackDecoder) ReadTableUpdates(r io.Reader) error {
-	reader := NewReader(r)
+	reader := decoder.newReader(r)
+	// Nothing longer than the table can be inserted.
+	if reader.MaxStringLength == 0 || reader.MaxStringLength > int(decoder.maxCapacity) {
+		reader.MaxStringLength = int(decoder.maxCapacity)
+	}
 
 	for {
 		base := decoder.Table.Base()
@@ -241,14 +338,14 @@ func (decoder *QpackDecoder) ReadTableUpdates(r io.Reader) error {
 	return nil
 }
 
-func (decoder *QpackDecoder) readIndexed(reader *Reader, base int) (*HeaderField, error) {
+func (decoder *QpackDecoder) readIndexed(reader *Reader, block *HeaderBlock, base int) error {
 	static, err := reader.ReadBit()
 	if err != nil {
-		return nil, err
+		return err
 	}
 	index, err := reader.ReadIndex(6)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	decoder.logger.Printf("indexed (static=%v) %v", static == 1, index)
 	var entry Entry
@@ -258,37 +355,39 @@ func (decoder *QpackDecoder) readIndexed(reader *Reader, base int) (*HeaderField
 		entry = decoder.Table.GetDynamic(index, base)
 	}
 	if entry == nil {
-		return nil, ErrIndexError
+		return ErrIndexError
 	}
-	return &HeaderField{entry.Name(), entry.Value(), false}, nil
+	decoder.count(&decoder.stats.Indexed)
+	return block.add(blockString{s: entry.Name()}, blockString{s: entry.Value()}, false)
 }
 
-func (decoder *QpackDecoder) readPostBaseIndexed(reader *Reader, base int) (*HeaderField, error) {
+func (decoder *QpackDecoder) readPostBaseIndexed(reader *Reader, block *HeaderBlock, base int) error {
 	postBase, err := reader.ReadIndex(4)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	decoder.logger.Printf("post-base indexed %v", postBase)
 	entry := decoder.Table.GetDynamic(-1-postBase, base)
 	if entry == nil {
-		return nil, ErrIndexError
+		return ErrIndexError
 	}
 	decoder.logger.Printf("entry %v", entry)
-	return &HeaderField{entry.Name(), entry.Value(), false}, nil
+	decoder.count(&decoder.stats.Indexed)
+	return block.add(blockString{s: entry.Name()}, blockString{s: entry.Value()}, false)
 }
 
-func (decoder *QpackDecoder) readLiteralWithNameReference(reader *Reader, base int) (*HeaderField, error) {
+func (decoder *QpackDecoder) readLiteralWithNameReference(reader *Reader, block *HeaderBlock, base int) error {
 	neverIndex, err := reader.ReadBit()
 	if err != nil {
-		return nil, err
+		return err
 	}
 	static, err := reader.ReadBit()
 	if err != nil {
-		return nil, err
+		return err
 	}
 	nameIndex, err := reader.ReadIndex(4)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	decoder.logger.Printf("literal name ref (sensitive=%v, static=%v) %v",
 		neverIndex == 1, static == 1, nameIndex)
@@ -299,63 +398,69 @@ func (decoder *QpackDecoder) readLiteralWithNameReference(reader *Reader, base i
 		nameEntry = decoder.Table.GetDynamic(nameIndex, base)
 	}
 	if nameEntry == nil {
-		return nil, ErrIndexError
+		return ErrIndexError
 	}
 
-	value, err := reader.ReadString(7)
+	value, err := block.readValue(reader, 7)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return &HeaderField{nameEntry.Name(), value, neverIndex == 1}, nil
+	decoder.count(&decoder.stats.NameReferences)
+	return block.add(blockString{s: nameEntry.Name()}, value, neverIndex == 1)
 }
 
-func (decoder *QpackDecoder) readLiteralWithPostBaseNameReference(reader *Reader, base int) (*HeaderField, error) {
+func (decoder *QpackDecoder) readLiteralWithPostBaseNameReference(reader *Reader, block *HeaderBlock, base int) error {
 	neverIndex, err := reader.ReadBit()
 	if err != nil {
-		return nil, err
+		return err
 	}
 	postBase, err := reader.ReadIndex(3)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	decoder.logger.Printf("literal name ref (sensitive=%v) %v",
 		neverIndex == 1, postBase)
 	nameEntry := decoder.Table.GetDynamic(-1*postBase, base)
 	if nameEntry == nil {
-		return nil, ErrIndexError
+		return ErrIndexError
 	}
 
-	value, err := reader.ReadString(7)
+	value, err := block.readValue(reader, 7)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return &HeaderField{nameEntry.Name(), value, neverIndex == 1}, nil
+	decoder.count(&decoder.stats.NameReferences)
+	return block.add(blockString{s: nameEntry.Name()}, value, neverIndex == 1)
 }
 
-func (decoder *QpackDecoder) readLiteralWithNameLiteral(reader *Reader, base int) (*HeaderField, error) {
+func (decoder *QpackDecoder) readLiteralWithNameLiteral(reader *Reader, block *HeaderBlock, base int) error {
 	neverIndex, err := reader.ReadBit()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	name, err := reader.ReadString(3)
+	name, err := block.readName(reader, 3)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	value, err := reader.ReadString(7)
+	value, err := block.readValue(reader, 7)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return &HeaderField{name, value, neverIndex == 1}, nil
+	decoder.count(&decoder.stats.Literals)
+	return block.add(name, value, neverIndex == 1)
 }
 
-func (decoder *QpackDecoder) decodeLargestBase(lrRaw uint64) int {
+func (decoder *QpackDecoder) decodeLargestBase(lrRaw uint64) (int, error) {
 	decoder.logger.Printf("largest reference %v, current base %v",
 		lrRaw, decoder.Table.Base())
 	if lrRaw == 0 {
-		return 0
+		return 0, nil
 	}
-	maxEntries := uint64(decoder.Table.Capacity() / entryOverhead)
+	maxEntries := uint64(decoder.maxCapacity / entryOverhead)
 	fullRange := maxEntries * 2
+	if lrRaw > fullRange {
+		return 0, ErrIndexError
+	}
 
 	// Determine the maximum possible value, which is base + maxEntries
 	maxValue := uint64(decoder.Table.Base()) + maxEntries
@@ -371,7 +476,7 @@ func (decoder *QpackDecoder) decodeLargestBase(lrRaw uint64) int {
 	// Note that largestReference isn't a reference, it's the count of
 	// the number of inserts - which is the same as we use for largestBase.
 	decoder.logger.Printf("largest reference %v", largestReference)
-	return int(largestReference)
+	return int(largestReference), nil
 }
 
 // readBase reads the header block header and blocks until the decoder is
@@ -381,10 +486,16 @@ func (decoder *QpackDecoder) readBase(reader *Reader) (int, int, error) {
 	if err != nil {
 		return 0, 0, err
 	}
-	largestBase := decoder.decodeLargestBase(lrRaw)
+	largestBase, err := decoder.decodeLargestBase(lrRaw)
+	if err != nil {
+		return 0, 0, err
+	}
 	decoder.logger.Printf("wait for %v", largestBase)
 	// This blocks until the dynamic table is ready.
-	decoder.table.WaitForEntry(largestBase)
+	err = decoder.waitForEntry(largestBase)
+	if err != nil {
+		return 0, 0, err
+	}
 
 	sign, err := reader.ReadBit()
 	if err != nil {
@@ -400,22 +511,31 @@ func (decoder *QpackDecoder) readBase(reader *Reader) (int, int, error) {
 	decoder.logger.Printf("base delta %v %v", sign, delta)
 	// Sign: 1 means negative, 0 means positive.
 	base := largestBase + (delta * (1 - 2*int(sign)))
+	if base < 0 {
+		return 0, 0, ErrIndexError
+	}
 	decoder.logger.Printf("base %v", base)
 	return largestBase, base, nil
 }
 
 // ReadHeaderBlock decodes header fields as they arrive.
 func (decoder *QpackDecoder) ReadHeaderBlock(r io.Reader, id uint64) ([]HeaderField, error) {
-	reader := NewReader(r)
-	largestBase, base, err := decoder.readBase(reader)
+	var block HeaderBlock
+	err := decoder.ReadHeaderBlockInto(r, id, &block)
 	if err != nil {
 		return nil, err
 	}
+	return block.Fields, nil
+}
 
-	headers := []HeaderField{}
-	addHeader := func(h *HeaderField) {
-		decoder.logger.Printf("add %v", h)
-		headers = append(headers, *h)
+// ReadHeaderBlockInto decodes header fields into the given block.  Reusing the
+// same block avoids most of the allocations that ReadHeaderBlock makes.  A
+// block can't be used for more than one header block at a time.
+func (decoder *QpackDecoder) ReadHeaderBlockInto(r io.Reader, id uint64, block *HeaderBlock) error {
+	reader := decoder.startBlock(block, r)
+	largestBase, base, err := decoder.readBase(reader)
+	if err != nil {
+		return err
 	}
 
 	for {
@@ -424,63 +544,60 @@ func (decoder *QpackDecoder) ReadHeaderBlock(r io.Reader, id uint64) ([]HeaderFi
 			break // Success!
 		}
 		if err != nil {
-			return nil, err
+			return err
 		}
 		if b == 1 {
-			h, err := decoder.readIndexed(reader, base)
+			err = decoder.readIndexed(reader, block, base)
 			if err != nil {
-				return nil, err
+				return err
 			}
-			addHeader(h)
 			continue
 		}
 
 		b, err = reader.ReadBit()
 		if err != nil {
-			return nil, err
+			return err
 		}
 		if b == 1 {
-			h, err := decoder.readLiteralWithNameReference(reader, base)
+			err = decoder.readLiteralWithNameReference(reader, block, base)
 			if err != nil {
-				return nil, err
+				return err
 			}
-			addHeader(h)
 			continue
 		}
 
 		b, err = reader.ReadBit()
 		if err != nil {
-			return nil, err
+			return err
 		}
 		if b == 1 {
-			h, err := decoder.readLiteralWithNameLiteral(reader, base)
+			err = decoder.readLiteralWithNameLiteral(reader, block, base)
 			if err != nil {
-				return nil, err
+				return err
 			}
-			addHeader(h)
 			continue
 		}
 
 		b, err = reader.ReadBit()
 		if err != nil {
-			return nil, err
+			return err
 		}
-		var h *HeaderField
 		if b == 1 {
-			h, err = decoder.readPostBaseIndexed(reader, base)
+			err = decoder.readPostBaseIndexed(reader, block, base)
 		} else {
-			h, err = decoder.readLiteralWithPostBaseNameReference(reader, base)
+			err = decoder.readLiteralWithPostBaseNameReference(reader, block, base)
 		}
 		if err != nil {
-			return nil, err
+			return err
 		}
-		addHeader(h)
 	}
+	block.finish()
 
 	if largestBase > 0 {
 		decoder.acknowledged <- &headerBlockAck{id, largestBase}
 	}
-	return headers, nil
+	decoder.countBlock(block.Fields, block.counter.n)
+	return nil
 }
 
 // Cancelled tells the decoder that the identifier was cancelled.  The decoder
@@ -1,11 +1,17 @@
 package hc
 
 import (
+	"errors"
 	"io"
 	"strings"
 	"sync"
+	"unicode/utf8"
 )
 
+// ErrMaxCapacityFixed is returned if the largest capacity is changed after
+// entries have been inserted into the table.
+var ErrMaxCapacityFixed = errors.New("maximum table capacity can't change after inserting")
+
 const intMax = int(^uint(0) >> 1)
 
 // This is used by the writer to track which table entries are needed to write
@@ -14,6 +20,8 @@ type qpackWriterState struct {
 	headers     []HeaderField
 	matches     []Entry
 	nameMatches []Entry
+	// copied is set once headers is no longer shared with the caller.
+	copied bool
 
 	// Track the largest and smallest base that we use. Largest so that we can set
 	// the base on the header block; smallest so that we can prevent that from
@@ -29,16 +37,45 @@ type qpackWriterState struct {
 	uses *qpackHeaderBlockUsage
 }
 
+// initHeaders sets up the state for the given header fields.  The header fields
+// are only copied if they need to be changed.
 func (state *qpackWriterState) initHeaders(headers []HeaderField) {
-	state.headers = make([]HeaderField, len(headers))
+	state.headers = headers
 	for i, h := range headers {
-		state.headers[i] = HeaderField{strings.ToLower(h.Name), h.Value, h.Sensitive}
+		if needsLowercase(h.Name) {
+			state.copyHeaders()
+			state.headers[i].Name = strings.ToLower(h.Name)
+		}
 	}
-	state.matches = make([]Entry, len(headers))
-	state.nameMatches = make([]Entry, len(headers))
+	entries := make([]Entry, 2*len(headers))
+	state.matches = entries[:len(headers)]
+	state.nameMatches = entries[len(headers):]
 	state.smallestBase = int(^uint(0) >> 1)
 }
 
+// copyHeaders ensures that the state has its own copy of the header fields,
+// which can then be modified.
+func (state *qpackWriterState) copyHeaders() {
+	if state.copied {
+		return
+	}
+	headers := make([]HeaderField, len(state.headers))
+	copy(headers, state.headers)
+	state.headers = headers
+	state.copied = true
+}
+
+// needsLowercase returns true if strings.ToLower would change the name.
+func needsLowercase(name string) bool {
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c >= utf8.RuneSelf || ('A' <= c && c <= 'Z') {
+			return true
+		}
+	}
+	return false
+}
+
 // setupUsage configures the state with a usage tracker.
 func (state *qpackWriterState) setupUsage(streamUsage *qpackStreamUsage, highestAcknowledged int, blockingAllowed bool) {
 	state.maxBase = intMax
@@ -144,6 +181,18 @@ type QpackEncoder struct {
 	// blockedStreams is the number of streams that are currently
 	// potentially blocked.
 	blockedStreams int
+	// maxCapacity is the largest capacity that the peer allows.  This is used
+	// to encode the largest reference.
+	maxCapacity TableCapacity
+	// capacityPending is set when the capacity needs to be reduced to
+	// pendingCapacity, but entries that are still needed prevent that.
+	capacityPending bool
+	pendingCapacity TableCapacity
+	// lag tracks how long acknowledgments take in adaptive mode.
+	lag ackLag
+	// nonAdaptive is the strategy that is used when adaptive mode is turned
+	// off.
+	nonAdaptive IndexingStrategy
 }
 
 // NewQpackEncoder creates a new QpackEncoder and sets it up.
@@ -156,9 +205,11 @@ func NewQpackEncoder(hw io.Writer, capacity TableCapacity, referenceable TableCa
 	encoder := new(QpackEncoder)
 	encoder.table = NewQpackEncoderTable(capacity, referenceable)
 	encoder.Table = encoder.table
+	encoder.maxCapacity = capacity
 	encoder.updatesWriter = NewWriter(hw)
 	encoder.usage = make(map[uint64]*qpackStreamUsage)
 	encoder.initLogging(nil)
+	encoder.initStats()
 	return encoder
 }
 
@@ -214,6 +265,10 @@ func (encoder *QpackEncoder) insert(name string, value string, evict evictionChe
 	// encoder adds to the dynamic table, but cannot use those entries until
 	// they are acknowledged.  If they are evicted before they can be used,
 	// the table updates are a total waste.
+	if encoder.capacityPending {
+		encoder.logger.Printf("not adding entry while the capacity is reduced")
+		return nil
+	}
 	if entry.Size()+encoder.unacknowledgedSize > encoder.table.referenceableLimit {
 		encoder.logger.Printf("not adding entry of size %v", entry.Size())
 		return nil
@@ -242,6 +297,7 @@ func (encoder *QpackEncoder) writeDuplicate(entry DynamicEntry, state *qpackWrit
 	if err != nil {
 		return err
 	}
+	encoder.count(&encoder.stats.Duplicates)
 	state.recordMatch(i, inserted, nil)
 	return nil
 }
@@ -293,6 +349,7 @@ func (encoder *QpackEncoder) writeInsert(state *qpackWriterState, i int,
 		return err
 	}
 
+	encoder.count(&encoder.stats.Inserts)
 	state.recordMatch(i, inserted, nil)
 	return nil
 }
@@ -308,11 +365,18 @@ func (encoder *QpackEncoder) writeTableChanges(state *qpackWriterState, id uint6
 	streamUsage := encoder.usage.get(id)
 	blockingAllowed := encoder.blockedStreams < encoder.maxBlockedStreams
 	state.setupUsage(streamUsage, encoder.highestAcknowledged, blockingAllowed)
+	if encoder.capacityPending {
+		// Don't use the dynamic table until the capacity can be reduced.
+		state.maxBase = 0
+	}
 
 	for i := range state.headers {
 		// Make sure to write into the slice rather than use a copy of each header.
 		h := state.headers[i]
-		if h.Sensitive {
+		decision, nameOnly := encoder.adaptiveDecision(h)
+		if decision == IndexNever {
+			state.copyHeaders()
+			state.headers[i].Sensitive = true
 			continue
 		}
 
@@ -332,8 +396,7 @@ func (encoder *QpackEncoder) writeTableChanges(state *qpackWriterState, id uint6
 		//     If this turns up a name match, a name reference to that name is used
 		//     when inserting a new entry.
 		//     The at-risk lookup considers entries that are blocked by maxBase.
-		//     However, to avoid churn on the table, unacknowledged entries are not
-		//     duplicated.
+		//     The IndexingStrategy decides whether these entries are duplicated.
 
 		match, nameMatch := encoder.table.LookupReferenceable(h.Name, h.Value, state.maxBase)
 		if match != nil {
@@ -352,9 +415,10 @@ func (encoder *QpackEncoder) writeTableChanges(state *qpackWriterState, id uint6
 		var insertNameMatch Entry
 		duplicate, insertNameMatch := encoder.table.LookupExtra(h.Name, h.Value)
 		if duplicate != nil {
-			// Only duplicate acknowledged entries.  Refreshing entries more than
-			// once per round trip is going to churn the table too much.
-			if duplicate.Base() <= encoder.highestAcknowledged {
+			// The default strategy only duplicates acknowledged entries.  Refreshing
+			// entries more than once per round trip churns the table too much.
+			acknowledged := duplicate.Base() <= encoder.highestAcknowledged
+			if encoder.indexingStrategy().Duplicate(h, acknowledged) {
 				err := encoder.writeDuplicate(duplicate, state, i)
 				if err != nil {
 					return err
@@ -370,7 +434,9 @@ func (encoder *QpackEncoder) writeTableChanges(state *qpackWriterState, id uint6
 			state.recordMatch(i, nil, nameMatch)
 			insertNameMatch = nameMatch
 		}
-		if encoder.shouldIndex(h) && h.size() <= encoder.Table.Capacity() {
+		// In adaptive mode, a value for a name that has many different values
+		// is only inserted if the name can't be referenced.
+		if decision == IndexInsert && (!nameOnly || nameMatch == nil) {
 			err := encoder.writeInsert(state, i, insertNameMatch)
 			if err != nil {
 				return err
@@ -378,6 +444,9 @@ func (encoder *QpackEncoder) writeTableChanges(state *qpackWriterState, id uint6
 		}
 	}
 
+	if state.largestBase > encoder.highestAcknowledged {
+		encoder.count(&encoder.stats.BlockedStreams)
+	}
 	if state.isNewlyBlocked(encoder.highestAcknowledged) {
 		// If this wasn't blocking before, it is now.
 		encoder.blockedStreams++
@@ -418,6 +487,7 @@ func (encoder *QpackEncoder) writeIndexed(writer *Writer, state *qpackWriterStat
 		return err
 	}
 
+	encoder.count(&encoder.stats.Indexed)
 	state.addUse(i)
 	return nil
 }
@@ -461,8 +531,10 @@ func (encoder *QpackEncoder) writeLiteral(writer *Writer, state *qpackWriterStat
 	var err error
 	nameMatch := state.nameMatches[i]
 	if nameMatch != nil {
+		encoder.count(&encoder.stats.NameReferences)
 		err = encoder.writeLiteralNameReference(writer, state, sensitive, nameMatch)
 	} else {
+		encoder.count(&encoder.stats.Literals)
 		err = writer.WriteBits(2|sensitive, 4)
 		if err != nil {
 			return err
@@ -473,7 +545,7 @@ func (encoder *QpackEncoder) writeLiteral(writer *Writer, state *qpackWriterStat
 		return err
 	}
 
-	err = writer.WriteStringRaw(h.Value, 7, encoder.HuffmanPreference)
+	err = writer.WriteStringRaw(h.Value, 7, encoder.valueHuffman(h))
 	if err != nil {
 		return err
 	}
@@ -489,12 +561,13 @@ func (encoder *QpackEncoder) encodeLargestReference(largestBase int) uint64 {
 	// largestBase is the same thing as largestReference here - a count of the number of inserts.
 	// The spec is confused, but the resulting code is fine.
 	largestReference := uint64(largestBase)
-	maxEntries := uint64(encoder.Table.Capacity() / entryOverhead)
+	maxEntries := uint64(encoder.maxCapacity / entryOverhead)
 	return (largestReference % (2 * maxEntries)) + 1
 }
 
 func (encoder *QpackEncoder) writeHeaderBlock(headerWriter io.Writer, state *qpackWriterState) error {
-	w := NewWriter(headerWriter)
+	cw := &countingWriter{w: headerWriter}
+	w := NewWriter(cw)
 	err := w.WriteInt(encoder.encodeLargestReference(state.largestBase), 8)
 	if err != nil {
 		return err
@@ -521,6 +594,7 @@ func (encoder *QpackEncoder) writeHeaderBlock(headerWriter io.Writer, state *qpa
 			return err
 		}
 	}
+	encoder.countBlock(state.headers, cw.n)
 	return nil
 }
 
@@ -550,6 +624,9 @@ func (encoder *QpackEncoder) updateHighestAcknowledged(increment int) {
 		panic("can't acknowledge more than we've sent")
 	}
 	encoder.highestAcknowledged += increment
+	if encoder.isAdaptive() {
+		encoder.adaptReferenceableLimit()
+	}
 
 	// Now we need to reduce the count of unacknowledged entry sizes.
 	for i := 0; i < increment; i++ {
@@ -575,7 +652,7 @@ func (encoder *QpackEncoder) AcknowledgeInsert(increment int) error {
 	}
 	encoder.blockedStreams = encoder.usage.countBlockedStreams(base)
 	encoder.updateHighestAcknowledged(increment)
-	return nil
+	return encoder.applyCapacity()
 }
 
 // AcknowledgeHeader is called when a header block has been acknowledged by the peer.
@@ -591,7 +668,7 @@ func (encoder *QpackEncoder) AcknowledgeHeader(id uint64) error {
 		encoder.blockedStreams--
 		encoder.updateHighestAcknowledged(removedLargest - encoder.highestAcknowledged)
 	}
-	return nil
+	return encoder.applyCapacity()
 }
 
 // AcknowledgeReset is used when this side resets a stream.  When the decoder
@@ -607,15 +684,73 @@ func (encoder *QpackEncoder) AcknowledgeReset(id uint64) error {
 	if largest > encoder.highestAcknowledged {
 		encoder.blockedStreams--
 	}
-	return nil
+	return encoder.applyCapacity()
 }
 
-// SetCapacity sets the table capacity. This panics if it is called when the
-// capacity has already been set to a non-zero value.
-func (encoder *QpackEncoder) SetCapacity(capacity TableCapacity) {
+// SetMaxCapacity sets the largest capacity that the peer's decoder allows,
+// which comes from its settings.  The table starts with this capacity.  Both
+// sides use this value to encode the largest reference in header blocks, so it
+// can't change once anything has been inserted.
+func (encoder *QpackEncoder) SetMaxCapacity(capacity TableCapacity) error {
 	defer encoder.mutex.Unlock()
 	encoder.mutex.Lock()
+	if encoder.Table.Base() > 0 {
+		return ErrMaxCapacityFixed
+	}
+	encoder.maxCapacity = capacity
+	encoder.capacityPending = false
 	encoder.table.SetCapacity(capacity)
+	return nil
+}
+
+// SetCapacity sets the table capacity, which can't be more than the peer
+// allows (see SetMaxCapacity).  Before anything is inserted, this sets the
+// capacity that the peer's decoder starts with.  After that, the change is sent
+// to the decoder.  Reducing the capacity can require entries to be evicted,
+// which can't happen while header blocks that use them are unacknowledged, or
+// before the decoder has acknowledged them.  Until then, the dynamic table
+// isn't used.
+func (encoder *QpackEncoder) SetCapacity(capacity TableCapacity) error {
+	defer encoder.mutex.Unlock()
+	encoder.mutex.Lock()
+	if capacity > encoder.maxCapacity {
+		return ErrTableOverflow
+	}
+	if encoder.Table.Base() == 0 {
+		encoder.capacityPending = false
+		encoder.table.SetCapacity(capacity)
+		return nil
+	}
+	encoder.capacityPending = true
+	encoder.pendingCapacity = capacity
+	return encoder.applyCapacity()
+}
+
+// acknowledgedCheck allows entries to be evicted if the decoder has
+// acknowledged them.
+type acknowledgedCheck int
+
+func (highest acknowledgedCheck) CanEvict(e DynamicEntry) bool {
+	return e.Base() <= int(highest)
+}
+
+// applyCapacity changes the capacity if there is a change pending and writes
+// a dynamic table size update instruction.
+func (encoder *QpackEncoder) applyCapacity() error {
+	if !encoder.capacityPending {
+		return nil
+	}
+	if !encoder.table.setCapacity(encoder.pendingCapacity, acknowledgedCheck(encoder.highestAcknowledged)) {
+		encoder.logger.Printf("can't reduce capacity to %v yet", encoder.pendingCapacity)
+		return nil
+	}
+	encoder.capacityPending = false
+	encoder.logger.Printf("update capacity %v", encoder.pendingCapacity)
+	err := encoder.updatesWriter.WriteBits(1, 3)
+	if err != nil {
+		return err
+	}
+	return encoder.updatesWriter.WriteInt(uint64(encoder.pendingCapacity), 5)
 }
 
 // SetReferenceableLimit limits the space in the table that can be used.
@@ -625,6 +760,91 @@ func (encoder *QpackEncoder) SetReferenceableLimit(limit TableCapacity) {
 	encoder.table.SetReferenceableLimit(limit)
 }
 
+// adaptiveDecision is indexDecision, but in adaptive mode it also reports
+// whether the header field is only inserted if its name can't be referenced.
+// Preferences set with SetIndexPreference override that.
+func (encoder *QpackEncoder) adaptiveDecision(h HeaderField) (IndexDecision, bool) {
+	ai, ok := encoder.strategy.(*adaptiveIndexing)
+	if !ok || h.Sensitive {
+		return encoder.indexDecision(h), false
+	}
+	decision, nameOnly := ai.decide(h)
+	if _, ok := encoder.indexPrefs[h.Name]; ok {
+		nameOnly = false
+	}
+	return encoder.overrideDecision(h, decision), nameOnly
+}
+
+// SetAdaptive turns adaptive mode on or off.  In adaptive mode, the encoder
+// learns which header fields recur on the connection and only inserts those
+// that are likely to be used again.  Values for names with many different
+// values are sent as literals that reference the name until they repeat.  The
+// referenceable limit is also adjusted so that the margin at the end of the
+// table is large enough to hold what is inserted while waiting for an
+// acknowledgment.  Adaptive mode replaces the limit set by
+// SetReferenceableLimit.  Adaptive mode also takes the place of any
+// IndexingStrategy, which is used again when adaptive mode is turned off.
+func (encoder *QpackEncoder) SetAdaptive(adaptive bool) {
+	defer encoder.mutex.Unlock()
+	encoder.mutex.Lock()
+	if adaptive == encoder.isAdaptive() {
+		return
+	}
+	if adaptive {
+		encoder.nonAdaptive = encoder.strategy
+		encoder.strategy = newAdaptiveIndexing()
+	} else {
+		encoder.strategy = encoder.nonAdaptive
+		encoder.nonAdaptive = nil
+	}
+	encoder.lag = ackLag{}
+}
+
+// SetIndexingStrategy sets the strategy that the encoder uses to decide how to
+// use the table.  Setting this to nil restores the default.  In adaptive mode,
+// the strategy is used once adaptive mode is turned off.
+func (encoder *QpackEncoder) SetIndexingStrategy(strategy IndexingStrategy) {
+	defer encoder.mutex.Unlock()
+	encoder.mutex.Lock()
+	if encoder.isAdaptive() {
+		encoder.nonAdaptive = strategy
+	} else {
+		encoder.strategy = strategy
+	}
+}
+
+func (encoder *QpackEncoder) isAdaptive() bool {
+	_, adaptive := encoder.strategy.(*adaptiveIndexing)
+	return adaptive
+}
+
+// adaptReferenceableLimit updates the referenceable limit based on the number
+// of bytes that were waiting for acknowledgment.  This is called when the
+// highest acknowledged entry increases, before unacknowledgedSize is reduced.
+func (encoder *QpackEncoder) adaptReferenceableLimit() {
+	encoder.lag.sample(encoder.unacknowledgedSize)
+	limit := encoder.lag.referenceableLimit(encoder.Table.Capacity())
+	if limit != encoder.table.referenceableLimit {
+		encoder.logger.Printf("adjust referenceable limit to %v", limit)
+		encoder.table.SetReferenceableLimit(limit)
+	}
+}
+
+// Stats returns statistics for the encoder.
+func (encoder *QpackEncoder) Stats() Stats {
+	defer encoder.mutex.RUnlock()
+	encoder.mutex.RLock()
+	return encoder.snapshot(encoder.Table)
+}
+
+// ReferenceableLimit returns the current limit on the space in the table that
+// can be referenced.
+func (encoder *QpackEncoder) ReferenceableLimit() TableCapacity {
+	defer encoder.mutex.RUnlock()
+	encoder.mutex.RLock()
+	return encoder.table.referenceableLimit
+}
+
 // SetMaxBlockedStreams sets the number of streams that this can encode without blocking.
 func (encoder *QpackEncoder) SetMaxBlockedStreams(m int) {
 	defer encoder.mutex.Unlock()
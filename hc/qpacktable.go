@@ -2,6 +2,7 @@ package hc
 
 import (
 	"sync"
+	"time"
 )
 
 const tableOverhead = TableCapacity(32)
@@ -20,9 +21,9 @@ const useQpackStaticTable = true
 // Lookup finds an entry.
 func (table *qpackTableCommon) Lookup(name string, value string) (Entry, Entry) {
 	if useQpackStaticTable {
-		return table.lookupImpl(qpackStaticTable, name, value, 0, len(table.dynamic))
+		return table.lookupImpl(qpackStaticIndex, name, value, 0, table.dynamic.len())
 	}
-	return table.lookupImpl(hpackStaticTable, name, value, 0, len(table.dynamic))
+	return table.lookupImpl(hpackStaticIndex, name, value, 0, table.dynamic.len())
 }
 
 // Index returns the index for the given entry.
@@ -40,7 +41,7 @@ func (table *qpackTableCommon) GetStatic(i int) Entry {
 		if i < 0 || i >= len(qpackStaticTable) {
 			return nil
 		}
-		return qpackStaticTable[i]
+		return &qpackStaticTable[i]
 	}
 
 	// Use the HPACK table temporarily.
@@ -48,7 +49,7 @@ func (table *qpackTableCommon) GetStatic(i int) Entry {
 	if i < 0 || i >= len(hpackStaticTable) {
 		return nil
 	}
-	return hpackStaticTable[i]
+	return &hpackStaticTable[i]
 }
 
 // QpackDecoderTable is a table for decoding QPACK header fields.
@@ -81,11 +82,31 @@ func (qt *QpackDecoderTable) GetStatic(i int) Entry {
 
 // WaitForEntry waits until the table base reaches or exceeds the specified value.
 func (qt *QpackDecoderTable) WaitForEntry(base int) {
+	_ = qt.waitForEntry(base, 0)
+}
+
+// waitForEntry waits until the table base reaches or exceeds the specified
+// value, or the timeout expires.  A zero timeout means no limit.
+func (qt *QpackDecoderTable) waitForEntry(base int, timeout time.Duration) error {
 	defer qt.lock.Unlock()
 	qt.lock.Lock()
+	expired := false
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			defer qt.lock.Unlock()
+			qt.lock.Lock()
+			expired = true
+			qt.insertCondition.Broadcast()
+		})
+		defer timer.Stop()
+	}
 	for qt.table.Base() < base {
+		if expired {
+			return ErrBlockedTimeout
+		}
 		qt.insertCondition.Wait()
 	}
+	return nil
 }
 
 // Insert an entry into the table.
@@ -101,6 +122,13 @@ func (qt *QpackDecoderTable) Insert(name string, value string, evict evictionChe
 	return entry
 }
 
+// evictionCount wraps tableCommon.evictionCount with a reader lock.
+func (qt *QpackDecoderTable) evictionCount() uint64 {
+	defer qt.lock.RUnlock()
+	qt.lock.RLock()
+	return qt.table.evictionCount()
+}
+
 // Capacity wraps tableCommon.Capacity with a reader lock.
 func (qt *QpackDecoderTable) Capacity() TableCapacity {
 	defer qt.lock.RUnlock()
@@ -271,6 +299,8 @@ type QpackEncoderTable struct {
 	qpackTableCommon
 	// The amount of table capacity we will actively use.
 	referenceableLimit TableCapacity
+	// The limit that was asked for, which might be more than the capacity.
+	requestedLimit TableCapacity
 	// The number of entries we can use right now.
 	referenceable int
 	// The size of those usable entries.
@@ -292,7 +322,7 @@ func (qt *QpackEncoderTable) added(qe DynamicEntry) {
 	i := qt.referenceable + 1
 	for updatedSize > qt.referenceableLimit {
 		i--
-		updatedSize -= qt.dynamic[i].Size()
+		updatedSize -= qt.dynamic.get(i).Size()
 	}
 	qt.referenceable = i
 	qt.referenceableSize = updatedSize
@@ -312,15 +342,16 @@ type qpackEncoderEvictWrapper struct {
 }
 
 func (qevict *qpackEncoderEvictWrapper) CanEvict(e DynamicEntry) bool {
-	if !qevict.wrapped.CanEvict(e) {
-		return false
-	}
-	qe := e.(*qpackEncoderEntry)
-	if qe.inUse() {
+	if qevict.wrapped != nil && !qevict.wrapped.CanEvict(e) {
 		return false
 	}
-	qevict.table.removed(qe)
-	return true
+	return !e.(*qpackEncoderEntry).inUse()
+}
+
+// Evicted implements evictionObserver so that the referenceable entries are
+// only updated when entries are really evicted.
+func (qevict *qpackEncoderEvictWrapper) Evicted(e DynamicEntry) {
+	qevict.table.removed(e)
 }
 
 // Insert an entry. This monitors for both evictions and insertions so that a
@@ -348,9 +379,9 @@ func (qt *QpackEncoderTable) LookupReferenceable(name string, value string, maxB
 		end = 0
 	}
 	if useQpackStaticTable {
-		return qt.lookupImpl(qpackStaticTable, name, value, start, end)
+		return qt.lookupImpl(qpackStaticIndex, name, value, start, end)
 	}
-	return qt.lookupImpl(hpackStaticTable, name, value, start, end)
+	return qt.lookupImpl(hpackStaticIndex, name, value, start, end)
 }
 
 // LookupBlocked looks in the portion of the table that we're blocked from looking at
@@ -364,48 +395,44 @@ func (qt *QpackEncoderTable) LookupBlocked(name string, value string, maxBase in
 	if end > qt.referenceable {
 		end = qt.referenceable
 	}
-	for _, entry := range qt.dynamic[:end] {
-		if entry.Name() == name && entry.Value() == value {
-			return true
-		}
-	}
-	return false
+	return newest(qt.index.fields[fieldKey{name, value}], qt.Base()-end, qt.Base()) != nil
 }
 
 // LookupExtra looks in the table for a dynamic entry after the provided
-// offset. It is designed for use after LookupReferenceable() fails.
+// offset. It is designed for use after LookupReferenceable() fails.  No name
+// match is returned, because an entry this close to eviction could be evicted
+// by the insertion that would reference it.
 func (qt *QpackEncoderTable) LookupExtra(name string, value string) (DynamicEntry, DynamicEntry) {
-	var nameMatch DynamicEntry
-	for _, entry := range qt.dynamic[qt.referenceable:] {
-		if entry.Name() == name {
-			if entry.Value() == value {
-				return entry, entry
-			}
-			if nameMatch != nil {
-				nameMatch = entry
-			}
-		}
+	match := newest(qt.index.fields[fieldKey{name, value}], 0, qt.Base()-qt.referenceable)
+	if match != nil {
+		return match, match
 	}
-	return nil, nameMatch
+	return nil, nil
 }
 
-// SetCapacity sets the table capacity. This panics if it is called after an
-// entry has been inserted. For safety, only set this to a non-zero value from a
-// zero value.
+// SetCapacity sets the table capacity.  If the capacity is reduced, entries
+// are evicted, but entries that are in use can't be evicted.  If that prevents
+// the table from shrinking, nothing changes.
 func (qt *QpackEncoderTable) SetCapacity(c TableCapacity) {
-	if qt.Base() > 0 {
-		// TODO implement something sensible here
-		panic("Can't change encoder table size after inserting anything")
+	qt.setCapacity(c, nil)
+}
+
+// setCapacity changes the capacity, evicting entries as necessary.  This
+// returns false and leaves the table unchanged if that isn't possible.
+func (qt *QpackEncoderTable) setCapacity(c TableCapacity, evict evictionCheck) bool {
+	if !qt.evictTo(c, &qpackEncoderEvictWrapper{evict, qt}) {
+		return false
 	}
 	qt.capacity = c
-	if qt.referenceableLimit > c {
-		qt.SetReferenceableLimit(qt.referenceableLimit)
-	}
+	// Apply the limit again, which restores it if the table grows.
+	qt.SetReferenceableLimit(qt.requestedLimit)
+	return true
 }
 
 // SetReferenceableLimit limits the space in the table that can be used.
 // This value is set to the minimum of the provided value and the capacity.
 func (qt *QpackEncoderTable) SetReferenceableLimit(limit TableCapacity) {
+	qt.requestedLimit = limit
 	if limit > qt.capacity {
 		limit = qt.capacity
 	}
@@ -415,13 +442,13 @@ func (qt *QpackEncoderTable) SetReferenceableLimit(limit TableCapacity) {
 	qt.referenceable = 0
 
 	remainingSpace := qt.referenceableLimit
-	for i := range qt.dynamic {
-		sz := qt.dynamic[i].Size()
-		if sz < remainingSpace {
-			qt.referenceable++
-			qt.referenceableSize += sz
-		} else {
+	for i := 0; i < qt.dynamic.len(); i++ {
+		sz := qt.dynamic.get(i).Size()
+		if sz > remainingSpace {
 			break
 		}
+		remainingSpace -= sz
+		qt.referenceable++
+		qt.referenceableSize += sz
 	}
 }
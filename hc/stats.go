@@ -0,0 +1,139 @@
+package hc
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Stats counts what an encoder or decoder has done.  Counts for encoders are
+// for what was written; counts for decoders are for what was read.  Some
+// counts only apply to QPACK.
+type Stats struct {
+	// HeaderBlocks is the number of header blocks.
+	HeaderBlocks uint64
+	// RawBytes is the total length of the names and values in header blocks.
+	RawBytes uint64
+	// EncodedBytes is the total size of the encoded header blocks.  This
+	// doesn't include the QPACK encoder stream.
+	EncodedBytes uint64
+	// Indexed is the number of header fields that reference a table entry.
+	Indexed uint64
+	// NameReferences is the number of literal header fields that reference
+	// the name of a table entry.
+	NameReferences uint64
+	// Literals is the number of header fields with a literal name.
+	Literals uint64
+	// Inserts is the number of entries added to the dynamic table, not
+	// counting duplicates.
+	Inserts uint64
+	// Duplicates is the number of entries that were duplicated.
+	Duplicates uint64
+	// Evictions is the number of entries evicted from the dynamic table.
+	Evictions uint64
+	// BlockedStreams is, for a QPACK encoder, the number of header blocks
+	// that can't be decoded until the decoder receives table updates.  For a
+	// QPACK decoder, it is the number of header blocks that had to wait.
+	BlockedStreams uint64
+	// BlockedTime is the total time that a QPACK decoder spent waiting for
+	// table updates.
+	BlockedTime time.Duration
+}
+
+// counters is embedded in encoders and decoders to collect Stats.  Counters
+// are updated atomically, and the Stats are allocated separately so that they
+// are suitably aligned for that.
+type counters struct {
+	stats *Stats
+}
+
+func (c *counters) initStats() {
+	c.stats = new(Stats)
+}
+
+func (c *counters) count(counter *uint64) {
+	atomic.AddUint64(counter, 1)
+}
+
+// countBlock records a header block.
+func (c *counters) countBlock(headers []HeaderField, encoded int) {
+	raw := 0
+	for _, h := range headers {
+		raw += len(h.Name) + len(h.Value)
+	}
+	atomic.AddUint64(&c.stats.HeaderBlocks, 1)
+	atomic.AddUint64(&c.stats.RawBytes, uint64(raw))
+	atomic.AddUint64(&c.stats.EncodedBytes, uint64(encoded))
+}
+
+// countBlocked records that a header block had to wait.
+func (c *counters) countBlocked(d time.Duration) {
+	atomic.AddUint64(&c.stats.BlockedStreams, 1)
+	atomic.AddInt64((*int64)(&c.stats.BlockedTime), int64(d))
+}
+
+// evictionCounter is implemented by tables that count evictions.
+type evictionCounter interface {
+	evictionCount() uint64
+}
+
+// snapshot takes a copy of the counters, adding evictions from the table.
+func (c *counters) snapshot(table Table) Stats {
+	s := Stats{
+		HeaderBlocks:   atomic.LoadUint64(&c.stats.HeaderBlocks),
+		RawBytes:       atomic.LoadUint64(&c.stats.RawBytes),
+		EncodedBytes:   atomic.LoadUint64(&c.stats.EncodedBytes),
+		Indexed:        atomic.LoadUint64(&c.stats.Indexed),
+		NameReferences: atomic.LoadUint64(&c.stats.NameReferences),
+		Literals:       atomic.LoadUint64(&c.stats.Literals),
+		Inserts:        atomic.LoadUint64(&c.stats.Inserts),
+		Duplicates:     atomic.LoadUint64(&c.stats.Duplicates),
+		BlockedStreams: atomic.LoadUint64(&c.stats.BlockedStreams),
+		BlockedTime:    time.Duration(atomic.LoadInt64((*int64)(&c.stats.BlockedTime))),
+	}
+	if ec, ok := table.(evictionCounter); ok {
+		s.Evictions = ec.evictionCount()
+	}
+	return s
+}
+
+// countingWriter counts the bytes written to a header block.
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += n
+	return n, err
+}
+
+// countingReader counts the bytes read from a header block.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += n
+	return n, err
+}
+
+// ReadByte is implemented because the bit reader reads a byte at a time.
+func (cr *countingReader) ReadByte() (byte, error) {
+	var b byte
+	var err error
+	if br, ok := cr.r.(io.ByteReader); ok {
+		b, err = br.ReadByte()
+	} else {
+		buf := [1]byte{}
+		_, err = io.ReadFull(cr.r, buf[:])
+		b = buf[0]
+	}
+	if err == nil {
+		cr.n++
+	}
+	return b, err
+}
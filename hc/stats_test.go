@@ -0,0 +1,96 @@
+package hc_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/martinthomson/minhq/hc"
+	"github.com/stvp/assert"
+)
+
+func TestHpackStats(t *testing.T) {
+	encoder := hc.NewHpackEncoder(256)
+	decoder := hc.NewHpackDecoder()
+	decoder.Table.SetCapacity(256)
+
+	headers := []hc.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":path", Value: "/x"},
+		{Name: "name1", Value: "value1"},
+	}
+	encoded := 0
+	for i := 0; i < 2; i++ {
+		var buf bytes.Buffer
+		err := encoder.WriteHeaderBlock(&buf, headers...)
+		assert.Nil(t, err)
+		encoded += buf.Len()
+		_, err = decoder.ReadHeaderBlock(&buf)
+		assert.Nil(t, err)
+	}
+
+	// :method is indexed twice, :path is sent with a name reference both
+	// times, and name1 is inserted and then indexed.
+	expected := hc.Stats{
+		HeaderBlocks:   2,
+		RawBytes:       2 * (7 + 3 + 5 + 2 + 5 + 6),
+		EncodedBytes:   uint64(encoded),
+		Indexed:        3,
+		NameReferences: 2,
+		Literals:       1,
+		Inserts:        1,
+	}
+	assert.Equal(t, expected, encoder.Stats())
+	assert.Equal(t, expected, decoder.Stats())
+}
+
+func TestQpackStats(t *testing.T) {
+	var updateBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 100, 100)
+	encoder.SetMaxBlockedStreams(100)
+	ackChecker := newAckChecker(t)
+	decoder := hc.NewQpackDecoder(ackChecker, 100)
+	defer decoder.Close()
+
+	var headerBuf bytes.Buffer
+	err := encoder.WriteHeaderBlock(&headerBuf, defaultToken,
+		hc.HeaderField{Name: "name1", Value: "value1"},
+		hc.HeaderField{Name: "name2", Value: "value2"})
+	assert.Nil(t, err)
+	encoded := headerBuf.Len()
+
+	// Read the header block before the table updates so that it blocks.
+	done := make(chan struct{})
+	go func() {
+		_, err := decoder.ReadHeaderBlock(&headerBuf, defaultToken)
+		assert.Nil(t, err)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	err = decoder.ReadTableUpdates(&updateBuf)
+	assert.Nil(t, err)
+	<-done
+
+	stats := decoder.Stats()
+	assert.Equal(t, uint64(1), stats.HeaderBlocks)
+	assert.Equal(t, uint64(22), stats.RawBytes)
+	assert.Equal(t, uint64(encoded), stats.EncodedBytes)
+	assert.Equal(t, uint64(2), stats.Indexed)
+	assert.Equal(t, uint64(2), stats.Inserts)
+	assert.Equal(t, uint64(1), stats.BlockedStreams)
+	assert.True(t, stats.BlockedTime > 0)
+
+	// Once acknowledged, a third entry evicts the first.
+	assert.Nil(t, encoder.AcknowledgeHeader(defaultToken))
+	headerBuf.Reset()
+	err = encoder.WriteHeaderBlock(&headerBuf, defaultToken,
+		hc.HeaderField{Name: "name3", Value: "value3"})
+	assert.Nil(t, err)
+
+	stats = encoder.Stats()
+	assert.Equal(t, uint64(2), stats.HeaderBlocks)
+	assert.Equal(t, uint64(2+1), stats.Indexed)
+	assert.Equal(t, uint64(3), stats.Inserts)
+	assert.Equal(t, uint64(1), stats.Evictions)
+	assert.Equal(t, uint64(2), stats.BlockedStreams)
+}
@@ -0,0 +1,185 @@
+package hc
+
+import (
+	"sync"
+)
+
+// IndexDecision is what an IndexingStrategy decides to do with a header field.
+// Encoders treat values other than those listed here as IndexLiteral.
+type IndexDecision int
+
+const (
+	// IndexLiteral sends a header field as a literal, without adding it to the
+	// table.  A matching table entry is still used if there is one.
+	IndexLiteral IndexDecision = iota
+	// IndexInsert adds a header field to the table if there is no match.
+	IndexInsert
+	// IndexNever sends a header field as a literal that intermediaries are not
+	// permitted to index.  This is the same as setting HeaderField.Sensitive.
+	IndexNever
+)
+
+// IndexingStrategy decides how an encoder uses the dynamic table.  An encoder
+// consults the strategy for every header field that isn't already marked as
+// sensitive.  A strategy that is shared between encoders needs to be safe for
+// concurrent use.
+type IndexingStrategy interface {
+	// Index decides whether a header field is added to the table.
+	Index(h HeaderField) IndexDecision
+	// Duplicate decides whether an entry that is close to being evicted is
+	// copied to the head of the table so that it can be used.  acknowledged is
+	// true if the decoder has acknowledged the entry.  Only QPACK uses this.
+	Duplicate(h HeaderField, acknowledged bool) bool
+}
+
+// dontIndex lists names that DefaultIndexing doesn't add to the table.  The
+// values of these are too variable to be worth keeping.
+var dontIndex = map[string]bool{
+	":path":               true,
+	"content-length":      true,
+	"content-range":       true,
+	"date":                true,
+	"expires":             true,
+	"etag":                true,
+	"if-modified-since":   true,
+	"if-range":            true,
+	"if-unmodified-since": true,
+	"last-modified":       true,
+	"link":                true,
+	"range":               true,
+	"referer":             true,
+	"refresh":             true,
+}
+
+// DefaultIndexing adds everything to the table except for a fixed list of
+// header fields with values that rarely repeat.  It only duplicates entries
+// that the decoder has acknowledged, so that entries aren't refreshed more
+// than once per round trip.
+type DefaultIndexing struct{}
+
+// Index implements IndexingStrategy.
+func (DefaultIndexing) Index(h HeaderField) IndexDecision {
+	if dontIndex[h.Name] {
+		return IndexLiteral
+	}
+	return IndexInsert
+}
+
+// Duplicate implements IndexingStrategy.
+func (DefaultIndexing) Duplicate(h HeaderField, acknowledged bool) bool {
+	return acknowledged
+}
+
+// StaticOnlyIndexing never uses the dynamic table.  This makes an encoder
+// that has no state beyond the static table.
+type StaticOnlyIndexing struct{}
+
+// Index implements IndexingStrategy.
+func (StaticOnlyIndexing) Index(h HeaderField) IndexDecision {
+	return IndexLiteral
+}
+
+// Duplicate implements IndexingStrategy.
+func (StaticOnlyIndexing) Duplicate(h HeaderField, acknowledged bool) bool {
+	return false
+}
+
+// AggressiveIndexing adds every header field to the table and duplicates
+// entries even if the decoder hasn't acknowledged them yet.  This suits small
+// sets of header fields that are repeated often, but it causes churn if there
+// are too many header fields to fit in the table.
+type AggressiveIndexing struct{}
+
+// Index implements IndexingStrategy.
+func (AggressiveIndexing) Index(h HeaderField) IndexDecision {
+	return IndexInsert
+}
+
+// Duplicate implements IndexingStrategy.
+func (AggressiveIndexing) Duplicate(h HeaderField, acknowledged bool) bool {
+	return true
+}
+
+// FrequencyIndexing learns which header fields recur.  A header field is only
+// added to the table once it has been seen a threshold number of times.  The
+// number of header fields that are tracked is limited; when that limit is
+// reached, all counts are halved and any header fields that drop to zero are
+// forgotten.  Use NewFrequencyIndexing to choose the threshold and limit; the
+// zero value uses the defaults.  This is safe for concurrent use.
+type FrequencyIndexing struct {
+	lock      sync.Mutex
+	threshold int
+	limit     int
+	counts    map[fieldKey]int
+}
+
+const (
+	defaultFrequencyThreshold = 2
+	defaultFrequencyLimit     = 1024
+)
+
+// NewFrequencyIndexing makes a FrequencyIndexing.  threshold is the number of
+// times that a header field needs to be seen before it is added to the table,
+// and limit is the number of header fields that are tracked.  Zero values for
+// threshold or limit use defaults of 2 and 1024 respectively.
+func NewFrequencyIndexing(threshold int, limit int) *FrequencyIndexing {
+	return &FrequencyIndexing{threshold: threshold, limit: limit}
+}
+
+// init fills in defaults.  Call this with the lock held.
+func (fi *FrequencyIndexing) init() {
+	if fi.counts != nil {
+		return
+	}
+	if fi.threshold <= 0 {
+		fi.threshold = defaultFrequencyThreshold
+	}
+	if fi.limit <= 0 {
+		fi.limit = defaultFrequencyLimit
+	}
+	fi.counts = make(map[fieldKey]int)
+}
+
+// age halves all of the counts, forgetting those that reach zero.
+func (fi *FrequencyIndexing) age() {
+	for k, v := range fi.counts {
+		if v <= 1 {
+			delete(fi.counts, k)
+		} else {
+			fi.counts[k] = v / 2
+		}
+	}
+}
+
+// Index implements IndexingStrategy.  This counts the header field.
+func (fi *FrequencyIndexing) Index(h HeaderField) IndexDecision {
+	defer fi.lock.Unlock()
+	fi.lock.Lock()
+	fi.init()
+
+	key := fieldKey{h.Name, h.Value}
+	count, ok := fi.counts[key]
+	if !ok && len(fi.counts) >= fi.limit {
+		fi.age()
+	}
+	if count < fi.threshold {
+		count++
+		fi.counts[key] = count
+	}
+	if count >= fi.threshold {
+		return IndexInsert
+	}
+	return IndexLiteral
+}
+
+// Duplicate implements IndexingStrategy.  Only acknowledged entries that have
+// been seen often enough are duplicated.
+func (fi *FrequencyIndexing) Duplicate(h HeaderField, acknowledged bool) bool {
+	if !acknowledged {
+		return false
+	}
+	defer fi.lock.Unlock()
+	fi.lock.Lock()
+	fi.init()
+	return fi.counts[fieldKey{h.Name, h.Value}] >= fi.threshold
+}
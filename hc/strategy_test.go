@@ -0,0 +1,153 @@
+package hc_test
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/martinthomson/minhq/hc"
+	"github.com/stvp/assert"
+)
+
+func TestStaticOnlyIndexing(t *testing.T) {
+	var updateBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 256, 256)
+	encoder.SetMaxBlockedStreams(100)
+	encoder.SetIndexingStrategy(hc.StaticOnlyIndexing{})
+
+	var headerBuf bytes.Buffer
+	err := encoder.WriteHeaderBlock(&headerBuf, defaultToken,
+		hc.HeaderField{Name: ":method", Value: "GET"},
+		hc.HeaderField{Name: "name1", Value: "value1"})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, updateBuf.Len())
+	assert.Equal(t, 0, encoder.Table.Base())
+	checkDynamicTable(t, encoder.Table, &[]dynamicTableEntry{})
+}
+
+func TestFrequencyIndexing(t *testing.T) {
+	fi := hc.NewFrequencyIndexing(2, 2)
+	a := hc.HeaderField{Name: "a", Value: "1"}
+	b := hc.HeaderField{Name: "b", Value: "2"}
+	c := hc.HeaderField{Name: "c", Value: "3"}
+
+	assert.Equal(t, hc.IndexLiteral, fi.Index(a))
+	assert.False(t, fi.Duplicate(a, true))
+	assert.Equal(t, hc.IndexInsert, fi.Index(a))
+	assert.True(t, fi.Duplicate(a, true))
+	assert.False(t, fi.Duplicate(a, false))
+
+	// Adding a third field exceeds the limit, so b is forgotten and the count
+	// for a is halved.
+	assert.Equal(t, hc.IndexLiteral, fi.Index(b))
+	assert.Equal(t, hc.IndexLiteral, fi.Index(c))
+	assert.False(t, fi.Duplicate(a, true))
+	assert.Equal(t, hc.IndexInsert, fi.Index(a))
+	assert.Equal(t, hc.IndexInsert, fi.Index(c))
+}
+
+// The zero value works and uses the default threshold of 2.
+func TestFrequencyIndexingZero(t *testing.T) {
+	a := hc.HeaderField{Name: "a", Value: "1"}
+	var fi hc.FrequencyIndexing
+	assert.False(t, fi.Duplicate(a, true))
+	assert.Equal(t, hc.IndexLiteral, fi.Index(a))
+	assert.Equal(t, hc.IndexInsert, fi.Index(a))
+
+	shared := &hc.FrequencyIndexing{}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shared.Index(a)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, hc.IndexInsert, shared.Index(a))
+}
+
+func TestFrequencyIndexingEncoder(t *testing.T) {
+	var updateBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 256, 256)
+	encoder.SetMaxBlockedStreams(100)
+	encoder.SetIndexingStrategy(hc.NewFrequencyIndexing(2, 0))
+
+	var headerBuf bytes.Buffer
+	field := hc.HeaderField{Name: "name1", Value: "value1"}
+	err := encoder.WriteHeaderBlock(&headerBuf, defaultToken, field)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, updateBuf.Len())
+	assert.Equal(t, 0, encoder.Table.Base())
+
+	headerBuf.Reset()
+	err = encoder.WriteHeaderBlock(&headerBuf, defaultToken, field)
+	assert.Nil(t, err)
+	assert.NotEqual(t, 0, updateBuf.Len())
+	checkDynamicTable(t, encoder.Table, &[]dynamicTableEntry{
+		{"name1", "value1"},
+	})
+}
+
+// neverIndexCookies marks cookies as never indexed.
+type neverIndexCookies struct {
+	hc.DefaultIndexing
+}
+
+func (neverIndexCookies) Index(h hc.HeaderField) hc.IndexDecision {
+	if h.Name == "cookie" {
+		return hc.IndexNever
+	}
+	return hc.IndexInsert
+}
+
+func TestIndexNever(t *testing.T) {
+	encoder := hc.NewHpackEncoder(256)
+	encoder.SetIndexingStrategy(neverIndexCookies{})
+	var buf bytes.Buffer
+	err := encoder.WriteHeaderBlock(&buf,
+		hc.HeaderField{Name: "cookie", Value: "secret"},
+		hc.HeaderField{Name: "name1", Value: "value1"})
+	assert.Nil(t, err)
+	checkDynamicTable(t, encoder.Table, &[]dynamicTableEntry{
+		{"name1", "value1"},
+	})
+
+	decoder := hc.NewHpackDecoder()
+	headers, err := decoder.ReadHeaderBlock(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(headers))
+	assert.True(t, headers[0].Sensitive)
+	assert.False(t, headers[1].Sensitive)
+}
+
+// unknownDecision returns an IndexDecision that isn't defined.
+type unknownDecision struct {
+	hc.DefaultIndexing
+}
+
+func (unknownDecision) Index(h hc.HeaderField) hc.IndexDecision {
+	return hc.IndexNever + 1
+}
+
+// Decisions that aren't defined are treated as IndexLiteral, even where the
+// table has no entry with the same name.
+func TestIndexUnknownDecision(t *testing.T) {
+	var updateBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 4096, 4096)
+	encoder.SetMaxBlockedStreams(100)
+	encoder.SetIndexingStrategy(unknownDecision{})
+	var headerBuf bytes.Buffer
+	err := encoder.WriteHeaderBlock(&headerBuf, 1,
+		hc.HeaderField{Name: "x-id", Value: "id1"})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, updateBuf.Len())
+	assert.Equal(t, 0, encoder.Table.Base())
+
+	hpack := hc.NewHpackEncoder(256)
+	hpack.SetIndexingStrategy(unknownDecision{})
+	err = hpack.WriteHeaderBlock(&headerBuf,
+		hc.HeaderField{Name: "x-id", Value: "id1"})
+	assert.Nil(t, err)
+	checkDynamicTable(t, hpack.Table, &[]dynamicTableEntry{})
+}
@@ -66,6 +66,12 @@ type evictionCheck interface {
 	CanEvict(DynamicEntry) bool
 }
 
+// evictionObserver is an optional addition to evictionCheck that is told about
+// each entry as it is evicted.
+type evictionObserver interface {
+	Evicted(DynamicEntry)
+}
+
 // Table is the basic interface to a header compression table.
 type Table interface {
 	// Base returns the current table base index.
@@ -87,9 +93,149 @@ type Table interface {
 	Lookup(name string, value string) (Entry, Entry)
 }
 
+// fieldKey is used to index entries by name and value.
+type fieldKey struct {
+	name  string
+	value string
+}
+
+// staticIndex finds static table entries by name, or by name and value.  Where
+// there are several entries, the one with the lowest index is used.
+type staticIndex struct {
+	fields map[fieldKey]Entry
+	names  map[string]Entry
+}
+
+func newStaticIndex(table []staticTableEntry) *staticIndex {
+	idx := &staticIndex{
+		fields: make(map[fieldKey]Entry),
+		names:  make(map[string]Entry),
+	}
+	for i := range table {
+		// Pointers to the entries don't allocate when used as an Entry.
+		entry := &table[i]
+		key := fieldKey{entry.Name(), entry.Value()}
+		if _, ok := idx.fields[key]; !ok {
+			idx.fields[key] = entry
+		}
+		if _, ok := idx.names[entry.Name()]; !ok {
+			idx.names[entry.Name()] = entry
+		}
+	}
+	return idx
+}
+
+var hpackStaticIndex = newStaticIndex(hpackStaticTable)
+var qpackStaticIndex = newStaticIndex(qpackStaticTable)
+
+// dynamicEntries is a ring buffer of dynamic table entries.  Index 0 is the
+// most recently inserted entry.
+type dynamicEntries struct {
+	ring  []DynamicEntry
+	head  int
+	count int
+}
+
+func (d *dynamicEntries) len() int {
+	return d.count
+}
+
+func (d *dynamicEntries) get(i int) DynamicEntry {
+	return d.ring[(d.head+i)%len(d.ring)]
+}
+
+// push adds a new entry at index 0, growing the buffer if it is full.
+func (d *dynamicEntries) push(entry DynamicEntry) {
+	if d.count == len(d.ring) {
+		size := 2 * len(d.ring)
+		if size < 16 {
+			size = 16
+		}
+		ring := make([]DynamicEntry, size)
+		for i := 0; i < d.count; i++ {
+			ring[i] = d.get(i)
+		}
+		d.ring = ring
+		d.head = 0
+	}
+	d.head = (d.head + len(d.ring) - 1) % len(d.ring)
+	d.ring[d.head] = entry
+	d.count++
+}
+
+// removeOldest takes the entry with the highest index off the end.
+func (d *dynamicEntries) removeOldest() DynamicEntry {
+	d.count--
+	i := (d.head + d.count) % len(d.ring)
+	entry := d.ring[i]
+	d.ring[i] = nil
+	return entry
+}
+
+// dynamicIndex finds dynamic table entries by name, or by name and value.
+// Each list is in the order of insertion, so the oldest entry is first.
+type dynamicIndex struct {
+	fields map[fieldKey][]DynamicEntry
+	names  map[string][]DynamicEntry
+}
+
+func (idx *dynamicIndex) add(entry DynamicEntry) {
+	if idx.fields == nil {
+		idx.fields = make(map[fieldKey][]DynamicEntry)
+		idx.names = make(map[string][]DynamicEntry)
+	}
+	key := fieldKey{entry.Name(), entry.Value()}
+	idx.fields[key] = append(idx.fields[key], entry)
+	idx.names[entry.Name()] = append(idx.names[entry.Name()], entry)
+}
+
+// removeFrom takes an entry out of a list.  Entries are evicted in the order
+// they are inserted, so the entry is almost always first.
+func removeFrom(list []DynamicEntry, entry DynamicEntry) []DynamicEntry {
+	if len(list) > 0 && list[0] == entry {
+		return list[1:]
+	}
+	for i := range list {
+		if list[i] == entry {
+			return append(list[:i:i], list[i+1:]...)
+		}
+	}
+	return list
+}
+
+func (idx *dynamicIndex) remove(entry DynamicEntry) {
+	key := fieldKey{entry.Name(), entry.Value()}
+	if list := removeFrom(idx.fields[key], entry); len(list) > 0 {
+		idx.fields[key] = list
+	} else {
+		delete(idx.fields, key)
+	}
+	if list := removeFrom(idx.names[entry.Name()], entry); len(list) > 0 {
+		idx.names[entry.Name()] = list
+	} else {
+		delete(idx.names, entry.Name())
+	}
+}
+
+// newest finds the most recent entry in the list with a base in the range
+// (low, high].
+func newest(list []DynamicEntry, low int, high int) DynamicEntry {
+	for i := len(list) - 1; i >= 0; i-- {
+		b := list[i].Base()
+		if b <= low {
+			break
+		}
+		if b <= high {
+			return list[i]
+		}
+	}
+	return nil
+}
+
 // Table holds dynamic entries and accounting for space.
 type tableCommon struct {
-	dynamic []DynamicEntry
+	dynamic dynamicEntries
+	index   dynamicIndex
 	// The total capacity (in HPACK bytes) of the table. This is set by
 	// configuration.
 	capacity TableCapacity
@@ -97,6 +243,8 @@ type tableCommon struct {
 	used TableCapacity
 	// The total number of inserts thus far.
 	base int
+	// The total number of evictions thus far.
+	evictions uint64
 	// Retrieve a static table entry.
 	getStatic func(int) Entry
 }
@@ -113,28 +261,40 @@ func (table *tableCommon) GetDynamic(i int, base int) DynamicEntry {
 		return nil
 	}
 	dynIndex := i + delta
-	if dynIndex >= len(table.dynamic) || dynIndex < 0 {
+	if dynIndex >= table.dynamic.len() || dynIndex < 0 {
 		return nil
 	}
-	return table.dynamic[dynIndex]
+	return table.dynamic.get(dynIndex)
 }
 
 // Evict entries until the used capacity is less than the reduced capacity.
 func (table *tableCommon) evictTo(reduced TableCapacity, evict evictionCheck) bool {
-	l := len(table.dynamic)
+	l := table.dynamic.len()
 	used := table.used
 	for l > 0 && used > reduced {
 		l--
-		if evict != nil && !evict.CanEvict(table.dynamic[l]) {
+		if evict != nil && !evict.CanEvict(table.dynamic.get(l)) {
 			return false
 		}
-		used -= table.dynamic[l].Size()
+		used -= table.dynamic.get(l).Size()
+	}
+	observer, _ := evict.(evictionObserver)
+	for table.dynamic.len() > l {
+		entry := table.dynamic.removeOldest()
+		table.index.remove(entry)
+		table.evictions++
+		if observer != nil {
+			observer.Evicted(entry)
+		}
 	}
-	table.dynamic = table.dynamic[0:l]
 	table.used = used
 	return true
 }
 
+func (table *tableCommon) evictionCount() uint64 {
+	return table.evictions
+}
+
 // SetCapacity increases or reduces capacity to the set target.
 func (table *tableCommon) SetCapacity(capacity TableCapacity) {
 	table.evictTo(capacity, nil)
@@ -144,10 +304,7 @@ func (table *tableCommon) SetCapacity(capacity TableCapacity) {
 // Insert an entry into the table.  Return nil if the entry couldn't be added.
 func (table *tableCommon) insert(entry DynamicEntry, evict evictionCheck) bool {
 	if entry.Size() > table.capacity {
-		if table.evictTo(0, evict) {
-			table.dynamic = table.dynamic[0:0]
-			table.used = 0
-		}
+		table.evictTo(0, evict)
 		return false
 	}
 
@@ -157,14 +314,8 @@ func (table *tableCommon) insert(entry DynamicEntry, evict evictionCheck) bool {
 
 	table.base++
 	entry.setBase(table.base)
-
-	// TODO This is grossly inefficient. Indexing from the other end might be less
-	// bad, especially if the underlying array is made a little bigger than needed
-	// when resizing.
-	tmp := make([]DynamicEntry, len(table.dynamic)+1)
-	copy(tmp[1:], table.dynamic)
-	tmp[0] = entry
-	table.dynamic = tmp
+	table.dynamic.push(entry)
+	table.index.add(entry)
 	table.used += entry.Size()
 	return true
 }
@@ -179,27 +330,23 @@ func (table *tableCommon) Used() TableCapacity {
 	return table.used
 }
 
-func (table *tableCommon) lookupImpl(staticTable []staticTableEntry, name string, value string, dynamicMin int, dynamicMax int) (Entry, Entry) {
-	var nameMatch Entry
-	for _, entry := range staticTable {
-		if entry.Name() == name {
-			if entry.Value() == value {
-				return entry, entry
-			}
-			if nameMatch == nil {
-				nameMatch = entry
-			}
-		}
+// lookupImpl finds a match in the static table, or in the dynamic table
+// between the two indices.  Static matches are preferred, then the most recent
+// dynamic entry.
+func (table *tableCommon) lookupImpl(static *staticIndex, name string, value string, dynamicMin int, dynamicMax int) (Entry, Entry) {
+	if match := static.fields[fieldKey{name, value}]; match != nil {
+		return match, match
 	}
-	for _, entry := range table.dynamic[dynamicMin:dynamicMax] {
-		if entry.Name() == name {
-			if entry.Value() == value {
-				return entry, entry
-			}
-			if nameMatch == nil {
-				nameMatch = entry
-			}
-		}
+	low := table.base - dynamicMax
+	high := table.base - dynamicMin
+	if match := newest(table.index.fields[fieldKey{name, value}], low, high); match != nil {
+		return match, match
+	}
+	if nameMatch := static.names[name]; nameMatch != nil {
+		return nil, nameMatch
+	}
+	if nameMatch := newest(table.index.names[name], low, high); nameMatch != nil {
+		return nil, nameMatch
 	}
-	return nil, nameMatch
+	return nil, nil
 }
@@ -1,6 +1,8 @@
 package hc_test
 
 import (
+	"fmt"
+	"io/ioutil"
 	"testing"
 
 	"github.com/martinthomson/minhq/hc"
@@ -99,3 +101,92 @@ func TestLookupStatic(t *testing.T) {
 	assert.Nil(t, m)
 	assert.Equal(t, 2, nm.Base())
 }
+
+func TestLookupManyEntries(t *testing.T) {
+	var table hc.HpackTable
+	// Room for 50 entries, so the table wraps around several times.
+	table.SetCapacity(50 * 44)
+	var entries []hc.DynamicEntry
+	for i := 0; i < 200; i++ {
+		entries = append(entries, table.Insert(fmt.Sprintf("name%02d", i%100), fmt.Sprintf("val%03d", i), nil))
+	}
+
+	for i, e := range entries {
+		m, nm := table.Lookup(e.Name(), e.Value())
+		if i < 150 {
+			assert.Nil(t, m)
+		} else {
+			assert.Equal(t, e, m)
+			assert.Equal(t, e, table.Get(table.Index(e)))
+		}
+		if i%100 < 50 {
+			assert.Nil(t, nm)
+		} else {
+			// The newest entry with the same name.
+			assert.Equal(t, entries[100+i%100], nm)
+		}
+	}
+}
+
+func TestLookupNewestDuplicate(t *testing.T) {
+	var table hc.HpackTable
+	table.SetCapacity(300)
+	table.Insert("name", "value", nil)
+	second := table.Insert("name", "value", nil)
+	m, _ := table.Lookup("name", "value")
+	assert.Equal(t, second, m)
+}
+
+// benchmarkFields makes header fields that fill a 64KB table with hundreds of
+// entries.
+func benchmarkFields() []hc.HeaderField {
+	fields := make([]hc.HeaderField, 500)
+	for i := range fields {
+		fields[i] = hc.HeaderField{
+			Name:  fmt.Sprintf("x-field-%d", i%50),
+			Value: fmt.Sprintf("%090d", i),
+		}
+	}
+	return fields
+}
+
+func BenchmarkHpackEncode(b *testing.B) {
+	fields := benchmarkFields()
+	encoder := hc.NewHpackEncoder(65536)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := (i * 7) % (len(fields) - 20)
+		err := encoder.WriteHeaderBlock(ioutil.Discard, fields[start:start+20]...)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkQpackEncode(b *testing.B) {
+	fields := benchmarkFields()
+	encoder := hc.NewQpackEncoder(ioutil.Discard, 65536, 65536)
+	encoder.SetMaxBlockedStreams(100)
+	base := 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := (i * 7) % (len(fields) - 20)
+		id := uint64(i)
+		err := encoder.WriteHeaderBlock(ioutil.Discard, id, fields[start:start+20]...)
+		if err != nil {
+			b.Fatal(err)
+		}
+		// Acknowledge everything so that the whole table can be used.
+		if encoder.Table.Base() > base {
+			err = encoder.AcknowledgeInsert(encoder.Table.Base() - base)
+			if err != nil {
+				b.Fatal(err)
+			}
+			base = encoder.Table.Base()
+		}
+		err = encoder.AcknowledgeHeader(id)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
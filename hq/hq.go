@@ -4,7 +4,11 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/martinthomson/minhq"
 	"github.com/martinthomson/minhq/hc"
@@ -14,6 +18,8 @@ type serverArguments struct {
 	Address  string
 	CertFile string
 	KeyFile  string
+	Shards   int
+	TCP      string
 }
 
 type clientArguments struct {
@@ -45,15 +51,23 @@ func (a *commandLine) exit(msg string) {
 }
 
 func (a *commandLine) parseServer(params []string) {
-	a.fs.Usage = func() {
-		a.print("Usage: %s [...] server <address:port> <cert> <key>", a.fs.Name())
+	a.usage = "server <address:port> <cert> <key>"
+	var args serverArguments
+	fs := flag.NewFlagSet(a.fs.Name()+" server", flag.ExitOnError)
+	fs.Usage = func() {
+		a.print("Usage: %s [...] server [flags] <address:port[,address:port...]> <cert> <key>", a.fs.Name())
+		fs.PrintDefaults()
 	}
-	if len(params) < 3 {
+	fs.IntVar(&args.Shards, "n", 1, "number of service loops")
+	fs.StringVar(&args.TCP, "tcp", "", "also listen on this TCP address and advertise Alt-Svc")
+	fs.Parse(params)
+	if fs.NArg() < 3 {
 		a.exit("missing arguments")
-		a.print("Usage: %s [...] server <address:port> <cert> <key>")
-
 	}
-	a.args = &serverArguments{params[0], params[1], params[2]}
+	args.Address = fs.Arg(0)
+	args.CertFile = fs.Arg(1)
+	args.KeyFile = fs.Arg(2)
+	a.args = &args
 }
 
 func (a *commandLine) parseClient(params []string) {
@@ -163,6 +177,9 @@ func runClient(config *minhq.Config, args *clientArguments) {
 		go sendFile(request, args.File)
 
 		response := request.Response()
+		if response == nil {
+			die("reading response", minhq.ErrNoResponse)
+		}
 		fmt.Println(response)
 		fmt.Println("[[[")
 		_, err = io.Copy(os.Stdout, response)
@@ -175,7 +192,9 @@ func runClient(config *minhq.Config, args *clientArguments) {
 }
 
 func runServer(config *minhq.Config, args *serverArguments) {
-	server, err := minhq.Listen(args.Address, args.CertFile, args.KeyFile, config)
+	config.ServerShards = args.Shards
+	addresses := strings.Split(args.Address, ",")
+	server, err := minhq.ListenAll(addresses, args.CertFile, args.KeyFile, config)
 	if err != nil {
 		die("starting server", err)
 	}
@@ -183,6 +202,9 @@ func runServer(config *minhq.Config, args *serverArguments) {
 		for <-server.Connections != nil {
 		}
 	}()
+	if args.TCP != "" {
+		go runTCPServer(args, addresses[0])
+	}
 
 	for {
 		req := <-server.Requests
@@ -211,3 +233,24 @@ func runServer(config *minhq.Config, args *serverArguments) {
 		}
 	}
 }
+
+// runTCPServer runs a TCP server that advertises the HTTP over QUIC server
+// with Alt-Svc.
+func runTCPServer(args *serverArguments, quicAddress string) {
+	_, port, err := net.SplitHostPort(quicAddress)
+	if err != nil {
+		die("parsing address", err)
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		die("parsing port", err)
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "hq")
+		fmt.Fprintf(w, "%s %s\n", r.Method, r.URL)
+	})
+	alt := minhq.AltSvc{Protocol: "hq", Port: portNumber}
+	err = http.ListenAndServeTLS(args.TCP, args.CertFile, args.KeyFile,
+		minhq.AltSvcHandler(handler, alt))
+	die("running TCP server", err)
+}
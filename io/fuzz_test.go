@@ -0,0 +1,92 @@
+//go:build go1.18
+// +build go1.18
+
+package io_test
+
+import (
+	"bytes"
+	"testing"
+
+	bitio "github.com/martinthomson/minhq/io"
+)
+
+// readBitsSlowly reads count bits starting at bit offset from p, one bit at a
+// time.  This returns false if there aren't enough bits.
+func readBitsSlowly(p []byte, offset int, count byte) (uint64, bool) {
+	if offset+int(count) > len(p)*8 {
+		return 0, false
+	}
+	v := uint64(0)
+	for i := offset; i < offset+int(count); i++ {
+		v = (v << 1) | uint64((p[i/8]>>(7-uint(i%8)))&1)
+	}
+	return v, true
+}
+
+func FuzzBitReader(f *testing.F) {
+	f.Add([]byte{0x40, 0xaa, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+		0x3f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xe0},
+		[]byte{1, 1, 7, 7, 64, 3, 64, 5})
+	f.Fuzz(func(t *testing.T, input []byte, counts []byte) {
+		reader := bitio.NewBitReader(bytes.NewReader(input))
+		offset := 0
+		for _, c := range counts {
+			count := c % 65
+			v, err := reader.ReadBits(count)
+			expected, ok := readBitsSlowly(input, offset, count)
+			if !ok {
+				// Reads past the end fail, and leave the reader in an
+				// unspecified state.
+				if err == nil {
+					t.Fatalf("read %v bits past the end", count)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v != expected {
+				t.Fatalf("read %x at %v, expected %x", v, offset, expected)
+			}
+			offset += int(count)
+		}
+	})
+}
+
+func FuzzBitWriterRoundTrip(f *testing.F) {
+	f.Add(uint64(1), byte(1), uint64(0x55), byte(7), ^uint64(0), byte(64))
+	f.Fuzz(func(t *testing.T, v1 uint64, c1 byte, v2 uint64, c2 byte, v3 uint64, c3 byte) {
+		values := []uint64{v1, v2, v3}
+		counts := []byte{c1 % 65, c2 % 65, c3 % 65}
+		// WriteBits rejects values that don't fit.
+		for i := range values {
+			if counts[i] < 64 {
+				values[i] &= (1 << counts[i]) - 1
+			}
+		}
+
+		var buf bytes.Buffer
+		writer := bitio.NewBitWriter(&buf)
+		for i := range values {
+			err := writer.WriteBits(values[i], counts[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := writer.Pad(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reader := bitio.NewBitReader(&buf)
+		for i := range values {
+			v, err := reader.ReadBits(counts[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v != values[i] {
+				t.Fatalf("read %x, expected %x", v, values[i])
+			}
+		}
+	})
+}
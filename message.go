@@ -7,6 +7,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/martinthomson/minhq/hc"
 	bitio "github.com/martinthomson/minhq/io"
@@ -35,6 +36,24 @@ func buildRequestHeaderFields(method string, base *url.URL, target string, heade
 	}, headers...), nil
 }
 
+// markSensitive marks header fields with names in the sensitive set.  This
+// makes a copy of the header fields if any need to be changed.
+func markSensitive(headers []hc.HeaderField, sensitive map[string]bool) []hc.HeaderField {
+	marked := headers
+	copied := false
+	for i, h := range headers {
+		if h.Sensitive || !sensitive[strings.ToLower(h.Name)] {
+			continue
+		}
+		if !copied {
+			marked = append([]hc.HeaderField(nil), headers...)
+			copied = true
+		}
+		marked[i].Sensitive = true
+	}
+	return marked
+}
+
 type headerFieldArray []hc.HeaderField
 
 func (a headerFieldArray) String() string {
@@ -55,18 +74,7 @@ func (a headerFieldArray) String() string {
 // This returns an empty string if the header field wasn't present.
 // Multiple values are concatenated using commas.
 func (a headerFieldArray) GetHeader(n string) string {
-	v := ""
-	for _, h := range a {
-		// Incoming messages have all lowercase names.
-		if h.Name == strings.ToLower(n) {
-			if len(v) > 0 {
-				v += "," + h.Value
-			} else {
-				v = h.Value
-			}
-		}
-	}
-	return v
+	return hc.GetHeader(a, n)
 }
 
 // GetStatus returns the status from the header block, or 0 if it's not there or badly formed.
@@ -123,6 +131,18 @@ type IncomingMessage struct {
 	reader   *bitio.ConcatenatingReader
 	Trailers <-chan []hc.HeaderField
 	trailers chan<- []hc.HeaderField
+
+	// block is what header blocks on this message are decoded into.  This
+	// comes from headerBlocks and is returned once the message is complete.
+	block *hc.HeaderBlock
+}
+
+// headerBlocks recycles the blocks that header blocks are decoded into, so that
+// space for header fields and strings is reused from one message to the next.
+var headerBlocks = sync.Pool{
+	New: func() interface{} {
+		return new(hc.HeaderBlock)
+	},
 }
 
 func newIncomingMessage(s *recvStream, decoder *hc.QpackDecoder, headers []hc.HeaderField) IncomingMessage {
@@ -146,6 +166,7 @@ func (msg *IncomingMessage) handleMessage(headersHandler initialHeadersHandler,
 	frameHandler incomingMessageFrameHandler) error {
 	defer close(msg.trailers)
 	defer msg.reader.Close()
+	defer msg.releaseBlock()
 
 	err := func() error {
 		gotFirstHeaders := false
@@ -170,7 +191,7 @@ func (msg *IncomingMessage) handleMessage(headersHandler initialHeadersHandler,
 				msg.reader.AddReader(r)
 
 			case frameHeaders:
-				headers, err := msg.decoder.ReadHeaderBlock(r, msg.s.Id())
+				headers, err := msg.readHeaders(r)
 				if err != nil {
 					return err
 				}
@@ -203,6 +224,27 @@ func (msg *IncomingMessage) handleMessage(headersHandler initialHeadersHandler,
 	return err
 }
 
+// readHeaders decodes a header block.  The block is reused, so the header
+// fields are copied out.  The strings in them don't need to be copied.
+func (msg *IncomingMessage) readHeaders(r io.Reader) (headerFieldArray, error) {
+	if msg.block == nil {
+		msg.block = headerBlocks.Get().(*hc.HeaderBlock)
+	}
+	err := msg.decoder.ReadHeaderBlockInto(r, msg.s.Id(), msg.block)
+	if err != nil {
+		return nil, err
+	}
+	return append(headerFieldArray(nil), msg.block.Fields...), nil
+}
+
+// releaseBlock returns the block to headerBlocks.
+func (msg *IncomingMessage) releaseBlock() {
+	if msg.block != nil {
+		headerBlocks.Put(msg.block)
+		msg.block = nil
+	}
+}
+
 // GetHeader performs a case-insensitive lookup for a given name.
 // This returns an empty string if the header field wasn't present.
 // Multiple values are concatenated using commas.
@@ -215,6 +257,10 @@ func (msg *IncomingMessage) String() string {
 	return msg.Headers.String()
 }
 
+// ErrNoStream is returned when writing to a request that was answered by a
+// push, which doesn't have a stream.
+var ErrNoStream = errors.New("message has no stream")
+
 // OutgoingMessage contains the common parts of outgoing messages (requests for
 // clients, responses for servers).
 type OutgoingMessage struct {
@@ -224,15 +270,18 @@ type OutgoingMessage struct {
 
 	// encoder is needed for encoding trailers (ugh)
 	encoder *hc.QpackEncoder
+	// sensitive is the set of names that are marked as sensitive.
+	sensitive map[string]bool
 }
 
 var _ io.WriteCloser = &OutgoingMessage{}
 
 func newOutgoingMessage(c *connection, s *sendStream, headers []hc.HeaderField) OutgoingMessage {
 	return OutgoingMessage{
-		headers: headers,
-		s:       s,
-		encoder: c.encoder,
+		headers:   headers,
+		s:         s,
+		encoder:   c.encoder,
+		sensitive: c.sensitive,
 	}
 }
 
@@ -243,6 +292,9 @@ func (msg *OutgoingMessage) Headers() []hc.HeaderField {
 
 // Write fulfils the io.Writer contract.
 func (msg *OutgoingMessage) Write(p []byte) (int, error) {
+	if msg.s == nil {
+		return 0, ErrNoStream
+	}
 	// Note that WriteFrame always uses the entire input array, and it reports
 	// how much it wrote, not how much it used.  It always uses the entire
 	// input array.  That's not the io.Writer contract, so adapt.
@@ -256,7 +308,8 @@ func (msg *OutgoingMessage) Write(p []byte) (int, error) {
 func (msg *OutgoingMessage) writeHeaderBlock(headers []hc.HeaderField) error {
 	// TODO: ensure that header blocks are properly dropped if the stream is reset.
 	var headerBuf bytes.Buffer
-	err := msg.encoder.WriteHeaderBlock(&headerBuf, msg.s.Id(), headers...)
+	err := msg.encoder.WriteHeaderBlock(&headerBuf, msg.s.Id(),
+		markSensitive(headers, msg.sensitive)...)
 	if err != nil {
 		return err
 	}
@@ -266,7 +319,7 @@ func (msg *OutgoingMessage) writeHeaderBlock(headers []hc.HeaderField) error {
 
 // End closes out the stream, writing any trailers that might be included.
 func (msg *OutgoingMessage) End(trailers []hc.HeaderField) error {
-	if trailers != nil {
+	if trailers != nil && msg.s != nil {
 		err := msg.writeHeaderBlock(trailers)
 		if err != nil {
 			return err
@@ -277,6 +330,9 @@ func (msg *OutgoingMessage) End(trailers []hc.HeaderField) error {
 
 // Close allows OutgoingMessage to implement io.WriteCloser.
 func (msg *OutgoingMessage) Close() error {
+	if msg.s == nil {
+		return nil
+	}
 	return msg.s.Close()
 }
 
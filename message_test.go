@@ -0,0 +1,104 @@
+package minhq
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ekr/minq"
+	"github.com/martinthomson/minhq/hc"
+	"github.com/stvp/assert"
+)
+
+// readerStream is a minq.RecvStream that reads from a bytes.Reader.
+type readerStream struct {
+	*bytes.Reader
+}
+
+func (s readerStream) Id() uint64                      { return 0 }
+func (s readerStream) RecvState() minq.RecvStreamState { return 0 }
+func (s readerStream) StopSending(code uint16) error   { return nil }
+
+// discardCloser accepts and discards acknowledgments from a decoder.
+type discardCloser struct{}
+
+func (discardCloser) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (discardCloser) Close() error {
+	return nil
+}
+
+// headerFrames encodes each set of header fields into a HEADERS frame.  Only
+// the static table is used, so any decoder can read these.
+func headerFrames(tb testing.TB, blocks ...[]hc.HeaderField) []byte {
+	encoder := hc.NewQpackEncoder(discardCloser{}, 0, 0)
+	var frames bytes.Buffer
+	fw := NewFrameWriter(&frames)
+	for i, headers := range blocks {
+		var encoded bytes.Buffer
+		err := encoder.WriteHeaderBlock(&encoded, uint64(i), headers...)
+		assert.Nil(tb, err)
+		_, err = fw.WriteFrame(frameHeaders, encoded.Bytes())
+		assert.Nil(tb, err)
+	}
+	return frames.Bytes()
+}
+
+func TestIncomingMessageTrailers(t *testing.T) {
+	frames := headerFrames(t,
+		[]hc.HeaderField{{Name: ":status", Value: "200"}, {Name: "x-header", Value: "one"}},
+		[]hc.HeaderField{{Name: "x-trailer", Value: "two"}})
+	decoder := hc.NewQpackDecoder(discardCloser{}, 0)
+	defer decoder.Close()
+
+	s := newRecvStream(readerStream{bytes.NewReader(frames)})
+	msg := newIncomingMessage(s, decoder, nil)
+	done := make(chan error)
+	go func() {
+		done <- msg.handleMessage(func(headers headerFieldArray) (bool, error) {
+			msg.Headers = headers
+			return true, nil
+		}, nil)
+	}()
+
+	trailers := <-msg.Trailers
+	assert.Nil(t, <-done)
+	assert.Equal(t, []hc.HeaderField{{Name: "x-trailer", Value: "two"}}, trailers)
+	// Decoding the trailers doesn't disturb the header fields.
+	assert.Equal(t, headerFieldArray{{Name: ":status", Value: "200"}, {Name: "x-header", Value: "one"}},
+		msg.Headers)
+	assert.Nil(t, msg.block)
+}
+
+// BenchmarkIncomingMessage measures the allocations made when the header block
+// of a response is received.
+func BenchmarkIncomingMessage(b *testing.B) {
+	frames := headerFrames(b, []hc.HeaderField{
+		{Name: ":status", Value: "200"},
+		{Name: "content-type", Value: "text/html; charset=utf-8"},
+		{Name: "content-length", Value: "12345"},
+		{Name: "cache-control", Value: "max-age=3600"},
+		{Name: "date", Value: "Mon, 19 Oct 2026 00:00:00 GMT"},
+		{Name: "etag", Value: "\"5f3e2a1b\""},
+		{Name: "server", Value: "minhq"},
+		{Name: "vary", Value: "accept-encoding"},
+		{Name: "x-request-id", Value: "0123456789abcdef"},
+	})
+	decoder := hc.NewQpackDecoder(discardCloser{}, 0)
+	defer decoder.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := newRecvStream(readerStream{bytes.NewReader(frames)})
+		msg := newIncomingMessage(s, decoder, nil)
+		err := msg.handleMessage(func(headers headerFieldArray) (bool, error) {
+			msg.Headers = headers
+			return true, nil
+		}, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
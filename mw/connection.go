@@ -1,19 +1,12 @@
 package mw
 
 import (
-	"net"
+	"sync"
 	"time"
 
 	"github.com/ekr/minq"
 )
 
-// Packet represents a UDP packet.  It has addresses and a payload.
-type Packet struct {
-	DestAddr *net.UDPAddr
-	SrcAddr  *net.UDPAddr
-	Data     []byte
-}
-
 // Connection is an async wrapper around minq.Connection
 type Connection struct {
 	minq *minq.Connection
@@ -24,19 +17,25 @@ type Connection struct {
 	connected    chan<- struct{}
 	closed       chan struct{}
 	// RemoteStreams is an unbuffered channel of streams created by a peer.
+	// This is closed when the connection closes.
 	RemoteStreams <-chan minq.Stream
-	remoteStreams chan<- minq.Stream
 	// RemoteRecvStreams is an unbuffered channel of unidirectional streams created by a peer.
+	// This is closed when the connection closes.
 	RemoteRecvStreams <-chan minq.RecvStream
-	remoteRecvStreams chan<- minq.RecvStream
+	// These queues hold streams until they can be passed to the channels above.
+	streamQueue     *upcallQueue
+	recvStreamQueue *upcallQueue
 	// IncomingPackets are packets that arrive at the connection.
 	IncomingPackets chan<- *Packet
 
 	readState map[minq.RecvStream]*readRequest
 	ops       *connectionOperations
+	// timers is shared with other connections on the same server.
+	timers *timerWheel
+	timer  *timerEntry
 }
 
-func newConnection(mc *minq.Connection, ops *connectionOperations) *Connection {
+func newConnection(mc *minq.Connection, ops *connectionOperations, timers *timerWheel) *Connection {
 	connected := make(chan struct{})
 	streams := make(chan minq.Stream)
 	recvStreams := make(chan minq.RecvStream)
@@ -46,21 +45,25 @@ func newConnection(mc *minq.Connection, ops *connectionOperations) *Connection {
 		connected:         connected,
 		closed:            make(chan struct{}),
 		RemoteStreams:     streams,
-		remoteStreams:     streams,
 		RemoteRecvStreams: recvStreams,
-		remoteRecvStreams: recvStreams,
+		streamQueue:       newUpcallQueue(),
+		recvStreamQueue:   newUpcallQueue(),
 
 		readState: make(map[minq.RecvStream]*readRequest),
 		ops:       ops,
+		timers:    timers,
 	}
+	c.timer = newTimerEntry(c.checkTimer)
 	mc.SetHandler(c)
+	go c.deliverStreams(streams)
+	go c.deliverRecvStreams(recvStreams)
 	return c
 }
 
 // NewConnection makes a new client connection.
 func NewConnection(mc *minq.Connection) *Connection {
 	ops := newConnectionOperations()
-	c := newConnection(mc, ops)
+	c := newConnection(mc, ops, newTimerWheel(DefaultTimerGranularity))
 	// Only clients need to handle packets directly. Server handles routing of
 	// incoming packets for servers.
 	incoming := make(chan *Packet)
@@ -73,11 +76,11 @@ func NewConnection(mc *minq.Connection) *Connection {
 // connection doesn't accept incoming packets from Connection.IncomingPackets
 // (that is set to nil), because the expectation is that packets will be passed
 // to the server.
-func newServerConnection(mc *minq.Connection, ops *connectionOperations) *Connection {
+func newServerConnection(mc *minq.Connection, ops *connectionOperations, timers *timerWheel) *Connection {
 	if mc.Role() != minq.RoleServer {
 		panic("minq.Server spat out a client")
 	}
-	return newConnection(mc, ops)
+	return newConnection(mc, ops, timers)
 }
 
 // Service is intended to be run as a goroutine. This is the only goroutine that
@@ -85,8 +88,7 @@ func newServerConnection(mc *minq.Connection, ops *connectionOperations) *Connec
 func (c *Connection) service(incoming <-chan *Packet) {
 	defer c.cleanup()
 
-	ticker := time.NewTicker(50 * time.Millisecond)
-	defer ticker.Stop()
+	c.updateTimer()
 	for {
 		switch c.minq.GetState() {
 		case minq.StateClosed, minq.StateError:
@@ -96,23 +98,97 @@ func (c *Connection) service(incoming <-chan *Packet) {
 		case op := <-c.ops.ch:
 			c.ops.Handle(op)
 		case p := <-incoming:
-			_ = c.minq.Input(p.Data)
-		case <-ticker.C:
-			c.minq.CheckTimer()
+			_ = c.minq.Input(p.take())
+		case now := <-c.timers.C():
+			c.timers.expire(now)
+			continue
 		}
+		c.updateTimer()
+	}
+}
+
+// nextDeadline works out when the timer for this connection needs to be
+// checked.  minq doesn't say when its timers expire, so this is the next slot
+// of the timer wheel for as long as the connection is open.
+func (c *Connection) nextDeadline(now time.Time) time.Time {
+	switch c.minq.GetState() {
+	case minq.StateClosed, minq.StateError:
+		return time.Time{}
 	}
+	return now.Add(c.timers.granularity)
+}
+
+// checkTimer is called when the timer for the connection expires.
+func (c *Connection) checkTimer(now time.Time) time.Time {
+	c.minq.CheckTimer()
+	return c.nextDeadline(now)
+}
+
+// updateTimer is called after something happens to the connection, which
+// might cause minq to set a new timer.
+func (c *Connection) updateTimer() {
+	c.timers.schedule(c.timer, c.nextDeadline(time.Now()))
+}
+
+// SetTimerGranularity changes the granularity of timers.  For a server
+// connection, this affects all connections on the same server.
+func (c *Connection) SetTimerGranularity(d time.Duration) error {
+	result := make(chan error)
+	c.ops.Add(&setTimerGranularityRequest{c.timers, d, reportErrorChannel{result}})
+	return <-result
 }
 
 func (c *Connection) cleanup() {
+	c.timers.remove(c.timer)
 	c.ops.Close()
+	// Close this before connected so that anything waiting for connected can
+	// tell that the connection failed.
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
 	if !c.wasConnected {
 		close(c.connected)
 	}
-	close(c.remoteStreams)
+	c.streamQueue.close()
+	c.recvStreamQueue.close()
+}
+
+// deliverStreams passes new streams from the queue to the RemoteStreams channel.
+// This is the only goroutine that writes to that channel, so it closes the
+// channel when the queue is closed.
+func (c *Connection) deliverStreams(streams chan<- minq.Stream) {
+	defer close(streams)
+	for {
+		s, ok := c.streamQueue.next()
+		if !ok {
+			return
+		}
+		select {
+		case streams <- s.(minq.Stream):
+		case <-c.closed:
+		}
+	}
 }
 
-// Note: each signal/upcall from minq uses a goroutine so that the main
-// goroutine doesn't block on any of these operations.
+// deliverRecvStreams is the same as deliverStreams, but for RemoteRecvStreams.
+func (c *Connection) deliverRecvStreams(recvStreams chan<- minq.RecvStream) {
+	defer close(recvStreams)
+	for {
+		s, ok := c.recvStreamQueue.next()
+		if !ok {
+			return
+		}
+		select {
+		case recvStreams <- s.(minq.RecvStream):
+		case <-c.closed:
+		}
+	}
+}
+
+// Note: signals/upcalls from minq must not block the main goroutine.  New
+// streams are added to a queue, which is drained by a dedicated goroutine.
 
 // StateChanged is required by the minq.ConnectionHandler interface.
 func (c *Connection) StateChanged(s minq.State) {
@@ -122,21 +198,19 @@ func (c *Connection) StateChanged(s minq.State) {
 		close(c.connected)
 	case minq.StateClosed, minq.StateError:
 		close(c.closed)
+		c.streamQueue.close()
+		c.recvStreamQueue.close()
 	}
 }
 
 // NewStream is required by the minq.ConnectionHandler interface.
 func (c *Connection) NewStream(s minq.Stream) {
-	go func() {
-		c.remoteStreams <- &Stream{SendStream{c, s}, RecvStream{c, s}}
-	}()
+	c.streamQueue.push(&Stream{SendStream{c, s}, RecvStream{c, s}})
 }
 
 // NewRecvStream is required by the minq.ConnectionHandler interface.
 func (c *Connection) NewRecvStream(s minq.RecvStream) {
-	go func() {
-		c.remoteRecvStreams <- &RecvStream{c, s}
-	}()
+	c.recvStreamQueue.push(&RecvStream{c, s})
 }
 
 // StreamReadable is required by the minq.ConnectionHandler interface.
@@ -162,6 +236,12 @@ func (c *Connection) handleReadRequest(req *readRequest) {
 	}
 }
 
+// Closed returns a channel that is closed when the connection closes or
+// fails.  This includes connections that fail before they are established.
+func (c *Connection) Closed() <-chan struct{} {
+	return c.closed
+}
+
 // GetState returns the current connection of the connection.
 func (c *Connection) GetState() minq.State {
 	state := make(chan minq.State)
@@ -196,3 +276,56 @@ func (c *Connection) CreateSendStream() minq.SendStream {
 	s := <-result
 	return s
 }
+
+// upcallQueue holds values from upcalls until a consumer is ready for them.
+// This is unbounded, but it only needs a single goroutine to drain it, rather
+// than one goroutine for every upcall.
+type upcallQueue struct {
+	lock   sync.Mutex
+	ready  *sync.Cond
+	items  []interface{}
+	closed bool
+}
+
+func newUpcallQueue() *upcallQueue {
+	q := &upcallQueue{}
+	q.ready = sync.NewCond(&q.lock)
+	return q
+}
+
+// push adds an item to the queue.  Items are dropped if the queue is closed.
+func (q *upcallQueue) push(v interface{}) {
+	defer q.lock.Unlock()
+	q.lock.Lock()
+	if q.closed {
+		return
+	}
+	q.items = append(q.items, v)
+	q.ready.Signal()
+}
+
+// next waits for an item.  This returns false when the queue is closed.
+func (q *upcallQueue) next() (interface{}, bool) {
+	defer q.lock.Unlock()
+	q.lock.Lock()
+	for len(q.items) == 0 && !q.closed {
+		q.ready.Wait()
+	}
+	if q.closed {
+		return nil, false
+	}
+	v := q.items[0]
+	q.items[0] = nil
+	q.items = q.items[1:]
+	return v, true
+}
+
+// close causes next to return false.  Any remaining items are discarded.
+// This can be called multiple times.
+func (q *upcallQueue) close() {
+	defer q.lock.Unlock()
+	q.lock.Lock()
+	q.closed = true
+	q.items = nil
+	q.ready.Broadcast()
+}
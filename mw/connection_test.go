@@ -2,6 +2,7 @@ package mw_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/martinthomson/minhq/mw"
 	"github.com/martinthomson/minhq/mw/test"
@@ -27,3 +28,128 @@ func TestConnect(t *testing.T) {
 	assert.Equal(t, 3, n)
 	assert.Equal(t, out, in)
 }
+
+func TestRemoteStreamsClosed(t *testing.T) {
+	cs := test.NewClientServerPair(mw.RunServer, nil)
+	defer cs.Close()
+
+	assert.Nil(t, cs.ClientConnection.Close())
+	_, ok := <-cs.ClientConnection.RemoteStreams
+	assert.False(t, ok)
+	_, ok = <-cs.ClientConnection.RemoteRecvStreams
+	assert.False(t, ok)
+}
+
+func TestSetTimerGranularity(t *testing.T) {
+	cs := test.NewClientServerPair(mw.RunServer, nil)
+	defer cs.Close()
+
+	assert.Equal(t, mw.ErrInvalidGranularity, cs.ClientConnection.SetTimerGranularity(0))
+	assert.Nil(t, cs.ClientConnection.SetTimerGranularity(time.Millisecond))
+	assert.Nil(t, cs.ServerConnection.SetTimerGranularity(10*time.Millisecond))
+
+	// The connection still works after changing granularity.
+	cstr := cs.ClientConnection.CreateStream()
+	_, err := cstr.Write([]byte{1})
+	assert.Nil(t, err)
+	sstr := <-cs.ServerConnection.RemoteStreams
+	assert.Equal(t, cstr.Id(), sstr.Id())
+}
+
+func TestShardedServer(t *testing.T) {
+	cs := test.NewShardedClientServerPair(4)
+	defer cs.Close()
+
+	cstr := cs.ClientConnection.CreateStream()
+	_, err := cstr.Write([]byte{1, 2})
+	assert.Nil(t, err)
+	sstr := <-cs.ServerConnection.RemoteStreams
+	assert.Equal(t, cstr.Id(), sstr.Id())
+
+	in := make([]byte, 2)
+	n, err := sstr.Read(in)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []byte{1, 2}, in)
+}
+
+// BenchmarkStreamTransfer measures throughput on a stream between a client and
+// server.  This needs a minq that can complete a handshake.
+func BenchmarkStreamTransfer(b *testing.B) {
+	cs := test.NewClientServerPair(mw.RunServer, nil)
+	defer cs.Close()
+
+	out := make([]byte, 1000)
+	cstr := cs.ClientConnection.CreateStream()
+	// The first write causes the stream to be created at the server.
+	_, err := cstr.Write(out)
+	if err != nil {
+		b.Fatal(err)
+	}
+	sstr := <-cs.ServerConnection.RemoteStreams
+
+	total := len(out) * (b.N + 1)
+	done := make(chan error)
+	go func() {
+		in := make([]byte, 4096)
+		for received := 0; received < total; {
+			n, err := sstr.Read(in)
+			if err != nil {
+				done <- err
+				return
+			}
+			received += n
+		}
+		done <- nil
+	}()
+
+	b.SetBytes(int64(len(out)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err = cstr.Write(out)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	err = <-done
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+// benchmarkPackets simulates the receipt of packets, with a function that
+// produces each packet.
+func benchmarkPackets(b *testing.B, get func() *mw.Packet) {
+	packets := make(chan *mw.Packet, 16)
+	done := make(chan struct{})
+	go func() {
+		for p := range packets {
+			// Connection copies the data for minq before releasing the packet.
+			data := make([]byte, len(p.Data))
+			copy(data, p.Data)
+			p.Release()
+		}
+		close(done)
+	}()
+
+	b.SetBytes(1200)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p := get()
+		p.Data = p.Data[:1200]
+		packets <- p
+	}
+	close(packets)
+	<-done
+}
+
+func BenchmarkPacketAllocate(b *testing.B) {
+	benchmarkPackets(b, func() *mw.Packet {
+		return &mw.Packet{Data: make([]byte, 4096)}
+	})
+}
+
+func BenchmarkPacketPool(b *testing.B) {
+	pool := mw.NewPacketPool(4096)
+	benchmarkPackets(b, pool.Get)
+}
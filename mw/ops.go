@@ -2,7 +2,9 @@ package mw
 
 import (
 	"errors"
+	"io"
 	"sync"
+	"time"
 
 	"github.com/ekr/minq"
 )
@@ -14,6 +16,9 @@ var ErrConnectionClosed = errors.New("connection closed before operation could c
 // ErrUnknownOperation is what you get when operations are used improperly.
 var ErrUnknownOperation = errors.New("unknown operation provided")
 
+// ErrInvalidGranularity is returned when a timer granularity isn't positive.
+var ErrInvalidGranularity = errors.New("timer granularity must be positive")
+
 type connectionOperation interface {
 	report(error)
 }
@@ -76,14 +81,26 @@ type ioResult struct {
 	err error
 }
 
+// ioRequest is used for reading and writing.  These are reused, so the result
+// channel has a buffer of one.  That means that the service goroutine never
+// blocks when reporting a result.
 type ioRequest struct {
 	c      *Connection
 	p      []byte
-	result chan<- *ioResult
+	result chan ioResult
 }
 
 func (ior *ioRequest) report(err error) {
-	ior.result <- &ioResult{0, err}
+	ior.result <- ioResult{0, err}
+}
+
+// wait waits for the result and then clears the request so that it can be
+// reused.
+func (ior *ioRequest) wait() (int, error) {
+	res := <-ior.result
+	ior.c = nil
+	ior.p = nil
+	return res.n, res.err
 }
 
 type writeRequest struct {
@@ -91,17 +108,59 @@ type writeRequest struct {
 	s *SendStream
 }
 
+var writeRequestPool = sync.Pool{
+	New: func() interface{} {
+		return &writeRequest{ioRequest: ioRequest{result: make(chan ioResult, 1)}}
+	},
+}
+
+func newWriteRequest(s *SendStream, p []byte) *writeRequest {
+	req := writeRequestPool.Get().(*writeRequest)
+	req.c = s.c
+	req.p = p
+	req.s = s
+	return req
+}
+
+// release returns the request to the pool.  Only do this after the result has
+// been read.
+func (req *writeRequest) release() {
+	req.s = nil
+	writeRequestPool.Put(req)
+}
+
 type readRequest struct {
 	ioRequest
 	s *RecvStream
 }
 
+var readRequestPool = sync.Pool{
+	New: func() interface{} {
+		return &readRequest{ioRequest: ioRequest{result: make(chan ioResult, 1)}}
+	},
+}
+
+func newReadRequest(s *RecvStream, p []byte) *readRequest {
+	req := readRequestPool.Get().(*readRequest)
+	req.c = s.c
+	req.p = p
+	req.s = s
+	return req
+}
+
+// release returns the request to the pool.  Only do this after the result has
+// been read.
+func (req *readRequest) release() {
+	req.s = nil
+	readRequestPool.Put(req)
+}
+
 func (req *readRequest) read() bool {
 	n, err := req.s.minq.Read(req.p)
 	success := err != minq.ErrorWouldBlock
 	if success {
 		//fmt.Printf("%v %d < %x\n", req.s.c.minq.Role(), req.s.Id(), req.p)
-		req.result <- &ioResult{n, err}
+		req.result <- ioResult{n, err}
 	}
 	return success
 }
@@ -126,6 +185,12 @@ type stopRequest struct {
 	reportErrorChannel
 }
 
+type setTimerGranularityRequest struct {
+	timers      *timerWheel
+	granularity time.Duration
+	reportErrorChannel
+}
+
 type closeConnectionRequest struct {
 	c *Connection
 	reportErrorChannel
@@ -161,52 +226,70 @@ func (ops *connectionOperations) Add(op connectionOperation) {
 	}
 }
 
-// Select polls the set of operations and runs any necessary operations.
-func (ops *connectionOperations) Handle(v connectionOperation) {
+// Handle runs an operation.  It returns the connection that the operation
+// affected, if any, so that its timer can be updated.
+func (ops *connectionOperations) Handle(v connectionOperation) *Connection {
 	switch op := v.(type) {
 	case *closeConnectionRequest:
 		op.report(op.c.minq.Close())
+		return op.c
 
 	case *applicationCloseRequest:
 		op.report(op.c.minq.Error(op.code, op.text))
+		return op.c
 
 	case *createStreamRequest:
 		s := op.c.minq.CreateStream()
 		op.result <- &Stream{SendStream{op.c, s}, RecvStream{op.c, s}}
+		return op.c
 
 	case *createSendStreamRequest:
 		s := op.c.minq.CreateSendStream()
 		op.result <- &SendStream{op.c, s}
+		return op.c
 
 	case *writeRequest:
 		// fmt.Printf("%v %d > %x\n", op.s.c.minq.Role(), op.s.Id(), op.p)
 		n, err := op.s.minq.Write(op.p)
-		op.result <- &ioResult{n, err}
+		op.result <- ioResult{n, err}
+		return op.c
 
 	case *closeStreamRequest:
 		op.report(op.s.minq.Close())
+		return op.c
 
 	case *resetRequest:
 		op.report(op.s.minq.Reset(op.code))
+		return op.c
 
 	case *readRequest:
 		op.c.handleReadRequest(op)
+		return op.c
 
 	case *stopRequest:
-		// Note that closing the channel shouldn't be necessary, but caution is
-		// always welcome in these matters.
+		// Any pending read won't complete, so treat it as the end of the stream.
 		readReq := op.c.readState[op.s.minq]
 		if readReq != nil {
-			close(readReq.result)
+			readReq.report(io.EOF)
 			delete(op.c.readState, op.s.minq)
 		}
 		op.report(op.s.minq.StopSending(op.code))
+		return op.c
+
+	case *setTimerGranularityRequest:
+		if op.granularity <= 0 {
+			op.report(ErrInvalidGranularity)
+		} else {
+			op.timers.setGranularity(op.granularity)
+			op.report(nil)
+		}
 
 	default:
 		// This covers the various state inquiry functions, which return
 		// a valid result from the reporting function.
 		op.report(ErrUnknownOperation)
 	}
+	return nil
 }
 
 func (ops *connectionOperations) Close() error {
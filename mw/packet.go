@@ -0,0 +1,72 @@
+package mw
+
+import (
+	"net"
+	"sync"
+)
+
+// Packet represents a UDP packet.  It has addresses and a payload.
+type Packet struct {
+	DestAddr *net.UDPAddr
+	SrcAddr  *net.UDPAddr
+	Data     []byte
+
+	// buf is the full buffer that Data is taken from, if this came from a pool.
+	buf  []byte
+	pool *PacketPool
+}
+
+// Release returns the packet to the pool that it came from, if any.  Connection
+// and Server release packets once they have been received, so don't touch a
+// packet after sending it to IncomingPackets.
+func (p *Packet) Release() {
+	if p.pool == nil {
+		return
+	}
+	p.DestAddr = nil
+	p.SrcAddr = nil
+	p.Data = nil
+	p.pool.pool.Put(p)
+}
+
+// take returns a copy of the packet data and releases the packet.  minq doesn't
+// promise not to keep the slice that is passed to Input; it could hold on to a
+// packet that it can't process yet.  So minq gets its own copy, which is only
+// as large as the packet, and the full-sized buffer goes back to the pool.
+func (p *Packet) take() []byte {
+	data := make([]byte, len(p.Data))
+	copy(data, p.Data)
+	p.Release()
+	return data
+}
+
+// PacketPool recycles packets and the buffers that they are read into, so that
+// each read doesn't need a new buffer of the maximum packet size.  This only
+// pools allocations; it isn't zero-copy.  The payload is still copied into a
+// slice of its own before it is passed to minq, see take.
+type PacketPool struct {
+	size int
+	pool sync.Pool
+}
+
+// NewPacketPool makes a pool for packets of up to the given size.
+func NewPacketPool(size int) *PacketPool {
+	pp := &PacketPool{size: size}
+	pp.pool.New = func() interface{} {
+		return &Packet{buf: make([]byte, size), pool: pp}
+	}
+	return pp
+}
+
+// Size is the size of buffers in the pool.
+func (pp *PacketPool) Size() int {
+	return pp.size
+}
+
+// Get returns a packet with a Data field that is the full size of the buffer.
+// Slice Data down to the size of the packet that was received.
+func (pp *PacketPool) Get() *Packet {
+	p := pp.pool.Get().(*Packet)
+	p.Data = p.buf
+	return p
+}
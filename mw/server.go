@@ -18,17 +18,33 @@ type Server struct {
 
 	ops      *connectionOperations
 	shutdown chan chan<- struct{}
+
+	// All connections share the same timers.  known tracks connections so
+	// that their timers can be updated after packets are received.
+	timers       *timerWheel
+	known        map[*minq.Connection]*Connection
+	housekeeping *timerEntry
+
+	// shards is set for a server created with RunShardedServer.
+	shards []*Server
 }
 
+// serverHousekeepingInterval is how often minq.Server is given a chance to
+// check on all connections.  Connection timers are handled individually, so
+// this only needs to run occasionally.
+const serverHousekeepingInterval = time.Second
+
 type serverHandler struct {
 	connections chan<- *Connection
-	ops         *connectionOperations
+	s           *Server
 }
 
 // NewConnection is part of the minq.ServerHandler interface.
 // Note the use of a goroutine to avoid blocking the main thread.
 func (sh *serverHandler) NewConnection(mc *minq.Connection) {
-	c := newServerConnection(mc, sh.ops)
+	c := newServerConnection(mc, sh.s.ops, sh.s.timers)
+	sh.s.known[mc] = c
+	c.updateTimer()
 	go func() {
 		<-c.Connected
 		sh.connections <- c
@@ -45,27 +61,37 @@ func RunServer(ms *minq.Server) *Server {
 		IncomingPackets: incoming,
 		ops:             newConnectionOperations(),
 		shutdown:        make(chan chan<- struct{}),
+		timers:          newTimerWheel(DefaultTimerGranularity),
+		known:           make(map[*minq.Connection]*Connection),
 	}
-	ms.SetHandler(&serverHandler{connections, s.ops})
+	s.housekeeping = newTimerEntry(s.checkTimers)
+	ms.SetHandler(&serverHandler{connections, s})
 	go s.service(incoming)
 	return s
 }
 
 func (s *Server) service(incoming <-chan *Packet) {
 	defer s.cleanup()
-	ticker := time.NewTicker(50 * time.Millisecond)
-	defer ticker.Stop()
+	s.timers.schedule(s.housekeeping, time.Now().Add(serverHousekeepingInterval))
 
 	for {
 		select {
 		case op := <-s.ops.ch:
-			s.ops.Handle(op)
+			c := s.ops.Handle(op)
+			if c != nil {
+				c.updateTimer()
+			}
 
 		case p := <-incoming:
-			_, _ = s.s.Input(p.SrcAddr, p.Data)
+			// take releases the packet, so get the address first.
+			addr := p.SrcAddr
+			mc, _ := s.s.Input(addr, p.take())
+			if c := s.known[mc]; c != nil {
+				c.updateTimer()
+			}
 
-		case <-ticker.C:
-			s.s.CheckTimer()
+		case now := <-s.timers.C():
+			s.timers.expire(now)
 
 		case done := <-s.shutdown:
 			close(done)
@@ -74,10 +100,42 @@ func (s *Server) service(incoming <-chan *Packet) {
 	}
 }
 
+// checkTimers lets minq.Server check all of its connections and forgets
+// about connections that have closed.
+func (s *Server) checkTimers(now time.Time) time.Time {
+	s.s.CheckTimer()
+	for mc, c := range s.known {
+		switch mc.GetState() {
+		case minq.StateClosed, minq.StateError:
+			s.timers.remove(c.timer)
+			delete(s.known, mc)
+		}
+	}
+	return now.Add(serverHousekeepingInterval)
+}
+
 func (s *Server) cleanup() {
+	s.timers.stop()
 	s.ops.Close()
 }
 
+// SetTimerGranularity changes the granularity of timers for all connections
+// on this server.
+func (s *Server) SetTimerGranularity(d time.Duration) error {
+	if s.shards != nil {
+		for _, shard := range s.shards {
+			err := shard.SetTimerGranularity(d)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	result := make(chan error)
+	s.ops.Add(&setTimerGranularityRequest{s.timers, d, reportErrorChannel{result}})
+	return <-result
+}
+
 // Close implements io.Closer.
 func (s *Server) Close() error {
 	done := make(chan struct{})
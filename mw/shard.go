@@ -0,0 +1,248 @@
+package mw
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ekr/minq"
+)
+
+// shardIdleTimeout is how long the dispatcher remembers where to send packets
+// for a connection ID or address that hasn't been seen.
+const shardIdleTimeout = 5 * time.Minute
+
+// connectionID extracts the connection ID from a packet.  This uses the header
+// layout that minq uses: the long header has the connection ID immediately
+// after the type octet; the short header has it in the same place unless the
+// omit connection ID flag (0x40) is set.
+func connectionID(p []byte) (uint64, bool) {
+	if len(p) < 9 {
+		return 0, false
+	}
+	if p[0]&0x80 == 0 && p[0]&0x40 != 0 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(p[1:9]), true
+}
+
+// shardRoute records where packets for a connection go.
+type shardRoute struct {
+	shard    int
+	lastSeen int64 // UnixNano, accessed atomically
+}
+
+func (r *shardRoute) touch(now time.Time) {
+	atomic.StoreInt64(&r.lastSeen, now.UnixNano())
+}
+
+func (r *shardRoute) idle(now time.Time) bool {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&r.lastSeen))) > shardIdleTimeout
+}
+
+// dispatcher picks a shard for each packet.  Routes are learned from the
+// connection IDs that each shard uses in the packets that it sends, plus the
+// address of the peer.  Packets that don't match any route are assigned a
+// shard based on a hash of their connection ID, or their address if there is
+// no connection ID.
+type dispatcher struct {
+	n     int
+	lock  sync.RWMutex
+	ids   map[uint64]*shardRoute
+	addrs map[string]*shardRoute
+}
+
+func newDispatcher(n int) *dispatcher {
+	return &dispatcher{
+		n:     n,
+		ids:   make(map[uint64]*shardRoute),
+		addrs: make(map[string]*shardRoute),
+	}
+}
+
+func (d *dispatcher) lookup(p *Packet, now time.Time) (int, bool) {
+	defer d.lock.RUnlock()
+	d.lock.RLock()
+	if id, ok := connectionID(p.Data); ok {
+		if r := d.ids[id]; r != nil {
+			r.touch(now)
+			return r.shard, true
+		}
+	}
+	if p.SrcAddr != nil {
+		if r := d.addrs[p.SrcAddr.String()]; r != nil {
+			r.touch(now)
+			return r.shard, true
+		}
+	}
+	return 0, false
+}
+
+// route works out which shard a packet belongs to.
+func (d *dispatcher) route(p *Packet) int {
+	now := time.Now()
+	if shard, ok := d.lookup(p, now); ok {
+		return shard
+	}
+
+	h := fnv.New32a()
+	if id, ok := connectionID(p.Data); ok {
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], id)
+		h.Write(b[:])
+	} else if p.SrcAddr != nil {
+		h.Write([]byte(p.SrcAddr.String()))
+	}
+	shard := int(h.Sum32() % uint32(d.n))
+	if p.SrcAddr != nil {
+		d.learnAddr(p.SrcAddr, shard)
+	}
+	return shard
+}
+
+func (d *dispatcher) learnID(id uint64, shard int) {
+	now := time.Now()
+	d.lock.RLock()
+	r := d.ids[id]
+	d.lock.RUnlock()
+	if r != nil && r.shard == shard {
+		r.touch(now)
+		return
+	}
+
+	defer d.lock.Unlock()
+	d.lock.Lock()
+	r = &shardRoute{shard: shard}
+	r.touch(now)
+	d.ids[id] = r
+}
+
+func (d *dispatcher) learnAddr(addr *net.UDPAddr, shard int) {
+	r := &shardRoute{shard: shard}
+	r.touch(time.Now())
+
+	defer d.lock.Unlock()
+	d.lock.Lock()
+	d.addrs[addr.String()] = r
+}
+
+// sweep removes routes that haven't been used recently.
+func (d *dispatcher) sweep(now time.Time) {
+	defer d.lock.Unlock()
+	d.lock.Lock()
+	for id, r := range d.ids {
+		if r.idle(now) {
+			delete(d.ids, id)
+		}
+	}
+	for addr, r := range d.addrs {
+		if r.idle(now) {
+			delete(d.addrs, addr)
+		}
+	}
+}
+
+// shardTransportFactory wraps the transports for a shard so that the
+// dispatcher learns the connection IDs that the shard uses.
+type shardTransportFactory struct {
+	minq.TransportFactory
+	d     *dispatcher
+	shard int
+}
+
+func (tf *shardTransportFactory) MakeTransport(remote *net.UDPAddr) (minq.Transport, error) {
+	t, err := tf.TransportFactory.MakeTransport(remote)
+	if err != nil {
+		return nil, err
+	}
+	tf.d.learnAddr(remote, tf.shard)
+	return &shardTransport{t, tf.d, tf.shard}, nil
+}
+
+type shardTransport struct {
+	minq.Transport
+	d     *dispatcher
+	shard int
+}
+
+func (t *shardTransport) Send(p []byte) error {
+	if id, ok := connectionID(p); ok {
+		t.d.learnID(id, t.shard)
+	}
+	return t.Transport.Send(p)
+}
+
+// RunShardedServer creates a Server that spreads connections across n
+// separate minq servers, each with its own service goroutine.  This allows a
+// server to use more than one core.  Each shard uses transports from tf.
+//
+// Packets written to IncomingPackets are passed to the shard that owns the
+// connection; connections from all shards are emitted on Connections.
+func RunShardedServer(n int, tf minq.TransportFactory, config *minq.TlsConfig) *Server {
+	if n < 1 {
+		n = 1
+	}
+	d := newDispatcher(n)
+	shards := make([]*Server, n)
+	for i := range shards {
+		stf := &shardTransportFactory{tf, d, i}
+		shards[i] = RunServer(minq.NewServer(stf, config, nil))
+	}
+
+	connections := make(chan *Connection)
+	incoming := make(chan *Packet)
+	s := &Server{
+		Connections:     connections,
+		IncomingPackets: incoming,
+		shutdown:        make(chan chan<- struct{}),
+		shards:          shards,
+	}
+	done := make(chan struct{})
+	for _, shard := range shards {
+		go mergeConnections(shard.Connections, connections, done)
+	}
+	go s.dispatch(d, incoming, done)
+	return s
+}
+
+func mergeConnections(in <-chan *Connection, out chan<- *Connection, done <-chan struct{}) {
+	for {
+		select {
+		case c := <-in:
+			select {
+			case out <- c:
+			case <-done:
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// dispatch is the service goroutine for a sharded server.
+func (s *Server) dispatch(d *dispatcher, incoming <-chan *Packet, done chan<- struct{}) {
+	ticker := time.NewTicker(shardIdleTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case p := <-incoming:
+			s.shards[d.route(p)].IncomingPackets <- p
+
+		case now := <-ticker.C:
+			d.sweep(now)
+
+		case shutdown := <-s.shutdown:
+			close(done)
+			for _, shard := range s.shards {
+				shard.Close()
+			}
+			close(shutdown)
+			return
+		}
+	}
+}
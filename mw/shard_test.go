@@ -0,0 +1,165 @@
+package mw
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ekr/minq"
+	"github.com/stvp/assert"
+)
+
+func TestConnectionID(t *testing.T) {
+	id := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	for _, tc := range []struct {
+		name   string
+		packet []byte
+		id     uint64
+		ok     bool
+	}{
+		{"long header", append([]byte{0x82}, id...), 0x0102030405060708, true},
+		{"long header with 0x40", append([]byte{0xc2}, id...), 0x0102030405060708, true},
+		{"short header", append([]byte{0x01}, append(id, 0xff)...), 0x0102030405060708, true},
+		{"short header without ID", append([]byte{0x41}, id...), 0, false},
+		{"short packet", []byte{0x82, 1, 2, 3, 4, 5, 6, 7}, 0, false},
+		{"empty", []byte{}, 0, false},
+	} {
+		v, ok := connectionID(tc.packet)
+		assert.Equal(t, tc.ok, ok, tc.name)
+		assert.Equal(t, tc.id, v, tc.name)
+	}
+}
+
+// testPacket makes a packet from addr, with the given connection ID.  An ID of
+// zero makes a short header packet without a connection ID.
+func testPacket(addr *net.UDPAddr, id uint64) *Packet {
+	data := make([]byte, 20)
+	if id == 0 {
+		data[0] = 0x41
+	} else {
+		data[0] = 0x82
+		for i := 8; i > 0; i-- {
+			data[i] = byte(id)
+			id >>= 8
+		}
+	}
+	return &Packet{SrcAddr: addr, Data: data}
+}
+
+func TestDispatcherRoute(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	moved := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 5678}
+	const id = 0x1234
+
+	for _, tc := range []struct {
+		name  string
+		learn func(d *dispatcher)
+		p     *Packet
+		shard int
+	}{
+		{"ID", func(d *dispatcher) { d.learnID(id, 2) }, testPacket(addr, id), 2},
+		{"ID after address change", func(d *dispatcher) { d.learnID(id, 2) }, testPacket(moved, id), 2},
+		{"ID before address", func(d *dispatcher) {
+			d.learnAddr(addr, 1)
+			d.learnID(id, 3)
+		}, testPacket(addr, id), 3},
+		{"address", func(d *dispatcher) { d.learnAddr(addr, 1) }, testPacket(addr, 0), 1},
+		{"address with unknown ID", func(d *dispatcher) { d.learnAddr(addr, 1) }, testPacket(addr, id), 1},
+		{"relearned ID", func(d *dispatcher) {
+			d.learnID(id, 2)
+			d.learnID(id, 0)
+		}, testPacket(addr, id), 0},
+	} {
+		d := newDispatcher(4)
+		tc.learn(d)
+		assert.Equal(t, tc.shard, d.route(tc.p), tc.name)
+	}
+}
+
+func TestDispatcherUnknown(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	d := newDispatcher(4)
+
+	// Packets that don't match a route are spread by a hash, and the address
+	// is remembered, so later packets go to the same shard.
+	shard := d.route(testPacket(addr, 0x1234))
+	assert.True(t, shard >= 0 && shard < 4)
+	r := d.addrs[addr.String()]
+	assert.NotNil(t, r)
+	assert.Equal(t, shard, r.shard)
+	assert.Equal(t, shard, d.route(testPacket(addr, 0)))
+
+	// The same connection ID always hashes to the same shard.
+	other := newDispatcher(4)
+	assert.Equal(t, shard, other.route(testPacket(nil, 0x1234)))
+}
+
+// recordingTransport is a minq.Transport that remembers what was sent.
+type recordingTransport struct {
+	sent [][]byte
+}
+
+func (t *recordingTransport) Send(p []byte) error {
+	t.sent = append(t.sent, p)
+	return nil
+}
+
+type recordingTransportFactory struct {
+	transport *recordingTransport
+}
+
+func (tf *recordingTransportFactory) MakeTransport(remote *net.UDPAddr) (minq.Transport, error) {
+	return tf.transport, nil
+}
+
+func TestShardTransportLearns(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	moved := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 5678}
+	d := newDispatcher(4)
+	inner := &recordingTransport{}
+	tf := &shardTransportFactory{&recordingTransportFactory{inner}, d, 3}
+
+	// Making a transport pins the address to the shard.
+	transport, err := tf.MakeTransport(addr)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, d.route(testPacket(addr, 0)))
+
+	// Sending a packet pins its connection ID, so packets with that ID find the
+	// shard after the address changes.
+	sent := testPacket(nil, 0x5678).Data
+	assert.Nil(t, transport.Send(sent))
+	assert.Equal(t, [][]byte{sent}, inner.sent)
+	assert.Equal(t, 3, d.route(testPacket(moved, 0x5678)))
+
+	// A packet without a connection ID teaches nothing.
+	assert.Nil(t, transport.Send(testPacket(nil, 0).Data))
+	assert.Equal(t, 1, len(d.ids))
+}
+
+func TestDispatcherSweep(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	d := newDispatcher(4)
+	d.learnID(0x1234, 2)
+	d.learnAddr(addr, 1)
+	start := time.Now()
+
+	// Routes that have been used recently are kept.
+	d.sweep(start.Add(shardIdleTimeout / 2))
+	assert.Equal(t, 1, len(d.ids))
+	assert.Equal(t, 1, len(d.addrs))
+
+	// Using the ID refreshes that route, but not the address.
+	later := start.Add(shardIdleTimeout / 2)
+	shard, ok := d.lookup(testPacket(nil, 0x1234), later)
+	assert.True(t, ok)
+	assert.Equal(t, 2, shard)
+	d.sweep(start.Add(shardIdleTimeout + time.Second))
+	assert.Equal(t, 1, len(d.ids))
+	assert.Equal(t, 0, len(d.addrs))
+
+	// Once idle for long enough, the ID is forgotten too.
+	d.sweep(later.Add(shardIdleTimeout + time.Second))
+	assert.Equal(t, 0, len(d.ids))
+	_, ok = d.lookup(testPacket(addr, 0x1234), later)
+	assert.False(t, ok)
+}
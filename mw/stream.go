@@ -32,10 +32,10 @@ func (s *SendStream) SendState() minq.SendStreamState {
 
 // Write implements the io.Writer interface.
 func (s *SendStream) Write(p []byte) (int, error) {
-	result := make(chan *ioResult)
-	s.c.ops.Add(&writeRequest{ioRequest{s.c, p, result}, s})
-	resp := <-result
-	return resp.n, resp.err
+	req := newWriteRequest(s, p)
+	defer req.release()
+	s.c.ops.Add(req)
+	return req.wait()
 }
 
 // Reset kills a stream (outbound only).
@@ -72,10 +72,10 @@ func (s *RecvStream) RecvState() minq.RecvStreamState {
 
 // Read implements the io.Reader interface.
 func (s *RecvStream) Read(p []byte) (int, error) {
-	result := make(chan *ioResult)
-	s.c.ops.Add(&readRequest{ioRequest{s.c, p, result}, s})
-	resp := <-result
-	return resp.n, resp.err
+	req := newReadRequest(s, p)
+	defer req.release()
+	s.c.ops.Add(req)
+	return req.wait()
 }
 
 // StopSending currently does nothing because minq doesn't support it.
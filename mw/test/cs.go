@@ -69,6 +69,21 @@ type ClientServer struct {
 
 // NewClientServerPair is used to support testing.
 func NewClientServerPair(runServerFunc func(*minq.Server) *mw.Server,
+	getServerConnectionFunc func(*mw.Server) *mw.Connection) *ClientServer {
+	return newClientServerPair(func(tf minq.TransportFactory, config *minq.TlsConfig) *mw.Server {
+		return runServerFunc(minq.NewServer(tf, config, nil))
+	}, getServerConnectionFunc)
+}
+
+// NewShardedClientServerPair is like NewClientServerPair, except that the
+// server is created with mw.RunShardedServer.
+func NewShardedClientServerPair(shards int) *ClientServer {
+	return newClientServerPair(func(tf minq.TransportFactory, config *minq.TlsConfig) *mw.Server {
+		return mw.RunShardedServer(shards, tf, config)
+	}, nil)
+}
+
+func newClientServerPair(runServerFunc func(minq.TransportFactory, *minq.TlsConfig) *mw.Server,
 	getServerConnectionFunc func(*mw.Server) *mw.Connection) *ClientServer {
 	cs := &ClientServer{}
 
@@ -78,7 +93,7 @@ func NewClientServerPair(runServerFunc func(*minq.Server) *mw.Server,
 	cs.serverTransport = &Transport{b, a, sync.Mutex{}}
 
 	serverConfig := minq.NewTlsConfig("localhost")
-	cs.Server = runServerFunc(minq.NewServer(&simpleTransportFactory{cs.serverTransport}, &serverConfig, nil))
+	cs.Server = runServerFunc(&simpleTransportFactory{cs.serverTransport}, &serverConfig)
 	go cs.serverTransport.Service(clientAddr, cs.Server.IncomingPackets)
 
 	clientConfig := minq.NewTlsConfig("localhost")
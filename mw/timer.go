@@ -0,0 +1,170 @@
+package mw
+
+import (
+	"container/heap"
+	"time"
+)
+
+// DefaultTimerGranularity is how often minq timers are checked.  minq doesn't
+// report when its next timer expires, so there are no deadlines to schedule:
+// every open connection is polled at this interval.  The polls for all
+// connections on a server share one timer, so an idle server wakes once per
+// interval rather than once per connection, but a retransmission can still be
+// late by up to this much.
+const DefaultTimerGranularity = 50 * time.Millisecond
+
+// timerEntry is something that has a timer.  check is called when the timer
+// expires.  It returns the next deadline, or the zero time if nothing needs to
+// be scheduled.
+type timerEntry struct {
+	check func(now time.Time) time.Time
+	slot  int64
+	index int
+}
+
+func newTimerEntry(check func(now time.Time) time.Time) *timerEntry {
+	return &timerEntry{check: check, index: -1}
+}
+
+func (e *timerEntry) scheduled() bool {
+	return e.index >= 0
+}
+
+// timerSlots is a heap of entries, ordered by slot.
+type timerSlots []*timerEntry
+
+func (ts timerSlots) Len() int           { return len(ts) }
+func (ts timerSlots) Less(i, j int) bool { return ts[i].slot < ts[j].slot }
+func (ts timerSlots) Swap(i, j int) {
+	ts[i], ts[j] = ts[j], ts[i]
+	ts[i].index = i
+	ts[j].index = j
+}
+
+func (ts *timerSlots) Push(x interface{}) {
+	e := x.(*timerEntry)
+	e.index = len(*ts)
+	*ts = append(*ts, e)
+}
+
+func (ts *timerSlots) Pop() interface{} {
+	old := *ts
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*ts = old[:len(old)-1]
+	e.index = -1
+	return e
+}
+
+// timerWheel schedules timers for any number of entries using a single
+// time.Timer.  Deadlines are rounded up into slots of the configured
+// granularity.  This is only used from a single service goroutine.
+type timerWheel struct {
+	granularity time.Duration
+	slots       timerSlots
+	timer       *time.Timer
+	// armed is the slot that timer is set for, or zero if it isn't running.
+	armed int64
+}
+
+func newTimerWheel(granularity time.Duration) *timerWheel {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	return &timerWheel{granularity: granularity, timer: timer}
+}
+
+// C is the channel that fires when the earliest entry is due.  When it
+// fires, call expire.
+func (tw *timerWheel) C() <-chan time.Time {
+	return tw.timer.C
+}
+
+func (tw *timerWheel) slotOf(deadline time.Time) int64 {
+	g := int64(tw.granularity)
+	return (deadline.UnixNano() + g - 1) / g
+}
+
+// schedule sets a deadline for the entry.  If the entry is already scheduled,
+// this only ever makes the deadline earlier.  A zero deadline is ignored.
+func (tw *timerWheel) schedule(e *timerEntry, deadline time.Time) {
+	if deadline.IsZero() {
+		return
+	}
+	slot := tw.slotOf(deadline)
+	if e.scheduled() {
+		if slot >= e.slot {
+			return
+		}
+		e.slot = slot
+		heap.Fix(&tw.slots, e.index)
+	} else {
+		e.slot = slot
+		heap.Push(&tw.slots, e)
+	}
+	tw.arm()
+}
+
+// remove stops the timer for an entry.
+func (tw *timerWheel) remove(e *timerEntry) {
+	if e.scheduled() {
+		heap.Remove(&tw.slots, e.index)
+		tw.arm()
+	}
+}
+
+// expire runs the check on all entries that are due.
+func (tw *timerWheel) expire(now time.Time) {
+	// The timer fired, so it isn't running any more.
+	tw.armed = 0
+	current := now.UnixNano() / int64(tw.granularity)
+	var due []*timerEntry
+	for len(tw.slots) > 0 && tw.slots[0].slot <= current {
+		due = append(due, heap.Pop(&tw.slots).(*timerEntry))
+	}
+	for _, e := range due {
+		tw.schedule(e, e.check(now))
+	}
+	tw.arm()
+}
+
+// arm sets the timer so that it fires for the earliest slot.
+func (tw *timerWheel) arm() {
+	if len(tw.slots) == 0 {
+		tw.stop()
+		return
+	}
+	next := tw.slots[0].slot
+	if next == tw.armed {
+		return
+	}
+	tw.stop()
+	tw.armed = next
+	tw.timer.Reset(time.Until(time.Unix(0, next*int64(tw.granularity))))
+}
+
+// stop stops the timer.
+func (tw *timerWheel) stop() {
+	if tw.armed == 0 {
+		return
+	}
+	tw.armed = 0
+	if !tw.timer.Stop() {
+		select {
+		case <-tw.timer.C:
+		default:
+		}
+	}
+}
+
+// setGranularity changes the granularity of the wheel.  Existing entries are
+// moved to the equivalent slot.
+func (tw *timerWheel) setGranularity(granularity time.Duration) {
+	old := int64(tw.granularity)
+	tw.granularity = granularity
+	for _, e := range tw.slots {
+		e.slot = tw.slotOf(time.Unix(0, e.slot*old))
+	}
+	heap.Init(&tw.slots)
+	tw.stop()
+	tw.arm()
+}
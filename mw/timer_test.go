@@ -0,0 +1,180 @@
+package mw
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stvp/assert"
+)
+
+const testGranularity = 10 * time.Millisecond
+
+// testSlot is a slot that is an hour away.  Deadlines this far out never make
+// the real timer fire during a test.
+var testSlot = time.Now().Add(time.Hour).UnixNano() / int64(testGranularity)
+
+// slotTime is the start of the slot that is n slots after testSlot.
+func slotTime(n int64) time.Time {
+	return time.Unix(0, (testSlot+n)*int64(testGranularity))
+}
+
+// recordingEntry makes an entry that records when its check runs and then
+// asks for the next deadline from next, if there is one.
+func recordingEntry(name string, ran *[]string, next ...time.Time) *timerEntry {
+	return newTimerEntry(func(now time.Time) time.Time {
+		*ran = append(*ran, name)
+		if len(next) == 0 {
+			return time.Time{}
+		}
+		deadline := next[0]
+		next = next[1:]
+		return deadline
+	})
+}
+
+func TestTimerWheelOrder(t *testing.T) {
+	tw := newTimerWheel(testGranularity)
+	defer tw.stop()
+	var ran []string
+	a := recordingEntry("a", &ran)
+	b := recordingEntry("b", &ran)
+	c := recordingEntry("c", &ran)
+
+	tw.schedule(c, slotTime(3))
+	tw.schedule(a, slotTime(1))
+	tw.schedule(b, slotTime(2))
+	assert.Equal(t, a, tw.slots[0])
+	assert.Equal(t, a.slot, tw.armed)
+
+	// Only entries that are due run, earliest first.
+	tw.expire(slotTime(2))
+	assert.Equal(t, []string{"a", "b"}, ran)
+	assert.False(t, a.scheduled())
+	assert.False(t, b.scheduled())
+	assert.True(t, c.scheduled())
+	assert.Equal(t, c.slot, tw.armed)
+
+	tw.expire(slotTime(3))
+	assert.Equal(t, []string{"a", "b", "c"}, ran)
+	assert.Equal(t, 0, len(tw.slots))
+	assert.Equal(t, int64(0), tw.armed)
+}
+
+func TestTimerWheelSchedule(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		deadlines []time.Time
+		slot      time.Time
+	}{
+		{"single", []time.Time{slotTime(2)}, slotTime(2)},
+		{"rounded up", []time.Time{slotTime(2).Add(-time.Nanosecond)}, slotTime(2)},
+		{"later is ignored", []time.Time{slotTime(2), slotTime(5)}, slotTime(2)},
+		{"earlier moves", []time.Time{slotTime(5), slotTime(2)}, slotTime(2)},
+		{"zero is ignored", []time.Time{slotTime(2), {}}, slotTime(2)},
+	} {
+		tw := newTimerWheel(testGranularity)
+		var ran []string
+		e := recordingEntry("e", &ran)
+		for _, deadline := range tc.deadlines {
+			tw.schedule(e, deadline)
+		}
+		assert.True(t, e.scheduled(), tc.name)
+		assert.Equal(t, tw.slotOf(tc.slot), e.slot, tc.name)
+		assert.Equal(t, e.slot, tw.armed, tc.name)
+		tw.stop()
+	}
+
+	// An entry with a zero deadline isn't scheduled at all.
+	tw := newTimerWheel(testGranularity)
+	var ran []string
+	e := recordingEntry("e", &ran)
+	tw.schedule(e, time.Time{})
+	assert.False(t, e.scheduled())
+	assert.Equal(t, int64(0), tw.armed)
+}
+
+func TestTimerWheelReschedule(t *testing.T) {
+	tw := newTimerWheel(testGranularity)
+	defer tw.stop()
+	var ran []string
+	// The check asks to be run again two slots later.
+	e := recordingEntry("e", &ran, slotTime(3))
+	tw.schedule(e, slotTime(1))
+
+	tw.expire(slotTime(1))
+	assert.Equal(t, []string{"e"}, ran)
+	assert.True(t, e.scheduled())
+	assert.Equal(t, tw.slotOf(slotTime(3)), e.slot)
+	assert.Equal(t, e.slot, tw.armed)
+
+	// Nothing is due in between.
+	tw.expire(slotTime(2))
+	assert.Equal(t, []string{"e"}, ran)
+
+	tw.expire(slotTime(3))
+	assert.Equal(t, []string{"e", "e"}, ran)
+	assert.False(t, e.scheduled())
+}
+
+func TestTimerWheelRemove(t *testing.T) {
+	tw := newTimerWheel(testGranularity)
+	defer tw.stop()
+	var ran []string
+	a := recordingEntry("a", &ran)
+	b := recordingEntry("b", &ran)
+	tw.schedule(a, slotTime(1))
+	tw.schedule(b, slotTime(2))
+
+	// Removing the earliest entry moves the timer to the next.
+	tw.remove(a)
+	assert.False(t, a.scheduled())
+	assert.Equal(t, b.slot, tw.armed)
+	// Removing an entry that isn't scheduled does nothing.
+	tw.remove(a)
+	assert.Equal(t, 1, len(tw.slots))
+
+	tw.expire(slotTime(2))
+	assert.Equal(t, []string{"b"}, ran)
+
+	// With nothing left, the timer stops.
+	tw.schedule(a, slotTime(3))
+	tw.remove(a)
+	assert.Equal(t, int64(0), tw.armed)
+}
+
+func TestTimerWheelSetGranularity(t *testing.T) {
+	tw := newTimerWheel(testGranularity)
+	defer tw.stop()
+	var ran []string
+	a := recordingEntry("a", &ran)
+	b := recordingEntry("b", &ran)
+	tw.schedule(b, slotTime(4))
+	tw.schedule(a, slotTime(2))
+
+	// Entries keep their deadlines and their order in a finer wheel.
+	tw.setGranularity(testGranularity / 10)
+	assert.Equal(t, tw.slotOf(slotTime(2)), a.slot)
+	assert.Equal(t, tw.slotOf(slotTime(4)), b.slot)
+	assert.Equal(t, a, tw.slots[0])
+	assert.Equal(t, a.slot, tw.armed)
+
+	tw.expire(slotTime(3))
+	assert.Equal(t, []string{"a"}, ran)
+}
+
+func TestTimerWheelFires(t *testing.T) {
+	tw := newTimerWheel(time.Millisecond)
+	defer tw.stop()
+	var ran []string
+	e := recordingEntry("e", &ran)
+	tw.schedule(e, time.Now().Add(time.Millisecond))
+
+	select {
+	case now := <-tw.C():
+		tw.expire(now)
+	case <-time.After(time.Second):
+		t.Fatal("timer didn't fire")
+	}
+	assert.Equal(t, []string{"e"}, ran)
+	assert.Equal(t, int64(0), tw.armed)
+}
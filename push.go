@@ -0,0 +1,166 @@
+package minhq
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/martinthomson/minhq/hc"
+)
+
+// PushAction is what a client does with a push promise.
+type PushAction int
+
+const (
+	// PushDeliver sends the promise to ClientRequest.Pushes, where the
+	// application has to accept or cancel it.
+	PushDeliver = PushAction(iota)
+	// PushAccept keeps the promise so that a matching Fetch can use the
+	// pushed response.  The promise isn't sent to ClientRequest.Pushes.  It
+	// is cancelled if nothing claims it within Config.UnclaimedPushLifetime.
+	PushAccept
+	// PushCancel cancels the promise.
+	PushCancel
+)
+
+// PushPolicy decides what to do with a push promise, based on the method,
+// authority and path in the promise.
+type PushPolicy func(method string, authority string, path string) PushAction
+
+// AcceptAllPushes is a PushPolicy that accepts every GET and HEAD promise and
+// cancels any others.
+func AcceptAllPushes(method string, authority string, path string) PushAction {
+	if method == "GET" || method == "HEAD" {
+		return PushAccept
+	}
+	return PushCancel
+}
+
+func (c *ClientConnection) pushAction(pp *PushPromise) PushAction {
+	if c.config.PushPolicy == nil {
+		return PushDeliver
+	}
+	target := pp.Target()
+	return c.config.PushPolicy(pp.Method(), target.Host, target.RequestURI())
+}
+
+// claimPushWait is the longest that Fetch waits for the responses to matching
+// promises before sending the request instead.
+const claimPushWait = 500 * time.Millisecond
+
+// keepPush saves an accepted promise for a later Fetch.  The same promise can
+// arrive on more than one request, but it is only kept once.  The promise is
+// cancelled if it isn't claimed within Config.UnclaimedPushLifetime.
+func (c *ClientConnection) keepPush(pp *PushPromise) {
+	defer c.pushLock.Unlock()
+	c.pushLock.Lock()
+	for _, p := range c.unclaimed {
+		if p == pp {
+			return
+		}
+	}
+	c.unclaimed = append(c.unclaimed, pp)
+	time.AfterFunc(c.config.unclaimedPushLifetime(), func() {
+		if c.forgetPush(pp) {
+			_ = pp.Cancel()
+		}
+	})
+}
+
+// forgetPush removes a promise from the unclaimed set.  This returns false if
+// the promise was already removed, which means that it has been claimed.
+func (c *ClientConnection) forgetPush(pp *PushPromise) bool {
+	defer c.pushLock.Unlock()
+	c.pushLock.Lock()
+	for i, p := range c.unclaimed {
+		if p == pp {
+			c.unclaimed = append(c.unclaimed[:i], c.unclaimed[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// unclaimedPushes lists unclaimed promises with the given method and target.
+func (c *ClientConnection) unclaimedPushes(method string, target *url.URL) []*PushPromise {
+	defer c.pushLock.Unlock()
+	c.pushLock.Lock()
+	var matches []*PushPromise
+	for _, pp := range c.unclaimed {
+		if pp.Method() == method && pp.Target().String() == target.String() {
+			matches = append(matches, pp)
+		}
+	}
+	return matches
+}
+
+// pushMatches checks that a request has the same values as a promise for the
+// header fields that the pushed response varies on.
+func pushMatches(promise []hc.HeaderField, resp []hc.HeaderField, request []hc.HeaderField) bool {
+	for _, name := range varyNames(resp) {
+		if name == "*" {
+			return false
+		}
+		if getHeaderAnyCase(promise, name) != getHeaderAnyCase(request, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// claimPush takes the response from an unclaimed promise that matches a
+// request.  Only GET and HEAD requests are matched.  This waits for responses
+// to matching promises, so that their vary header field can be checked, but
+// for no longer than claimPushWait in total.
+func (c *ClientConnection) claimPush(method string, target *url.URL, headers []hc.HeaderField) *ClientResponse {
+	if method != "GET" && method != "HEAD" {
+		return nil
+	}
+	deadline := time.Now().Add(claimPushWait)
+	for _, pp := range c.unclaimedPushes(method, target) {
+		resp, ok := pp.peekResponse(deadline)
+		if !ok {
+			continue
+		}
+		if resp == nil {
+			// Cancelled.
+			c.forgetPush(pp)
+			continue
+		}
+		if !pushMatches(pp.Headers(), resp.Headers, headers) {
+			continue
+		}
+		if c.forgetPush(pp) {
+			return pp.Response()
+		}
+	}
+	return nil
+}
+
+// newAnsweredRequest makes a request that is answered without sending it, by
+// a pushed or cached response.  The request has no stream, so it can't have a
+// body.
+func newAnsweredRequest(method string, target *url.URL, headers []hc.HeaderField,
+	resp *ClientResponse, decompress bool) *ClientRequest {
+	responseChannel := make(chan *ClientResponse, 1)
+	pushes := make(chan *PushPromise)
+	close(pushes)
+	final := make(chan struct{})
+	close(final)
+	req := &ClientRequest{
+		method:          method,
+		target:          target,
+		response:        responseChannel,
+		OutgoingMessage: OutgoingMessage{headers: headers},
+		Pushes:          pushes,
+		pushes:          pushes,
+		continued:       make(chan struct{}),
+		final:           final,
+		decompress:      decompress,
+	}
+	resp.Request = req
+	if decompress {
+		resp.decompress()
+	}
+	responseChannel <- resp
+	return req
+}
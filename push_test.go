@@ -0,0 +1,77 @@
+package minhq
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/martinthomson/minhq/hc"
+	"github.com/stvp/assert"
+)
+
+// acceptedPush makes a promise for a GET of target, as though PushPolicy
+// accepted it.
+func acceptedPush(t *testing.T, c *ClientConnection, pushID uint64, target string) *PushPromise {
+	u, err := url.Parse(target)
+	assert.Nil(t, err)
+	pp := c.getPushPromise(pushID)
+	assert.Nil(t, pp.setHeaders([]hc.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: u.Scheme},
+		{Name: ":authority", Value: u.Host},
+		{Name: ":path", Value: u.RequestURI()},
+	}))
+	c.keepPush(pp)
+	return pp
+}
+
+// pushedResponse makes a response on a stream that records how it was stopped.
+func pushedResponse(s *fakeStream) *ClientResponse {
+	return &ClientResponse{
+		IncomingMessage: newIncomingMessage(&newStream(s).recvStream, nil, nil),
+		Status:          200,
+	}
+}
+
+func TestClaimPushWait(t *testing.T) {
+	c := idleConnection()
+	defer c.Close()
+	pp := acceptedPush(t, c, 0, "https://example.com/pushed")
+
+	// Fetch doesn't wait forever for a response that doesn't arrive.
+	start := time.Now()
+	assert.Nil(t, c.claimPush("GET", pp.Target(), nil))
+	assert.True(t, time.Since(start) >= claimPushWait)
+
+	// Once it arrives, the response is claimed without waiting.
+	resp := pushedResponse(&fakeStream{id: 3})
+	pp.fulfill(resp, false)
+	assert.True(t, resp == c.claimPush("GET", pp.Target(), nil))
+	assert.Nil(t, c.claimPush("GET", pp.Target(), nil))
+}
+
+func TestUnclaimedPushExpires(t *testing.T) {
+	c := idleConnection()
+	defer c.Close()
+	c.config = &Config{UnclaimedPushLifetime: 10 * time.Millisecond}
+
+	s := &fakeStream{id: 3}
+	pp := acceptedPush(t, c, 0, "https://example.com/pushed")
+	pp.fulfill(pushedResponse(s), false)
+	assert.Equal(t, 1, len(c.unclaimedPushes("GET", pp.Target())))
+
+	// The push is forgotten and its stream is stopped.
+	for len(c.unclaimedPushes("GET", pp.Target())) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for {
+		s.lock.Lock()
+		stopped := s.stopSending
+		s.lock.Unlock()
+		if stopped != nil {
+			assert.Equal(t, uint16(ErrHttpRequestCancelled), *stopped)
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
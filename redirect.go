@@ -0,0 +1,235 @@
+package minhq
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/martinthomson/minhq/hc"
+)
+
+// ErrUseLastResponse can be returned by RedirectPolicy.Check to stop following
+// redirects.  Client.Do then returns the redirect response without an error.
+var ErrUseLastResponse = errors.New("use last response")
+
+// ErrTooManyRedirects is returned by Client.Do, along with the last response,
+// when the redirect limit is reached.
+var ErrTooManyRedirects = errors.New("too many redirects")
+
+// defaultMaxRedirects is the number of redirects Client.Do follows by default.
+const defaultMaxRedirects = 10
+
+// RedirectPolicy controls how Client.Do follows redirects.
+type RedirectPolicy struct {
+	// MaxRedirects is the number of redirects that are followed.  Zero means
+	// a default of 10.  A negative value means that redirects aren't followed.
+	MaxRedirects int
+	// KeepMethod stops 301 and 302 responses from changing the method of a
+	// request into GET.  Otherwise, any method other than GET or HEAD
+	// changes.  A 303 response always changes the method to GET, unless the
+	// method is HEAD.  307 and 308 responses never change the method.
+	KeepMethod bool
+	// Check is called before each redirect is followed, with the new target
+	// and the responses so far, oldest first.  Returning ErrUseLastResponse
+	// stops and returns the most recent response.  Any other error stops and
+	// is returned along with the most recent response.
+	Check func(target *url.URL, via []*ClientResponse) error
+}
+
+func (p *RedirectPolicy) maxRedirects() int {
+	if p.MaxRedirects == 0 {
+		return defaultMaxRedirects
+	}
+	return p.MaxRedirects
+}
+
+// redirectMethod works out the method and body to use when following a
+// redirect.  If the body is dropped, so are header fields that describe it.
+func (p *RedirectPolicy) redirectMethod(status int, method string) (string, bool) {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound:
+		if method != "GET" && method != "HEAD" && !p.KeepMethod {
+			return "GET", false
+		}
+	case http.StatusSeeOther:
+		if method != "GET" && method != "HEAD" {
+			return "GET", false
+		}
+	}
+	return method, true
+}
+
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// sensitiveRedirectHeaders aren't sent when a redirect goes to another host.
+var sensitiveRedirectHeaders = map[string]bool{
+	"authorization":    true,
+	"www-authenticate": true,
+	"cookie":           true,
+	"cookie2":          true,
+}
+
+// bodyHeaders describe a request body, so they are dropped with the body.
+var bodyHeaders = map[string]bool{
+	"content-encoding": true,
+	"content-language": true,
+	"content-length":   true,
+	"content-location": true,
+	"content-type":     true,
+}
+
+// redirectHeaders works out what header fields to send with a redirect.
+func redirectHeaders(headers []hc.HeaderField, from *url.URL, to *url.URL, keepBody bool) []hc.HeaderField {
+	sameHost := strings.EqualFold(from.Hostname(), to.Hostname())
+	result := make([]hc.HeaderField, 0, len(headers))
+	for _, h := range headers {
+		name := strings.ToLower(h.Name)
+		if !sameHost && sensitiveRedirectHeaders[name] {
+			continue
+		}
+		if !keepBody && bodyHeaders[name] {
+			continue
+		}
+		result = append(result, h)
+	}
+	return result
+}
+
+// cookieHeaders adds cookies from the jar, if there is one.
+func (c *Client) cookieHeaders(u *url.URL, headers []hc.HeaderField) []hc.HeaderField {
+	if c.Jar == nil {
+		return headers
+	}
+	cookies := c.Jar.Cookies(u)
+	if len(cookies) == 0 {
+		return headers
+	}
+	values := make([]string, len(cookies))
+	for i, cookie := range cookies {
+		values[i] = cookie.Name + "=" + cookie.Value
+	}
+	return append(headers[:len(headers):len(headers)],
+		hc.HeaderField{Name: "cookie", Value: strings.Join(values, "; ")})
+}
+
+// saveCookies stores any cookies from the response in the jar.
+func (c *Client) saveCookies(u *url.URL, resp *ClientResponse) {
+	if c.Jar == nil {
+		return
+	}
+	cookies := (&http.Response{Header: httpHeader(resp.Headers)}).Cookies()
+	if len(cookies) > 0 {
+		c.Jar.SetCookies(u, cookies)
+	}
+}
+
+// fetch makes a single request and waits for the response.  GET requests use
+// Client.Cache, if there is one.
+func (c *Client) fetch(method string, u *url.URL, body []byte, headers []hc.HeaderField) (*ClientResponse, error) {
+	headers = c.cookieHeaders(u, headers)
+	expectContinue := c.ExpectContinue > 0 && len(body) > 0
+	if expectContinue {
+		headers = append(headers[:len(headers):len(headers)],
+			hc.HeaderField{Name: "expect", Value: "100-continue"})
+	}
+	req, err := c.Fetch(method, u.String(), headers...)
+	if err != nil {
+		return nil, err
+	}
+	if req.InformationalResponses != nil {
+		go func() {
+			for range req.InformationalResponses {
+			}
+		}()
+	}
+	go func() {
+		for pp := range req.Pushes {
+			_ = pp.Cancel()
+		}
+	}()
+	// A request that was answered from the cache or by a push has no stream,
+	// so there is nowhere to send the body.
+	if len(body) > 0 && req.s != nil && (!expectContinue || req.AwaitContinue(c.ExpectContinue)) {
+		_, err = req.Write(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = req.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp := req.Response()
+	if resp == nil {
+		return nil, ErrNoResponse
+	}
+	c.saveCookies(u, resp)
+	return resp, nil
+}
+
+// Do makes a request and waits for the response, following redirects as
+// directed by Client.Redirects, and using cookies from Client.Jar.  The
+// responses to any redirects that were followed are listed in the Via field
+// of the response.  Like Fetch, this isn't safe to run concurrently.
+func (c *Client) Do(method string, target string, body []byte, headers ...hc.HeaderField) (*ClientResponse, error) {
+	err := hc.ValidatePseudoHeaders(headers)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+
+	var via []*ClientResponse
+	for {
+		resp, err := c.fetch(method, u, body, headers)
+		if err != nil {
+			return nil, err
+		}
+		resp.Via = via
+
+		location := resp.GetHeader("location")
+		if !isRedirect(resp.Status) || location == "" {
+			return resp, nil
+		}
+		next, err := u.Parse(location)
+		if err != nil {
+			return resp, err
+		}
+		if c.Redirects.maxRedirects() < 0 {
+			return resp, nil
+		}
+		if len(via) >= c.Redirects.maxRedirects() {
+			return resp, ErrTooManyRedirects
+		}
+		if c.Redirects.Check != nil {
+			err = c.Redirects.Check(next, append(via, resp))
+			if err == ErrUseLastResponse {
+				return resp, nil
+			}
+			if err != nil {
+				return resp, err
+			}
+		}
+
+		// The body of the redirect isn't needed.
+		_ = resp.Cancel()
+		via = append(via, resp)
+		var keepBody bool
+		method, keepBody = c.Redirects.redirectMethod(resp.Status, method)
+		if !keepBody {
+			body = nil
+		}
+		headers = redirectHeaders(headers, u, next, keepBody)
+		u = next
+	}
+}
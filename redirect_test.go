@@ -0,0 +1,33 @@
+package minhq
+
+import (
+	"testing"
+
+	"github.com/stvp/assert"
+)
+
+func TestRedirectMethod(t *testing.T) {
+	for _, c := range []struct {
+		status     int
+		method     string
+		keepMethod bool
+		expected   string
+		keepBody   bool
+	}{
+		{301, "POST", false, "GET", false},
+		{302, "PUT", false, "GET", false},
+		{302, "DELETE", false, "GET", false},
+		{302, "GET", false, "GET", true},
+		{301, "HEAD", false, "HEAD", true},
+		{302, "PUT", true, "PUT", true},
+		{303, "PUT", true, "GET", false},
+		{303, "HEAD", false, "HEAD", true},
+		{307, "POST", false, "POST", true},
+		{308, "PUT", false, "PUT", true},
+	} {
+		p := RedirectPolicy{KeepMethod: c.keepMethod}
+		method, keepBody := p.redirectMethod(c.status, c.method)
+		assert.Equal(t, c.expected, method, c)
+		assert.Equal(t, c.keepBody, keepBody, c)
+	}
+}
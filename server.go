@@ -6,6 +6,7 @@ import (
 	"crypto/x509"
 	"errors"
 	"net"
+	"sync"
 
 	"github.com/ekr/minq"
 	"github.com/martinthomson/minhq/mw"
@@ -24,6 +25,9 @@ type Server struct {
 	// `go func() { for <-server.Connections != nil {} }()` unless they
 	// need direct access to the connection.
 	Connections <-chan *ServerConnection
+
+	sockets   []net.PacketConn
+	closeOnce sync.Once
 }
 
 func (s *Server) serviceConnections(requests chan<- *ServerRequest, connections chan<- *ServerConnection) {
@@ -41,13 +45,17 @@ func (s *Server) serviceConnections(requests chan<- *ServerRequest, connections
 // RunServer takes a minq Server and starts the various goroutines that service it.
 // Run Listen() for a basic server.
 func RunServer(ms *minq.Server, config *Config) *Server {
+	return runServer(mw.RunServer(ms), config)
+}
+
+func runServer(mws *mw.Server, config *Config) *Server {
 	requests := make(chan *ServerRequest)
 	var connections chan *ServerConnection
 	if config.TrackConnections {
 		connections = make(chan *ServerConnection)
 	}
 	s := &Server{
-		Server:      *mw.RunServer(ms),
+		Server:      *mws,
 		config:      config,
 		Requests:    requests,
 		Connections: connections,
@@ -79,27 +87,86 @@ func loadCert(config *minq.TlsConfig, certfile string, keyfile string) error {
 
 // Listen creates and starts a simple server.
 func Listen(host string, certfile string, keyfile string, config *Config) (*Server, error) {
-	serverName, _, err := net.SplitHostPort(host)
-	if err != nil {
-		return nil, err
+	return ListenAll([]string{host}, certfile, keyfile, config)
+}
+
+// ListenAll creates a server that listens on several addresses, such as an IPv4
+// and an IPv6 address.  Requests from all addresses are emitted on the same
+// Requests channel.  The name of the server is taken from the first address.
+func ListenAll(hosts []string, certfile string, keyfile string, config *Config) (*Server, error) {
+	if len(hosts) == 0 {
+		return nil, errors.New("no addresses to listen on")
 	}
-	addr, err := net.ResolveUDPAddr("udp", host)
+	serverName, _, err := net.SplitHostPort(hosts[0])
 	if err != nil {
 		return nil, err
 	}
-	sock, err := net.ListenUDP("udp", addr)
+
+	sockets := make([]net.PacketConn, 0, len(hosts))
+	closeAll := func() {
+		for _, sock := range sockets {
+			_ = sock.Close()
+		}
+	}
+	for _, host := range hosts {
+		addr, err := net.ResolveUDPAddr("udp", host)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		sock, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		sockets = append(sockets, sock)
+	}
+
+	server, err := serve(sockets, serverName, certfile, keyfile, config)
 	if err != nil {
+		closeAll()
 		return nil, err
 	}
+	return server, nil
+}
+
+// Serve creates a server that uses an existing socket.  This can be used with
+// sockets that are inherited from another process, or any other
+// net.PacketConn.  The addresses that the socket reports need to be UDP
+// addresses, or strings that can be resolved as UDP addresses.  The socket is
+// closed when the server is closed.
+func Serve(pc net.PacketConn, serverName string, certfile string, keyfile string, config *Config) (*Server, error) {
+	return serve([]net.PacketConn{pc}, serverName, certfile, keyfile, config)
+}
 
+func serve(sockets []net.PacketConn, serverName string, certfile string, keyfile string, config *Config) (*Server, error) {
 	minqConfig := minq.NewTlsConfig(serverName)
-	err = loadCert(&minqConfig, certfile, keyfile)
+	err := loadCert(&minqConfig, certfile, keyfile)
 	if err != nil {
 		return nil, err
 	}
-	tf := minq.NewUdpTransportFactory(sock)
-	minqServer := minq.NewServer(tf, &minqConfig, nil)
-	server := RunServer(minqServer, config)
-	go serviceUdpSocket(server.IncomingPackets, sock, server)
+	tf := newServerTransportFactory(sockets)
+	var server *Server
+	if config.serverShards() > 1 {
+		server = runServer(mw.RunShardedServer(config.serverShards(), tf, &minqConfig), config)
+	} else {
+		server = RunServer(minq.NewServer(tf, &minqConfig, nil), config)
+	}
+	server.sockets = sockets
+	pool := mw.NewPacketPool(config.maxPacketSize())
+	for _, sock := range sockets {
+		go servicePacketConn(server.IncomingPackets, sock, server, pool, tf.observer(sock))
+	}
 	return server, nil
 }
+
+// Close stops the server and closes any sockets that it uses.
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		for _, sock := range s.sockets {
+			_ = sock.Close()
+		}
+		_ = s.Server.Close()
+	})
+	return nil
+}
@@ -2,19 +2,26 @@ package minhq
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"sync"
 
 	"github.com/martinthomson/minhq/mw"
 )
 
+// ErrNoPushIDs is returned by ServerRequest.Push when the client hasn't allowed
+// any more pushes.  Use ServerRequest.PushContext to wait instead.
+var ErrNoPushIDs = errors.New("no push IDs available")
+
 // ServerConnection specializes Connection with server-related functions.
 type ServerConnection struct {
 	connection
 
-	pushIDLock sync.RWMutex
+	pushIDLock sync.Mutex
 	nextPushID uint64
 	maxPushID  uint64
+	// pushCredit is closed and replaced when MAX_PUSH_ID increases.
+	pushCredit chan struct{}
 
 	cancelledPushesLock sync.RWMutex
 	cancelledPushes     map[uint64]bool
@@ -28,6 +35,7 @@ func newServerConnection(mwc *mw.Connection, config *Config) *ServerConnection {
 			Connection: *mwc,
 			ready:      make(chan struct{}),
 		},
+		pushCredit:      make(chan struct{}),
 		cancelledPushes: make(map[uint64]bool),
 	}
 }
@@ -42,14 +50,66 @@ func (c *ServerConnection) Connect(requests chan<- *ServerRequest) error {
 	return nil
 }
 
+// serviceRequests takes new streams and queues them for a pool of workers.
+// This stops when the connection closes.
 func (c *ServerConnection) serviceRequests(requests chan<- *ServerRequest) {
-	for {
-		s := newStream(<-c.RemoteStreams)
-		req := newServerRequest(c, s)
-		go req.handle(requests)
+	q := newRequestQueue(c.config.requestQueueDepth(), c.config.maxConcurrentRequests(),
+		func(s *stream) {
+			newServerRequest(c, s).handle(requests)
+		})
+	defer q.close()
+
+	for ms := range c.RemoteStreams {
+		q.add(newStream(ms))
+	}
+}
+
+// requestQueue feeds requests to a pool of workers.  The size of the pool and
+// the queue are both limited.
+type requestQueue struct {
+	queue   chan *stream
+	workers chan struct{}
+	handle  func(*stream)
+}
+
+func newRequestQueue(depth int, maxWorkers int, handle func(*stream)) *requestQueue {
+	return &requestQueue{
+		queue:   make(chan *stream, depth),
+		workers: make(chan struct{}, maxWorkers),
+		handle:  handle,
+	}
+}
+
+// add queues a request.  If the queue is full, the stream is refused.
+func (q *requestQueue) add(s *stream) {
+	select {
+	case q.queue <- s:
+	default:
+		s.refuse(ErrHttpExcessiveLoad)
+		return
+	}
+
+	// Start another worker if the pool isn't full.  Workers run until the
+	// queue is closed, so this only ever adds workers.
+	select {
+	case q.workers <- struct{}{}:
+		go q.work()
+	default:
+	}
+}
+
+// work handles requests from the queue.
+func (q *requestQueue) work() {
+	for s := range q.queue {
+		q.handle(s)
 	}
 }
 
+// close stops the workers once the queue is empty.
+func (q *requestQueue) close() {
+	close(q.queue)
+}
+
 func (c *ServerConnection) handleMaxPushID(r FrameReader) error {
 	n, err := r.ReadVarint()
 	if err != nil {
@@ -66,22 +126,46 @@ func (c *ServerConnection) handleMaxPushID(r FrameReader) error {
 	defer c.pushIDLock.Unlock()
 	if n > c.maxPushID {
 		c.maxPushID = n
+		close(c.pushCredit)
+		c.pushCredit = make(chan struct{})
 	}
 	return nil
 }
 
-func (c *ServerConnection) getNextPushID() (uint64, error) {
-	c.pushIDLock.RLock()
-	defer c.pushIDLock.RUnlock()
+// takePushID allocates a push ID.  If none are available, this returns a
+// channel that is closed when the client allows more pushes.
+func (c *ServerConnection) takePushID() (uint64, <-chan struct{}) {
+	defer c.pushIDLock.Unlock()
+	c.pushIDLock.Lock()
 	if c.nextPushID >= c.maxPushID {
-		return 0, errors.New("No push IDs available")
+		return 0, c.pushCredit
 	}
-
 	id := c.nextPushID
 	c.nextPushID++
 	return id, nil
 }
 
+// getNextPushID allocates a push ID.  If ctx is nil, this fails immediately if
+// there are no push IDs available, otherwise it waits.
+func (c *ServerConnection) getNextPushID(ctx context.Context) (uint64, error) {
+	for {
+		id, credit := c.takePushID()
+		if credit == nil {
+			return id, nil
+		}
+		if ctx == nil {
+			return 0, ErrNoPushIDs
+		}
+		select {
+		case <-credit:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-c.Closed():
+			return 0, ErrNoPushIDs
+		}
+	}
+}
+
 func (c *ServerConnection) handleCancelPush(r FrameReader) error {
 	pushID, err := r.ReadVarint()
 	if err != nil {
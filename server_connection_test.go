@@ -0,0 +1,132 @@
+package minhq
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ekr/minq"
+	"github.com/stvp/assert"
+)
+
+// fakeStream is a minq.Stream that has no data and records how it was
+// stopped.
+type fakeStream struct {
+	id uint64
+
+	lock        sync.Mutex
+	reset       *uint16
+	stopSending *uint16
+}
+
+var _ minq.Stream = &fakeStream{}
+
+func (s *fakeStream) Id() uint64                      { return s.id }
+func (s *fakeStream) SendState() minq.SendStreamState { return 0 }
+func (s *fakeStream) RecvState() minq.RecvStreamState { return 0 }
+func (s *fakeStream) Write(p []byte) (int, error)     { return len(p), nil }
+func (s *fakeStream) Read(p []byte) (int, error)      { return 0, io.EOF }
+func (s *fakeStream) Close() error                    { return nil }
+
+func (s *fakeStream) Reset(code uint16) error {
+	defer s.lock.Unlock()
+	s.lock.Lock()
+	s.reset = &code
+	return nil
+}
+
+func (s *fakeStream) StopSending(code uint16) error {
+	defer s.lock.Unlock()
+	s.lock.Lock()
+	s.stopSending = &code
+	return nil
+}
+
+// refusedWith returns the error code that the stream was refused with, or nil.
+func (s *fakeStream) refusedWith() *uint16 {
+	defer s.lock.Unlock()
+	s.lock.Lock()
+	if s.reset == nil || s.stopSending == nil || *s.reset != *s.stopSending {
+		return nil
+	}
+	return s.reset
+}
+
+func TestRequestQueueFull(t *testing.T) {
+	started := make(chan uint64, 10)
+	release := make(chan struct{})
+	q := newRequestQueue(2, 1, func(s *stream) {
+		started <- s.Id()
+		<-release
+	})
+	defer q.close()
+
+	streams := make([]*fakeStream, 4)
+	for i := range streams {
+		streams[i] = &fakeStream{id: uint64(i * 4)}
+	}
+
+	// The first request occupies the only worker, the next two fill the
+	// queue, and the last is refused.
+	q.add(newStream(streams[0]))
+	assert.Equal(t, streams[0].id, <-started)
+	q.add(newStream(streams[1]))
+	q.add(newStream(streams[2]))
+	q.add(newStream(streams[3]))
+
+	for _, s := range streams[:3] {
+		assert.Nil(t, s.refusedWith())
+	}
+	refused := streams[3].refusedWith()
+	assert.NotNil(t, refused)
+	assert.Equal(t, uint16(ErrHttpExcessiveLoad), *refused)
+
+	// The queued requests are handled in turn.
+	close(release)
+	assert.Equal(t, streams[1].id, <-started)
+	assert.Equal(t, streams[2].id, <-started)
+}
+
+func TestRequestQueueConcurrency(t *testing.T) {
+	const maxWorkers = 2
+	const requests = 6
+
+	var active, highest int32
+	started := make(chan struct{}, requests)
+	release := make(chan struct{})
+	var done sync.WaitGroup
+	done.Add(requests)
+	q := newRequestQueue(requests, maxWorkers, func(s *stream) {
+		n := atomic.AddInt32(&active, 1)
+		for {
+			h := atomic.LoadInt32(&highest)
+			if n <= h || atomic.CompareAndSwapInt32(&highest, h, n) {
+				break
+			}
+		}
+		started <- struct{}{}
+		<-release
+		atomic.AddInt32(&active, -1)
+		done.Done()
+	})
+	defer q.close()
+
+	for i := 0; i < requests; i++ {
+		q.add(newStream(&fakeStream{id: uint64(i * 4)}))
+	}
+	for i := 0; i < maxWorkers; i++ {
+		<-started
+	}
+	// No more requests start while the workers are busy.
+	select {
+	case <-started:
+		t.Fatal("too many requests started")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	done.Wait()
+	assert.Equal(t, int32(maxWorkers), atomic.LoadInt32(&highest))
+}
@@ -2,10 +2,14 @@ package minhq
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
+	"net"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/martinthomson/minhq/hc"
 )
@@ -13,6 +17,22 @@ import (
 // ErrPushCancelled is used when a push response is created, but the push was already cancelled.
 var ErrPushCancelled = errors.New("push was already cancelled")
 
+// ErrPushMethod is returned when a push uses a method other than GET or HEAD.
+// Only safe, cacheable methods can be pushed.
+var ErrPushMethod = errors.New("pushes must use GET or HEAD")
+
+// ErrPushAuthority is returned when a push is for an authority that the server
+// isn't responsible for.  See Config.PushAuthorities.
+var ErrPushAuthority = errors.New("push target has the wrong authority")
+
+// ErrResponseStarted is returned when a response can't be changed because it
+// has already been sent.
+var ErrResponseStarted = errors.New("response has already started")
+
+// ErrNotInformational is returned by SendInformational for a status code that
+// isn't a 1xx code, or for 101 (Switching Protocols), which can't be used.
+var ErrNotInformational = errors.New("not an informational status code")
+
 // ServerRequest handles incoming requests.
 type ServerRequest struct {
 	C      *ServerConnection
@@ -21,6 +41,10 @@ type ServerRequest struct {
 	method string
 	target *url.URL
 	IncomingMessage
+
+	respondLock  sync.Mutex
+	responded    bool
+	continueOnce sync.Once
 }
 
 func newServerRequest(c *ServerConnection, s *stream) *ServerRequest {
@@ -53,6 +77,7 @@ func (req *ServerRequest) handle(requests chan<- *ServerRequest) {
 		return ErrUnsupportedFrame
 	})
 	if err != nil {
+		req.C.checkDecoderError(err)
 		req.s.abort()
 		return
 	}
@@ -97,12 +122,90 @@ func (req *ServerRequest) sendResponse(statusCode int, headers []hc.HeaderField,
 }
 
 // Respond creates a response, starting by writing the response header block.
+// A 1xx status code sends an informational response and returns nil; see
+// SendInformational.
 func (req *ServerRequest) Respond(statusCode int, headers ...hc.HeaderField) (*ServerResponse, error) {
-	return req.sendResponse(statusCode, headers, &req.s.sendStream, nil)
+	defer req.respondLock.Unlock()
+	req.respondLock.Lock()
+	if req.responded {
+		return nil, ErrResponseStarted
+	}
+	resp, err := req.sendResponse(statusCode, headers, &req.s.sendStream, nil)
+	if err == nil && statusCode >= 200 {
+		req.responded = true
+	}
+	return resp, err
+}
+
+// SendInformational sends an informational response, such as 103 (Early
+// Hints).  This can be used any number of times before Respond.  A 100
+// (Continue) response is sent automatically when the body of a request with
+// expect: 100-continue is first read, so that doesn't need to be sent.
+func (req *ServerRequest) SendInformational(statusCode int, headers ...hc.HeaderField) error {
+	if statusCode < 100 || statusCode >= 200 || statusCode == 101 {
+		return ErrNotInformational
+	}
+	_, err := req.Respond(statusCode, headers...)
+	return err
+}
+
+// Read reads the request body.  If the client asked for 100 (Continue), that
+// is sent first, unless a final response has already been sent.
+func (req *ServerRequest) Read(p []byte) (int, error) {
+	req.continueOnce.Do(func() {
+		if strings.EqualFold(req.GetHeader("expect"), "100-continue") {
+			_ = req.SendInformational(100)
+		}
+	})
+	return req.IncomingMessage.Read(p)
 }
 
-// Push creates a new server push.
+// normalAuthority lowercases the host of a URL and adds the default port.
+func normalAuthority(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	return net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+}
+
+// validatePush checks that a push uses a safe, cacheable method, and that the
+// target is either on the same authority as the request or on one listed in
+// Config.PushAuthorities.
+func (req *ServerRequest) validatePush(method string, target *url.URL) error {
+	if method != "GET" && method != "HEAD" {
+		return ErrPushMethod
+	}
+	if target.Scheme != req.target.Scheme {
+		return ErrPushAuthority
+	}
+	authority := normalAuthority(target)
+	if authority == normalAuthority(req.target) {
+		return nil
+	}
+	for _, a := range req.C.config.PushAuthorities {
+		if authority == normalAuthority(&url.URL{Host: a}) {
+			return nil
+		}
+	}
+	return ErrPushAuthority
+}
+
+// Push creates a new server push.  This fails with ErrNoPushIDs if the client
+// hasn't allowed any more pushes.
 func (req *ServerRequest) Push(method string, target string, headers ...hc.HeaderField) (*ServerPushRequest, error) {
+	return req.push(nil, method, target, headers)
+}
+
+// PushContext creates a new server push, waiting until the client allows more
+// pushes if necessary.  This fails if the context is done before that happens.
+func (req *ServerRequest) PushContext(ctx context.Context, method string, target string,
+	headers ...hc.HeaderField) (*ServerPushRequest, error) {
+	return req.push(ctx, method, target, headers)
+}
+
+func (req *ServerRequest) push(ctx context.Context, method string, target string,
+	headers []hc.HeaderField) (*ServerPushRequest, error) {
 	err := hc.ValidatePseudoHeaders(headers)
 	if err != nil {
 		return nil, err
@@ -111,8 +214,12 @@ func (req *ServerRequest) Push(method string, target string, headers ...hc.Heade
 	if err != nil {
 		return nil, err
 	}
+	err = req.validatePush(method, url)
+	if err != nil {
+		return nil, err
+	}
 
-	pushID, err := req.C.getNextPushID()
+	pushID, err := req.C.getNextPushID(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -126,6 +233,9 @@ func (req *ServerRequest) Push(method string, target string, headers ...hc.Heade
 	}
 
 	err = req.writePushPromise(push)
+	if err != nil {
+		return nil, err
+	}
 	return push, nil
 }
 
@@ -145,7 +255,8 @@ func (req *ServerRequest) writePushPromise(push *ServerPushRequest) error {
 	if err != nil {
 		return err
 	}
-	err = req.C.encoder.WriteHeaderBlock(headerWriter, req.s.Id(), push.Headers...)
+	err = req.C.encoder.WriteHeaderBlock(headerWriter, req.s.Id(),
+		markSensitive(push.Headers, req.C.sensitive)...)
 	if err != nil {
 		return err
 	}
@@ -167,6 +278,12 @@ func (resp *ServerResponse) Push(method string, target string, headers ...hc.Hea
 	return resp.Request.Push(method, target, headers...)
 }
 
+// PushContext just forwards the server push to ServerRequest.PushContext.
+func (resp *ServerResponse) PushContext(ctx context.Context, method string, target string,
+	headers ...hc.HeaderField) (*ServerPushRequest, error) {
+	return resp.Request.PushContext(ctx, method, target, headers...)
+}
+
 // ReferencePush just forwards the server push to ServerRequest.ReferencePush.
 func (resp *ServerResponse) ReferencePush(push *ServerPushRequest) error {
 	return resp.Request.ReferencePush(push)
@@ -0,0 +1,280 @@
+package minhq
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stvp/assert"
+)
+
+var errMemClosed = errors.New("closed")
+
+type memPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+// memPacketConn is a net.PacketConn that exists only in memory.  Packets are
+// delivered with deliver and packets that are sent can be read from sent.
+type memPacketConn struct {
+	local     net.Addr
+	incoming  chan memPacket
+	sent      chan memPacket
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newMemPacketConn(local net.Addr) *memPacketConn {
+	return &memPacketConn{
+		local:    local,
+		incoming: make(chan memPacket),
+		sent:     make(chan memPacket, 16),
+		closed:   make(chan struct{}),
+	}
+}
+
+// deliver passes a packet to the next ReadFrom call.
+func (pc *memPacketConn) deliver(data []byte, addr net.Addr) error {
+	select {
+	case pc.incoming <- memPacket{data, addr}:
+		return nil
+	case <-pc.closed:
+		return errMemClosed
+	}
+}
+
+func (pc *memPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case packet := <-pc.incoming:
+		return copy(p, packet.data), packet.addr, nil
+	case <-pc.closed:
+		return 0, nil, errMemClosed
+	}
+}
+
+func (pc *memPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-pc.closed:
+		return 0, errMemClosed
+	default:
+	}
+	pc.sent <- memPacket{append([]byte{}, p...), addr}
+	return len(p), nil
+}
+
+func (pc *memPacketConn) Close() error {
+	pc.closeOnce.Do(func() { close(pc.closed) })
+	return nil
+}
+
+func (pc *memPacketConn) isClosed() bool {
+	select {
+	case <-pc.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (pc *memPacketConn) LocalAddr() net.Addr                { return pc.local }
+func (pc *memPacketConn) SetDeadline(t time.Time) error      { return nil }
+func (pc *memPacketConn) SetReadDeadline(t time.Time) error  { return nil }
+func (pc *memPacketConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// writeTestCertificate makes a self-signed certificate and key and returns the
+// names of the files they are in.
+func writeTestCertificate(t *testing.T) (string, string, func()) {
+	dir, err := ioutil.TempDir("", "minhq")
+	assert.Nil(t, err)
+	cleanup := func() { _ = os.RemoveAll(dir) }
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	certfile := filepath.Join(dir, "cert.pem")
+	keyfile := filepath.Join(dir, "key.pem")
+	err = ioutil.WriteFile(certfile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0600)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(keyfile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), 0600)
+	assert.Nil(t, err)
+	return certfile, keyfile, cleanup
+}
+
+func TestServePacketConn(t *testing.T) {
+	certfile, keyfile, cleanup := writeTestCertificate(t)
+	defer cleanup()
+
+	pc := newMemPacketConn(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443})
+	server, err := Serve(pc, "example.com", certfile, keyfile, &Config{})
+	assert.Nil(t, err)
+
+	// The server reads from the socket.  Addresses that aren't UDP addresses
+	// are resolved.
+	err = pc.deliver([]byte{0}, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1234})
+	assert.Nil(t, err)
+	err = pc.deliver([]byte{0}, stringAddr("192.0.2.3:1234"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, server.Close())
+	assert.True(t, pc.isClosed())
+}
+
+// stringAddr is an address that isn't a *net.UDPAddr.
+type stringAddr string
+
+func (a stringAddr) Network() string { return "udp" }
+func (a stringAddr) String() string  { return string(a) }
+
+// freePorts finds local UDP addresses that aren't in use.
+func freePorts(t *testing.T, n int) []string {
+	var addrs []string
+	for i := 0; i < n; i++ {
+		sock, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		assert.Nil(t, err)
+		addrs = append(addrs, sock.LocalAddr().String())
+		defer sock.Close()
+	}
+	return addrs
+}
+
+// inUse checks whether a local address is bound.
+func inUse(addr string) bool {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return false
+	}
+	sock, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return true
+	}
+	_ = sock.Close()
+	return false
+}
+
+func TestListenAll(t *testing.T) {
+	certfile, keyfile, cleanup := writeTestCertificate(t)
+	defer cleanup()
+
+	addrs := freePorts(t, 2)
+	server, err := ListenAll(addrs, certfile, keyfile, &Config{})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(server.sockets))
+	for i, addr := range addrs {
+		assert.Equal(t, addr, server.sockets[i].LocalAddr().String())
+		assert.True(t, inUse(addr))
+	}
+
+	// Both sockets are read.
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err)
+	defer client.Close()
+	for _, addr := range addrs {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		assert.Nil(t, err)
+		_, err = client.WriteTo([]byte{0}, udpAddr)
+		assert.Nil(t, err)
+	}
+
+	assert.Nil(t, server.Close())
+	for _, addr := range addrs {
+		assert.False(t, inUse(addr))
+	}
+}
+
+func TestListenAllFailure(t *testing.T) {
+	certfile, keyfile, cleanup := writeTestCertificate(t)
+	defer cleanup()
+
+	// The first socket is closed if the second can't be opened.
+	addrs := freePorts(t, 1)
+	_, err := ListenAll([]string{addrs[0], "127.0.0.1:x"}, certfile, keyfile, &Config{})
+	assert.NotNil(t, err)
+	assert.False(t, inUse(addrs[0]))
+
+	_, err = ListenAll(nil, certfile, keyfile, &Config{})
+	assert.NotNil(t, err)
+}
+
+func TestServerTransportFactory(t *testing.T) {
+	local := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}
+	first := newMemPacketConn(local)
+	second := newMemPacketConn(local)
+	tf := newServerTransportFactory([]net.PacketConn{first, second})
+
+	remote := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1234}
+	_, err := tf.MakeTransport(remote)
+	assert.Equal(t, errUnknownRemote, err)
+
+	tf.observer(second)(remote)
+	transport, err := tf.MakeTransport(remote)
+	assert.Nil(t, err)
+	assert.Nil(t, transport.Send([]byte{1}))
+	sent := <-second.sent
+	assert.Equal(t, remote, sent.addr)
+
+	// The socket follows the remote address.
+	tf.observer(first)(remote)
+	transport, err = tf.MakeTransport(remote)
+	assert.Nil(t, err)
+	assert.Nil(t, transport.Send([]byte{2}))
+	sent = <-first.sent
+	assert.Equal(t, []byte{2}, sent.data)
+}
+
+// An address that keeps sending is remembered, even as generations rotate.
+func TestServerTransportFactoryRotation(t *testing.T) {
+	local := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}
+	first := newMemPacketConn(local)
+	second := newMemPacketConn(local)
+	tf := newServerTransportFactory([]net.PacketConn{first, second})
+
+	remote := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1234}
+	// Rotation happens when a new address is seen.
+	port := 1000
+	rotate := func() {
+		tf.rotated = time.Now().Add(-2 * socketMemory)
+		port++
+		tf.observe(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 3), Port: port}, first)
+	}
+
+	tf.observe(remote, second)
+	rotate()
+	// This is now only in the previous generation.  Seeing it again moves it
+	// back to the current generation.
+	tf.observe(remote, second)
+	rotate()
+	transport, err := tf.MakeTransport(remote)
+	assert.Nil(t, err)
+	assert.Nil(t, transport.Send([]byte{1}))
+	assert.Equal(t, remote, (<-second.sent).addr)
+
+	// An address that stops sending is eventually forgotten.
+	rotate()
+	rotate()
+	_, err = tf.MakeTransport(remote)
+	assert.Equal(t, errUnknownRemote, err)
+}
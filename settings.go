@@ -16,7 +16,7 @@ type settingType uint16
 
 const (
 	settingTableSize              = settingType(1)
-	settingMaxHeaderListSize      = settingType(6) // TODO implement
+	settingMaxHeaderListSize      = settingType(6)
 	settingMaxQpackBlockedStreams = settingType(7)
 )
 
@@ -36,6 +36,12 @@ func (sw *settingsWriter) WriteTo(w io.Writer) (written int64, err error) {
 	n, err = sw.writeIntSetting(fw, settingMaxQpackBlockedStreams,
 		uint64(sw.config.ConcurrentDecoders))
 	written += n
+	if err != nil || sw.config.MaxHeaderBlockSize <= 0 {
+		return
+	}
+	n, err = sw.writeIntSetting(fw, settingMaxHeaderListSize,
+		uint64(sw.config.MaxHeaderBlockSize))
+	written += n
 	return
 }
 
@@ -85,7 +91,10 @@ func (sr *settingsReader) readSettings(r FrameReader) error {
 			if n >= 1<<30 {
 				return ErrSettingValue
 			}
-			sr.c.encoder.SetCapacity(hc.TableCapacity(n))
+			err = sr.c.encoder.SetMaxCapacity(hc.TableCapacity(n))
+			if err != nil {
+				return err
+			}
 
 		case settingMaxQpackBlockedStreams:
 			n, err := lr.ReadVarint()
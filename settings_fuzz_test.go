@@ -0,0 +1,29 @@
+//go:build go1.18
+// +build go1.18
+
+package minhq
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/martinthomson/minhq/hc"
+)
+
+func FuzzReadSettings(f *testing.F) {
+	var buf bytes.Buffer
+	sw := &settingsWriter{&Config{DecoderTableCapacity: 4096, ConcurrentDecoders: 10,
+		MaxHeaderBlockSize: 16384}}
+	_, err := sw.WriteTo(&buf)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(buf.Bytes())
+	f.Add([]byte{0, 1, 1, 0x3f})
+	f.Fuzz(func(t *testing.T, input []byte) {
+		c := &connection{encoder: hc.NewQpackEncoder(ioutil.Discard, 0, 0)}
+		sr := &settingsReader{c}
+		_ = sr.readSettings(NewFrameReader(bytes.NewReader(input)))
+	})
+}
@@ -25,8 +25,13 @@ func (s *stream) Id() uint64 {
 
 // abort is the option of last resort.
 func (s *stream) abort() {
-	s.Reset(uint16(ErrHttpInternalError))
-	s.StopSending(uint16(ErrHttpInternalError))
+	s.refuse(ErrHttpInternalError)
+}
+
+// refuse stops both directions of the stream with the given error.
+func (s *stream) refuse(e HTTPError) {
+	s.Reset(uint16(e))
+	s.StopSending(uint16(e))
 }
 
 type sendStream struct {
@@ -0,0 +1,114 @@
+package minhq
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ekr/minq"
+)
+
+// errUnknownRemote is returned if a server tries to create a connection to an
+// address that it hasn't received packets from.
+var errUnknownRemote = errors.New("no socket for remote address")
+
+// packetConnTransport sends packets to a single remote address using a
+// net.PacketConn.
+type packetConnTransport struct {
+	socket net.PacketConn
+	remote net.Addr
+}
+
+// Send implements minq.Transport.
+func (t *packetConnTransport) Send(p []byte) error {
+	_, err := t.socket.WriteTo(p, t.remote)
+	return err
+}
+
+// socketMemory is how long serverTransportFactory remembers which socket a
+// remote address used.  Transports are created when the first packet from a
+// remote address arrives, so this doesn't need to be long.
+const socketMemory = time.Minute
+
+// serverTransportFactory makes transports for a server that listens on one or
+// more sockets.  When there are multiple sockets, it remembers which socket
+// each remote address last sent to, so that replies come from the same
+// socket.  Two generations of addresses are kept, which bounds the memory
+// that is used without tracking each address individually.
+type serverTransportFactory struct {
+	sockets []net.PacketConn
+
+	lock     sync.RWMutex
+	current  map[string]net.PacketConn
+	previous map[string]net.PacketConn
+	rotated  time.Time
+}
+
+func newServerTransportFactory(sockets []net.PacketConn) *serverTransportFactory {
+	return &serverTransportFactory{
+		sockets: sockets,
+		current: make(map[string]net.PacketConn),
+		rotated: time.Now(),
+	}
+}
+
+// observer returns a function that records packets arriving on the socket.
+// This returns nil if there is only one socket, because there is no need to
+// track anything in that case.
+func (tf *serverTransportFactory) observer(socket net.PacketConn) func(*net.UDPAddr) {
+	if len(tf.sockets) == 1 {
+		return nil
+	}
+	return func(remote *net.UDPAddr) {
+		tf.observe(remote, socket)
+	}
+}
+
+func (tf *serverTransportFactory) lookup(key string) net.PacketConn {
+	defer tf.lock.RUnlock()
+	tf.lock.RLock()
+	if socket := tf.current[key]; socket != nil {
+		return socket
+	}
+	return tf.previous[key]
+}
+
+// isCurrent returns true if the remote address is in the current generation
+// and uses the socket.
+func (tf *serverTransportFactory) isCurrent(key string, socket net.PacketConn) bool {
+	defer tf.lock.RUnlock()
+	tf.lock.RLock()
+	return tf.current[key] == socket
+}
+
+// observe records the socket that a remote address used.  Addresses that are
+// only in the previous generation are moved to the current one.
+func (tf *serverTransportFactory) observe(remote *net.UDPAddr, socket net.PacketConn) {
+	key := remote.String()
+	if tf.isCurrent(key, socket) {
+		return
+	}
+
+	defer tf.lock.Unlock()
+	tf.lock.Lock()
+	now := time.Now()
+	if now.Sub(tf.rotated) > socketMemory {
+		tf.previous = tf.current
+		tf.current = make(map[string]net.PacketConn)
+		tf.rotated = now
+	}
+	tf.current[key] = socket
+}
+
+// MakeTransport implements minq.TransportFactory.
+func (tf *serverTransportFactory) MakeTransport(remote *net.UDPAddr) (minq.Transport, error) {
+	if len(tf.sockets) == 1 {
+		return &packetConnTransport{tf.sockets[0], remote}, nil
+	}
+	socket := tf.lookup(remote.String())
+	if socket == nil {
+		return nil, errUnknownRemote
+	}
+	return &packetConnTransport{socket, remote}, nil
+}
@@ -0,0 +1,81 @@
+package minhq
+
+import (
+	"io"
+	"net"
+
+	"github.com/martinthomson/minhq/mw"
+)
+
+// packetReader reads one or more packets from a socket.  The packets that are
+// returned come from a mw.PacketPool, so they need to be released.  Passing
+// packets to mw.Connection or mw.Server does that.
+type packetReader interface {
+	ReadPackets() ([]*mw.Packet, error)
+}
+
+// udpAddr converts an address into the form that minq needs.
+func udpAddr(addr net.Addr) (*net.UDPAddr, error) {
+	if u, ok := addr.(*net.UDPAddr); ok {
+		return u, nil
+	}
+	return net.ResolveUDPAddr("udp", addr.String())
+}
+
+// servicePacketConn reads packets from the socket and feeds them to the
+// provided channel.  When the socket fails, the resource is closed.  If seen
+// isn't nil, it is told about the source of every packet.
+func servicePacketConn(packets chan<- *mw.Packet, socket net.PacketConn,
+	resource io.Closer, pool *mw.PacketPool, seen func(*net.UDPAddr)) {
+	defer resource.Close()
+
+	// Not every net.PacketConn has a UDP address, so this might be nil.
+	localAddr, _ := udpAddr(socket.LocalAddr())
+
+	reader := newPacketReader(socket, pool)
+	for {
+		batch, err := reader.ReadPackets()
+		if err != nil {
+			return
+		}
+		for _, p := range batch {
+			p.DestAddr = localAddr
+			if seen != nil {
+				seen(p.SrcAddr)
+			}
+			packets <- p
+		}
+	}
+}
+
+// singlePacketReader reads packets one at a time.
+type singlePacketReader struct {
+	socket net.PacketConn
+	pool   *mw.PacketPool
+	batch  [1]*mw.Packet
+}
+
+func newSinglePacketReader(socket net.PacketConn, pool *mw.PacketPool) *singlePacketReader {
+	return &singlePacketReader{socket: socket, pool: pool}
+}
+
+func (r *singlePacketReader) ReadPackets() ([]*mw.Packet, error) {
+	for {
+		p := r.pool.Get()
+		n, addr, err := r.socket.ReadFrom(p.Data)
+		if err != nil {
+			p.Release()
+			return nil, err
+		}
+		remoteAddr, err := udpAddr(addr)
+		if err != nil {
+			// minq can only handle UDP addresses, so drop this.
+			p.Release()
+			continue
+		}
+		p.Data = p.Data[:n]
+		p.SrcAddr = remoteAddr
+		r.batch[0] = p
+		return r.batch[:], nil
+	}
+}
@@ -0,0 +1,68 @@
+//go:build linux
+// +build linux
+
+package minhq
+
+import (
+	"net"
+
+	"github.com/martinthomson/minhq/mw"
+	"golang.org/x/net/ipv4"
+)
+
+// udpBatchSize is the number of packets that are read with each system call.
+const udpBatchSize = 16
+
+// batchPacketReader uses recvmmsg to read multiple packets at once.  This
+// works for both IPv4 and IPv6 sockets.
+type batchPacketReader struct {
+	conn    *ipv4.PacketConn
+	pool    *mw.PacketPool
+	msgs    []ipv4.Message
+	packets []*mw.Packet
+	batch   []*mw.Packet
+}
+
+func newPacketReader(socket net.PacketConn, pool *mw.PacketPool) packetReader {
+	udpSocket, ok := socket.(*net.UDPConn)
+	if !ok {
+		return newSinglePacketReader(socket, pool)
+	}
+	r := &batchPacketReader{
+		conn:    ipv4.NewPacketConn(udpSocket),
+		pool:    pool,
+		msgs:    make([]ipv4.Message, udpBatchSize),
+		packets: make([]*mw.Packet, udpBatchSize),
+		batch:   make([]*mw.Packet, 0, udpBatchSize),
+	}
+	for i := range r.msgs {
+		r.msgs[i].Buffers = make([][]byte, 1)
+	}
+	return r
+}
+
+func (r *batchPacketReader) ReadPackets() ([]*mw.Packet, error) {
+	// Only replace the packets that were handed out last time.
+	for i, p := range r.packets {
+		if p == nil {
+			p = r.pool.Get()
+			r.packets[i] = p
+		}
+		r.msgs[i].Buffers[0] = p.Data
+	}
+
+	n, err := r.conn.ReadBatch(r.msgs, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	r.batch = r.batch[:0]
+	for i, msg := range r.msgs[:n] {
+		p := r.packets[i]
+		r.packets[i] = nil
+		p.Data = p.Data[:msg.N]
+		p.SrcAddr, _ = msg.Addr.(*net.UDPAddr)
+		r.batch = append(r.batch, p)
+	}
+	return r.batch, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package minhq
+
+import (
+	"net"
+
+	"github.com/martinthomson/minhq/mw"
+)
+
+func newPacketReader(socket net.PacketConn, pool *mw.PacketPool) packetReader {
+	return newSinglePacketReader(socket, pool)
+}